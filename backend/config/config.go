@@ -3,7 +3,10 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -21,11 +24,32 @@ type AppConfig struct {
 	ServerPort       string
 	MongoURI         string
 	MongoDbName      string
-	JwtSecret        string   // 新增 JWT 密鑰
-	EncryptionSecret string   // 新增用於訊息加密的密鑰
-	StorageBaseURL   string   // 存儲基礎 URL
-	UseCloudflare    bool     // 是否使用 Cloudflare
-	AllowedOrigins   []string // 允許的來源
+	JwtSecret        string            // 新增 JWT 密鑰
+	EncryptionSecret string            // 新增用於訊息加密的密鑰
+	EncryptionKeys   map[string]string // 密鑰 ID 到密鑰的對應，用於輪換加密密鑰
+	EncryptionKeyID  string            // 新寫入使用的密鑰 ID
+	SearchSecret     string            // 消息搜尋盲索引使用的 HMAC 密鑰，必須與加密密鑰不同
+	StorageBaseURL   string            // 存儲基礎 URL
+	UseCloudflare    bool              // 是否使用 Cloudflare
+	AllowedOrigins   []string          // 允許的來源
+	AdminUserIDs     []string          // 可以存取監控端點的用戶 ID
+
+	MessageEditWindow        time.Duration // 發送後允許編輯消息的時間，0 表示不限制
+	MaxPinnedMessages        int           // 每個聊天室最多可置頂的消息數
+	ScheduledMessageInterval time.Duration // 定時消息發送器檢查到期任務的間隔
+	MessageSweepInterval     time.Duration // 清理過期消息的間隔
+	AccountPurgeDelay        time.Duration // 刪除帳號後可取消的期限，之後永久銷毀私聊內容
+
+	SocketRateLimits           map[string]EventRateLimit // Socket 事件的速率限制，"*" 為未列出事件的預設值
+	SocketFloodThreshold       int                       // 一分鐘內被限流多少次後暫時禁言
+	SocketMuteDuration         time.Duration             // 禁言持續的時間
+	SocketDisconnectAfterMutes int                       // 十分鐘內被禁言多少次後斷開連線
+}
+
+// EventRateLimit 令牌桶參數：每秒補充 Rate 個令牌，最多累積 Burst 個
+type EventRateLimit struct {
+	Rate  float64
+	Burst int
 }
 
 // LoadConfig 載入設定
@@ -98,6 +122,42 @@ func LoadConfig() AppConfig {
 		log.Fatal("ENCRYPTION_SECRET must be 32 bytes long for AES-256")
 	}
 
+	// 加密密鑰環，格式為 "id1:secret1,id2:secret2"；未設置時只有一把以 ENCRYPTION_SECRET 為密鑰的 "v1"
+	// 輪換時加入新密鑰並把 ENCRYPTION_KEY_ID 指向它，舊密鑰需保留到重新加密完成
+	encryptionKeys := map[string]string{"v1": encryptionSecret}
+	encryptionKeyID := "v1"
+	if v := strings.TrimSpace(os.Getenv("ENCRYPTION_KEYS")); v != "" {
+		encryptionKeys = map[string]string{}
+		encryptionKeyID = ""
+		for _, entry := range strings.Split(v, ",") {
+			id, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			if !ok || id == "" || secret == "" {
+				log.Fatalf("invalid ENCRYPTION_KEYS entry %q, expected id:secret", entry)
+			}
+			encryptionKeys[id] = secret
+			encryptionKeyID = id // 未指定時使用最後一把
+		}
+	}
+	if v := os.Getenv("ENCRYPTION_KEY_ID"); v != "" {
+		if _, ok := encryptionKeys[v]; !ok {
+			log.Fatalf("ENCRYPTION_KEY_ID %q not found in ENCRYPTION_KEYS", v)
+		}
+		encryptionKeyID = v
+	}
+
+	// 搜尋索引密鑰（未設置時停用消息搜尋）
+	searchSecret := os.Getenv("SEARCH_INDEX_SECRET")
+	if searchSecret != "" {
+		if searchSecret == encryptionSecret {
+			log.Fatal("SEARCH_INDEX_SECRET must be different from ENCRYPTION_SECRET")
+		}
+		for id, secret := range encryptionKeys {
+			if searchSecret == secret {
+				log.Fatalf("SEARCH_INDEX_SECRET must be different from ENCRYPTION_KEYS entry %q", id)
+			}
+		}
+	}
+
 	// 存儲配置
 	storageBaseURL := os.Getenv("STORAGE_BASE_URL")
 	useCloudflare := os.Getenv("USE_CLOUDFLARE") == "true"
@@ -134,6 +194,119 @@ func LoadConfig() AppConfig {
 		}
 	}
 
+	// 消息編輯時限（分鐘）
+	messageEditWindow := 15 * time.Minute
+	if v := os.Getenv("MESSAGE_EDIT_WINDOW_MINUTES"); v != "" {
+		if minutes, err := strconv.Atoi(v); err == nil && minutes >= 0 {
+			messageEditWindow = time.Duration(minutes) * time.Minute
+		} else {
+			log.Printf("Warning: invalid MESSAGE_EDIT_WINDOW_MINUTES %q, using default", v)
+		}
+	}
+
+	// 每個聊天室的置頂消息上限
+	maxPinnedMessages := 50
+	if v := os.Getenv("MAX_PINNED_MESSAGES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxPinnedMessages = n
+		} else {
+			log.Printf("Warning: invalid MAX_PINNED_MESSAGES %q, using default", v)
+		}
+	}
+
+	// 定時消息檢查間隔（秒）
+	scheduledMessageInterval := 5 * time.Second
+	if v := os.Getenv("SCHEDULED_MESSAGE_INTERVAL_SECONDS"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			scheduledMessageInterval = time.Duration(seconds) * time.Second
+		} else {
+			log.Printf("Warning: invalid SCHEDULED_MESSAGE_INTERVAL_SECONDS %q, using default", v)
+		}
+	}
+
+	// 過期消息清理間隔（秒）
+	messageSweepInterval := 30 * time.Second
+	if v := os.Getenv("MESSAGE_SWEEP_INTERVAL_SECONDS"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			messageSweepInterval = time.Duration(seconds) * time.Second
+		} else {
+			log.Printf("Warning: invalid MESSAGE_SWEEP_INTERVAL_SECONDS %q, using default", v)
+		}
+	}
+
+	// 刪除帳號後的冷靜期（小時），期間可以取消刪除
+	accountPurgeDelay := 7 * 24 * time.Hour
+	if v := os.Getenv("ACCOUNT_PURGE_DELAY_HOURS"); v != "" {
+		if hours, err := strconv.Atoi(v); err == nil && hours >= 0 {
+			accountPurgeDelay = time.Duration(hours) * time.Hour
+		} else {
+			log.Printf("Warning: invalid ACCOUNT_PURGE_DELAY_HOURS %q, using default", v)
+		}
+	}
+
+	// Socket 事件速率限制，格式為 "event=rate:burst"，例如 "chat_message=5:10,typing=2:5"，會覆蓋預設值
+	socketRateLimits := map[string]EventRateLimit{
+		"*":                {Rate: 10, Burst: 20},
+		"chat_message":     {Rate: 5, Burst: 10},
+		"image_message":    {Rate: 1, Burst: 3},
+		"voice_message":    {Rate: 1, Burst: 3},
+		"video_message":    {Rate: 1, Burst: 3},
+		"forward_messages": {Rate: 1, Burst: 3},
+		"typing":           {Rate: 3, Burst: 5},
+		"typing_start":     {Rate: 3, Burst: 5},
+		"typing_end":       {Rate: 3, Burst: 5},
+		"sync":             {Rate: 1, Burst: 5},
+	}
+	if v := strings.TrimSpace(os.Getenv("SOCKET_RATE_LIMITS")); v != "" {
+		for _, entry := range strings.Split(v, ",") {
+			event, spec, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			rateText, burstText, ok2 := strings.Cut(spec, ":")
+			rate, err := strconv.ParseFloat(rateText, 64)
+			burst, err2 := strconv.Atoi(burstText)
+			if !ok || !ok2 || event == "" || err != nil || err2 != nil || rate <= 0 || burst <= 0 {
+				log.Printf("Warning: invalid SOCKET_RATE_LIMITS entry %q, expected event=rate:burst", entry)
+				continue
+			}
+			socketRateLimits[event] = EventRateLimit{Rate: rate, Burst: burst}
+		}
+	}
+
+	socketFloodThreshold := 30
+	if v := os.Getenv("SOCKET_FLOOD_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			socketFloodThreshold = n
+		} else {
+			log.Printf("Warning: invalid SOCKET_FLOOD_THRESHOLD %q, using default", v)
+		}
+	}
+
+	// 禁言時間（秒）
+	socketMuteDuration := 60 * time.Second
+	if v := os.Getenv("SOCKET_MUTE_SECONDS"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			socketMuteDuration = time.Duration(seconds) * time.Second
+		} else {
+			log.Printf("Warning: invalid SOCKET_MUTE_SECONDS %q, using default", v)
+		}
+	}
+
+	socketDisconnectAfterMutes := 3
+	if v := os.Getenv("SOCKET_DISCONNECT_AFTER_MUTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			socketDisconnectAfterMutes = n
+		} else {
+			log.Printf("Warning: invalid SOCKET_DISCONNECT_AFTER_MUTES %q, using default", v)
+		}
+	}
+
+	// 管理員用戶 ID，以逗號分隔
+	var adminUserIDs []string
+	for _, id := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			adminUserIDs = append(adminUserIDs, id)
+		}
+	}
+
 	return AppConfig{
 		AppVersion:       "1.0.30", // 設定應用程式版本
 		Environment:      environment,
@@ -142,8 +315,23 @@ func LoadConfig() AppConfig {
 		MongoDbName:      mongoDbName,
 		JwtSecret:        jwtSecret,
 		EncryptionSecret: encryptionSecret,
+		EncryptionKeys:   encryptionKeys,
+		EncryptionKeyID:  encryptionKeyID,
+		SearchSecret:     searchSecret,
 		StorageBaseURL:   storageBaseURL,
 		UseCloudflare:    useCloudflare,
 		AllowedOrigins:   allowedOrigins,
+		AdminUserIDs:     adminUserIDs,
+
+		MessageEditWindow:        messageEditWindow,
+		MaxPinnedMessages:        maxPinnedMessages,
+		ScheduledMessageInterval: scheduledMessageInterval,
+		MessageSweepInterval:     messageSweepInterval,
+		AccountPurgeDelay:        accountPurgeDelay,
+
+		SocketRateLimits:           socketRateLimits,
+		SocketFloodThreshold:       socketFloodThreshold,
+		SocketMuteDuration:         socketMuteDuration,
+		SocketDisconnectAfterMutes: socketDisconnectAfterMutes,
 	}
 }
@@ -146,6 +146,13 @@ func DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		// 不返回錯誤，繼續刪除流程
 	}
 
+	// 🔥 私聊的聊天室密鑰在冷靜期結束後才由後台任務銷毀，期間仍可取消刪除
+	if chatService, ok := getChatService(r); ok {
+		if err := chatService.DeleteUserE2EKeys(ctx, userID); err != nil {
+			log.Printf("刪除端到端加密密鑰失敗: %v", err)
+		}
+	}
+
 	// 3. 終止所有登入會話
 	err = terminateAllUserSessions(ctx, store, objectID)
 	if err != nil {
@@ -153,6 +160,11 @@ func DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		// 不返回錯誤，繼續刪除流程
 	}
 
+	// 🔥 斷開用戶所有設備上仍在線的連線
+	if chatService, ok := getChatService(r); ok {
+		chatService.DisconnectUser(ctx, userID, "", models.DisconnectReasonAccountDeleted)
+	}
+
 	log.Printf("用戶帳號刪除成功 - UserID: %s", userID)
 
 	// 返回成功響應
@@ -199,6 +211,12 @@ func handleRelatedDataDeletion(ctx context.Context, store database.Store, userOb
 		log.Printf("刪除登入會話失敗: %v", err)
 	}
 
+	// 刪除尚未送達的離線消息記錄
+	_, err = store.Collection("pending_deliveries").DeleteMany(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		log.Printf("刪除待送達消息失敗: %v", err)
+	}
+
 	// 4. 處理聊天室相關數據
 	chatRoomCollection := store.Collection("chat_rooms")
 
@@ -370,11 +388,15 @@ func CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "帳號未被刪除"}`, http.StatusBadRequest)
 		return
 	}
+	if user.PurgeStartedAt != nil {
+		http.Error(w, `{"error": "帳號資料已永久清除，無法取消刪除"}`, http.StatusGone)
+		return
+	}
 
-	// 恢復帳號
-	_, err = userCollection.UpdateOne(
+	// 恢復帳號；與後台清除任務的認領互斥，已開始清除的帳號不會被恢復
+	result, err := userCollection.UpdateOne(
 		ctx,
-		bson.M{"_id": objectID},
+		bson.M{"_id": objectID, "is_deleted": true, "purge_started_at": bson.M{"$exists": false}},
 		bson.M{
 			"$set": bson.M{
 				"is_deleted": false,
@@ -392,6 +414,10 @@ func CancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "恢復帳號失敗"}`, http.StatusInternalServerError)
 		return
 	}
+	if result.MatchedCount == 0 {
+		http.Error(w, `{"error": "帳號資料已永久清除，無法取消刪除"}`, http.StatusGone)
+		return
+	}
 
 	log.Printf("帳號恢復成功 - UserID: %s", userID)
 
@@ -3,6 +3,7 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,10 +14,9 @@ import (
 	"strings"
 	"time"
 
-	"chatwme/backend/config"
 	"chatwme/backend/middleware"
 	"chatwme/backend/models"
-	"chatwme/backend/utils"
+	"chatwme/backend/services"
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
@@ -32,6 +32,7 @@ type SendMessageRequest struct {
 	FileURL  string `json:"file_url,omitempty"`
 	Duration int    `json:"duration,omitempty"`
 	FileSize int64  `json:"file_size,omitempty"`
+	ReplyTo  string `json:"reply_to,omitempty"` // 被回覆的消息 ID
 }
 
 // 🔥 修正后的 GetMessagesByRoom 函数 - 正确处理语音消息解密
@@ -53,11 +54,43 @@ func GetMessagesByRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 获取分页参数
+	// 获取分页参数：优先使用 before/after 游标，page 仅为旧版客户端保留
 	pageStr := r.URL.Query().Get("page")
 	limitStr := r.URL.Query().Get("limit")
+	beforeID := r.URL.Query().Get("before")
+	afterID := r.URL.Query().Get("after")
+	fromSeqStr := r.URL.Query().Get("from_seq")
+	toSeqStr := r.URL.Query().Get("to_seq")
 	includeVoice := r.URL.Query().Get("include_voice") == "true"
 
+	if beforeID != "" && afterID != "" {
+		http.Error(w, `{"error": "before 与 after 不能同时使用"}`, http.StatusBadRequest)
+		return
+	}
+
+	// 🔥 按序号区间补齐缺失的消息（闭区间），不能与游标混用
+	seqRange := bson.M{}
+	if fromSeqStr != "" {
+		fromSeq, err := strconv.ParseInt(fromSeqStr, 10, 64)
+		if err != nil || fromSeq < 0 {
+			http.Error(w, `{"error": "无效的 from_seq"}`, http.StatusBadRequest)
+			return
+		}
+		seqRange["$gte"] = fromSeq
+	}
+	if toSeqStr != "" {
+		toSeq, err := strconv.ParseInt(toSeqStr, 10, 64)
+		if err != nil || toSeq < 0 {
+			http.Error(w, `{"error": "无效的 to_seq"}`, http.StatusBadRequest)
+			return
+		}
+		seqRange["$lte"] = toSeq
+	}
+	if len(seqRange) > 0 && (beforeID != "" || afterID != "") {
+		http.Error(w, `{"error": "序号区间不能与游标同时使用"}`, http.StatusBadRequest)
+		return
+	}
+
 	page := 1
 	limit := 50
 
@@ -73,12 +106,16 @@ func GetMessagesByRoom(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	cfg := config.LoadConfig()
 	store, ok := getStore(r)
 	if !ok {
 		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
 		return
 	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
 
 	// 验证用户权限
 	roomCollection := store.Collection("chat_rooms")
@@ -108,9 +145,8 @@ func GetMessagesByRoom(w http.ResponseWriter, r *http.Request) {
 
 	// 获取消息
 	messageCollection := store.Collection("messages")
-	skip := (page - 1) * limit
 
-	filter := bson.M{
+	baseFilter := bson.M{
 		"room":       roomID,
 		"is_deleted": bson.M{"$ne": true}, // 排除已刪除的消息
 	}
@@ -118,10 +154,67 @@ func GetMessagesByRoom(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Including voice messages in query for room %s", roomID)
 	}
 
+	// 真实的消息总数，而不是当前页的长度
+	total, err := messageCollection.CountDocuments(ctx, baseFilter)
+	if err != nil {
+		http.Error(w, `{"error": "查询讯息时发生错误"}`, http.StatusInternalServerError)
+		log.Printf("Error counting messages for room %s: %v", roomID, err)
+		return
+	}
+
+	// 🔥 游标分页：以 (timestamp, _id) 作为排序键，新消息到达时不会造成漏读或重复
+	filter := bson.M{}
+	for key, value := range baseFilter {
+		filter[key] = value
+	}
+
+	cursorID := beforeID
+	if afterID != "" {
+		cursorID = afterID
+	}
+	if cursorID != "" {
+		cursorObjectID, err := primitive.ObjectIDFromHex(cursorID)
+		if err != nil {
+			http.Error(w, `{"error": "无效的游标"}`, http.StatusBadRequest)
+			return
+		}
+
+		// 游标消息可能已被删除，因此这里不过滤 is_deleted
+		var cursorMessage models.Message
+		err = messageCollection.FindOne(ctx, bson.M{"_id": cursorObjectID, "room": roomID}).Decode(&cursorMessage)
+		if err != nil {
+			http.Error(w, `{"error": "游标消息不存在"}`, http.StatusBadRequest)
+			return
+		}
+
+		op := "$lt"
+		if afterID != "" {
+			op = "$gt"
+		}
+		filter["$or"] = []bson.M{
+			{"timestamp": bson.M{op: cursorMessage.Timestamp}},
+			{"timestamp": cursorMessage.Timestamp, "_id": bson.M{op: cursorObjectID}},
+		}
+	}
+
+	// after 方向与序号区间按正序读取，其余情况按时间倒序读取最新的消息
+	sortOrder := -1
+	if afterID != "" || len(seqRange) > 0 {
+		sortOrder = 1
+	}
+
+	sortKeys := bson.D{{Key: "timestamp", Value: sortOrder}, {Key: "_id", Value: sortOrder}}
+	if len(seqRange) > 0 {
+		filter["seq"] = seqRange
+		sortKeys = bson.D{{Key: "seq", Value: sortOrder}}
+	}
+
 	findOptions := options.Find()
-	findOptions.SetSort(bson.D{{Key: "timestamp", Value: -1}})
-	findOptions.SetLimit(int64(limit))
-	findOptions.SetSkip(int64(skip))
+	findOptions.SetSort(sortKeys)
+	findOptions.SetLimit(int64(limit + 1)) // 多取一条用于判断 has_more
+	if cursorID == "" && len(seqRange) == 0 && page > 1 {
+		findOptions.SetSkip(int64((page - 1) * limit))
+	}
 
 	cursor, err := messageCollection.Find(ctx, filter, findOptions)
 	if err != nil {
@@ -138,14 +231,23 @@ func GetMessagesByRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	encryptionKey := []byte(cfg.EncryptionSecret)
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	// 🔥 根据各成员的已读位置推导 read_by
+	if err := chatService.ApplyReadCursors(ctx, messages); err != nil {
+		log.Printf("Failed to load read cursors for room %s: %v", roomID, err)
+	}
+
 	userCollection := store.Collection("users")
 
 	// 🔥 关键修正：处理所有消息类型并正确解密
 	decryptedMessages := make([]map[string]interface{}, 0, len(messages))
 	for _, msg := range messages {
 		// 解密消息内容
-		decryptedContent, err := utils.Decrypt(msg.Content, encryptionKey)
+		decryptedContent, err := chatService.DecryptMessage(ctx, msg)
 		if err != nil {
 			log.Printf("Could not decrypt message ID %s: %v", msg.ID.Hex(), err)
 			decryptedContent = "[讯息无法解密]"
@@ -168,93 +270,63 @@ func GetMessagesByRoom(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// 🔥 构建基本消息对象
-		messageObj := map[string]interface{}{
-			"id":          msg.ID.Hex(),
-			"sender_id":   msg.SenderID,
-			"sender_name": senderName,
-			"room":        msg.Room,
-			"timestamp":   msg.Timestamp.Format(time.RFC3339),
-			"type":        msg.Type,
-			"read_by":     msg.ReadBy, // 🔥 新增：已读状态
-		}
-
-		if msg.Type == "voice" {
-			// 语音消息：解析JSON内容并添加相关字段
-			var voiceInfo map[string]interface{}
-			if err := json.Unmarshal([]byte(decryptedContent), &voiceInfo); err == nil {
-				messageObj["content"] = "[语音消息]" // 显示文本
-				messageObj["file_url"] = voiceInfo["file_url"]
-				messageObj["duration"] = voiceInfo["duration"]
-				messageObj["file_size"] = voiceInfo["file_size"]
-			} else {
-				log.Printf("Error parsing voice message content for message %s: %v", msg.ID.Hex(), err)
-				// 🔥 新增：尝试处理旧格式的语音消息
-				if strings.Contains(decryptedContent, "audio/") || strings.Contains(decryptedContent, ".m4a") {
-					// 可能是旧格式，直接作为文件路径使用
-					baseURL := "https://api-chatwmex.phdev.uk/uploads"
-					fileURL := decryptedContent
-					if !strings.HasPrefix(fileURL, "http") {
-						normalizedPath := strings.ReplaceAll(decryptedContent, "\\", "/")
-						fileURL = fmt.Sprintf("%s/%s", strings.TrimRight(baseURL, "/"), strings.TrimLeft(normalizedPath, "/"))
-					}
-
-					messageObj["content"] = "[语音消息]"
-					messageObj["file_url"] = fileURL
-					messageObj["duration"] = 0  // 默认值
-					messageObj["file_size"] = 0 // 默认值
-
-					log.Printf("✅ Processed legacy voice message %s: %s", msg.ID.Hex(), fileURL)
-				} else {
-					// 完全无法解析的消息
-					messageObj["content"] = "[语音消息解析失败]"
-					messageObj["file_url"] = nil
-					messageObj["duration"] = 0
-					messageObj["file_size"] = 0
-				}
-			}
-		} else if msg.Type == "image" {
-			// 图片消息
-			var imageInfo map[string]interface{}
-			if err := json.Unmarshal([]byte(decryptedContent), &imageInfo); err == nil {
-				messageObj["content"] = "[图片]"
-				messageObj["file_url"] = imageInfo["file_url"]
-			} else {
-				messageObj["content"] = "[图片解析失败]"
-			}
-		} else if msg.Type == "video" {
-			// 视频消息
-			var videoInfo map[string]interface{}
-			if err := json.Unmarshal([]byte(decryptedContent), &videoInfo); err == nil {
-				messageObj["content"] = "[视频]"
-				messageObj["file_url"] = videoInfo["file_url"]
-				messageObj["duration"] = videoInfo["duration"]
-				messageObj["file_size"] = videoInfo["file_size"]
-			} else {
-				messageObj["content"] = "[视频解析失败]"
-			}
-		} else {
-			// 普通文本消息
-			messageObj["content"] = decryptedContent
-		}
+		// 🔥 构建消息对象（与 Socket 同步事件使用相同格式）
+		messageObj := services.BuildMessagePayload(msg, senderName, decryptedContent)
 
 		decryptedMessages = append(decryptedMessages, messageObj)
 	}
 
-	// 反转数组，使最旧的消息在前
-	for i, j := 0, len(decryptedMessages)-1; i < j; i, j = i+1, j-1 {
-		decryptedMessages[i], decryptedMessages[j] = decryptedMessages[j], decryptedMessages[i]
+	// 倒序查询的结果需要反转，使最旧的消息在前
+	if sortOrder < 0 {
+		for i, j := 0, len(decryptedMessages)-1; i < j; i, j = i+1, j-1 {
+			decryptedMessages[i], decryptedMessages[j] = decryptedMessages[j], decryptedMessages[i]
+		}
 	}
 
 	if decryptedMessages == nil {
 		decryptedMessages = []map[string]interface{}{}
 	}
 
+	// 🔥 补上被引用消息的摘要与话题回复数
+	if err := chatService.AttachReplyContext(ctx, roomID, decryptedMessages); err != nil {
+		log.Printf("Failed to attach reply context for room %s: %v", roomID, err)
+	}
+
+	// next_cursor 指向同方向的下一页：向前翻页取最旧的一条，向后同步取最新的一条
+	var nextCursor interface{}
+	if hasMore && len(decryptedMessages) > 0 {
+		if sortOrder > 0 {
+			nextCursor = decryptedMessages[len(decryptedMessages)-1]["id"]
+		} else {
+			nextCursor = decryptedMessages[0]["id"]
+		}
+	}
+
 	response := map[string]interface{}{
-		"messages": decryptedMessages,
-		"page":     page,
-		"limit":    limit,
-		"total":    len(decryptedMessages),
+		"messages":    decryptedMessages,
+		"page":        page,
+		"limit":       limit,
+		"total":       total,
+		"has_more":    hasMore,
+		"next_cursor": nextCursor,
+	}
+
+	// 🔥 序号区间内已过期清理或从未写入消息的序号，客户端据此区分「不存在」与「尚未取得」
+	if len(seqRange) > 0 {
+		tombstoneRange := bson.M{}
+		for key, value := range seqRange {
+			tombstoneRange[key] = value
+		}
+		if hasMore && len(messages) > 0 {
+			// 只返回本页范围内的序号，其余的由下一页返回
+			tombstoneRange["$lte"] = messages[len(messages)-1].Seq
+		}
+		removedSeqs, err := chatService.SeqTombstones(ctx, roomID, tombstoneRange)
+		if err != nil {
+			log.Printf("Failed to load removed seqs for room %s: %v", roomID, err)
+			removedSeqs = []map[string]interface{}{}
+		}
+		response["removed_seqs"] = removedSeqs
 	}
 
 	log.Printf("✅ Returning %d messages for room %s (voice messages included: %v)",
@@ -296,12 +368,16 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 		req.Type = "text"
 	}
 
-	cfg := config.LoadConfig()
 	store, ok := getStore(r)
 	if !ok {
 		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
 		return
 	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
 
 	// 驗證用戶是否有權限訪問此聊天室
 	roomCollection := store.Collection("chat_rooms")
@@ -350,9 +426,24 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// 驗證被回覆的消息屬於同一聊天室
+	var replyTo, threadRoot string
+	if req.ReplyTo != "" {
+		replyTo, threadRoot, err = chatService.ResolveReplyTarget(ctx, roomID, req.ReplyTo)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidReplyTarget) {
+				http.Error(w, `{"error": "回覆的消息不存在或不在此聊天室"}`, http.StatusBadRequest)
+			} else {
+				log.Printf("Failed to resolve reply target: %v", err)
+				http.Error(w, `{"error": "查找回覆消息失敗"}`, http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
 	// 🔥 修正：根據消息類型處理不同的內容加密
 	var encryptedContent string
-	encryptionKey := []byte(cfg.EncryptionSecret)
+	plainContent := req.Content // 用於生成聊天室列表的預覽
 
 	if req.Type == "voice" {
 		// 語音消息：構建語音信息JSON並加密
@@ -369,7 +460,8 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		encryptedContent, err = utils.Encrypt(string(contentBytes), encryptionKey)
+		plainContent = string(contentBytes)
+		encryptedContent, err = chatService.EncryptContent(ctx, roomID, plainContent)
 		if err != nil {
 			log.Printf("Error encrypting voice message: %v", err)
 			http.Error(w, `{"error": "語音消息加密失敗"}`, http.StatusInternalServerError)
@@ -388,7 +480,8 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		encryptedContent, err = utils.Encrypt(string(contentBytes), encryptionKey)
+		plainContent = string(contentBytes)
+		encryptedContent, err = chatService.EncryptContent(ctx, roomID, plainContent)
 		if err != nil {
 			log.Printf("Error encrypting image message: %v", err)
 			http.Error(w, `{"error": "图片消息加密失败"}`, http.StatusInternalServerError)
@@ -409,15 +502,28 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		encryptedContent, err = utils.Encrypt(string(contentBytes), encryptionKey)
+		plainContent = string(contentBytes)
+		encryptedContent, err = chatService.EncryptContent(ctx, roomID, plainContent)
 		if err != nil {
 			log.Printf("Error encrypting video message: %v", err)
 			http.Error(w, `{"error": "视频消息加密失败"}`, http.StatusInternalServerError)
 			return
 		}
+	} else if req.Type == models.MessageTypeE2E {
+		// 端到端加密消息：內容已由客戶端加密，原樣保存，僅限私聊
+		if err := chatService.CheckE2ERoom(ctx, roomObjectID); err != nil {
+			if errors.Is(err, services.ErrE2EDirectOnly) {
+				http.Error(w, `{"error": "端到端加密消息只能在私聊中發送"}`, http.StatusBadRequest)
+			} else {
+				log.Printf("Error checking e2e room %s: %v", roomID, err)
+				http.Error(w, `{"error": "查找聊天室失敗"}`, http.StatusInternalServerError)
+			}
+			return
+		}
+		encryptedContent = req.Content
 	} else {
 		// 普通文本消息：直接加密內容
-		encryptedContent, err = utils.Encrypt(req.Content, encryptionKey)
+		encryptedContent, err = chatService.EncryptContent(ctx, roomID, req.Content)
 		if err != nil {
 			log.Printf("Error encrypting message: %v", err)
 			http.Error(w, `{"error": "消息加密失敗"}`, http.StatusInternalServerError)
@@ -449,40 +555,22 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 		Content:    encryptedContent, // 存儲加密後的內容
 		Timestamp:  time.Now(),
 		Type:       req.Type, // 🔥 確保包含消息類型
+		ReplyTo:    replyTo,
+		ThreadRoot: threadRoot,
+	}
+	if req.Type == models.MessageTypeText {
+		newMessage.SearchTokens = chatService.SearchTokens(req.Content)
 	}
 
-	// 保存消息到資料庫
-	messageCollection := store.Collection("messages")
-	result, err := messageCollection.InsertOne(ctx, newMessage)
-	if err != nil {
+	// 保存消息到資料庫（同時分配房間內的序號）
+	if err := chatService.InsertMessage(ctx, &newMessage); err != nil {
 		log.Printf("Failed to save message: %v", err)
 		http.Error(w, `{"error": "保存消息失敗"}`, http.StatusInternalServerError)
 		return
 	}
 
-	// 更新聊天室的最後消息
-	lastMessageContent := req.Content
-	if req.Type == "voice" {
-		lastMessageContent = "[语音消息]" // 為語音消息顯示特殊文本
-	} else if req.Type == "image" {
-		lastMessageContent = "[图片]" // 为图片消息显示特殊文本
-	} else if req.Type == "video" {
-		lastMessageContent = "[视频]" // 为视频消息显示特殊文本
-	}
-
-	roomUpdate := bson.M{
-		"$set": bson.M{
-			"last_message":      lastMessageContent,
-			"last_message_time": newMessage.Timestamp,
-			"updated_at":        time.Now(),
-		},
-		"$inc": bson.M{
-			"unread_count": 1, // 增加未讀計數
-		},
-	}
-
-	_, err = roomCollection.UpdateOne(ctx, bson.M{"_id": roomObjectID}, roomUpdate)
-	if err != nil {
+	// 更新聊天室的最後消息（預覽加密保存）
+	if err := chatService.UpdateRoomPreview(ctx, roomObjectID, newMessage, plainContent); err != nil {
 		log.Printf("Failed to update room last message: %v", err)
 	}
 
@@ -496,6 +584,11 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 		"timestamp":   newMessage.Timestamp.Format(time.RFC3339),
 		"type":        req.Type,
 		"read_by":     []string{}, // 🔥 新增：初始已读列表为空
+		"seq":         newMessage.Seq,
+	}
+	if replyTo != "" {
+		responseMessage["reply_to"] = replyTo
+		responseMessage["thread_root"] = threadRoot
 	}
 
 	// 如果是語音消息，添加語音相關字段
@@ -516,7 +609,7 @@ func SendMessage(w http.ResponseWriter, r *http.Request) {
 
 	response := map[string]interface{}{
 		"message": responseMessage,
-		"id":      result.InsertedID,
+		"id":      newMessage.ID,
 	}
 
 	log.Printf("Message sent successfully - Room: %s, User: %s, Type: %s", roomID, user.Username, req.Type)
@@ -559,6 +652,14 @@ func UploadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 指定聊天室时以聊天室密钥加密保存，只有成员可以下载
+	if roomID := r.FormValue("room_id"); roomID != "" {
+		uploadRoomMedia(w, r, roomID, ext, file)
+		return
+	}
+
+	// 未指定聊天室的旧版客户端仍保存为公开文件，保持兼容
+
 	// 生成唯一文件名
 	filename := fmt.Sprintf("img_%d%s", time.Now().UnixNano(), ext)
 	fullPath := filepath.Join(uploadPath, filename)
@@ -618,6 +719,14 @@ func UploadVideo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 指定聊天室时以聊天室密钥加密保存，只有成员可以下载
+	if roomID := r.FormValue("room_id"); roomID != "" {
+		uploadRoomMedia(w, r, roomID, ext, file)
+		return
+	}
+
+	// 未指定聊天室的旧版客户端仍保存为公开文件，保持兼容
+
 	// 生成唯一文件名
 	filename := fmt.Sprintf("vid_%d%s", time.Now().UnixNano(), ext)
 	fullPath := filepath.Join(uploadPath, filename)
@@ -644,3 +753,45 @@ func UploadVideo(w http.ResponseWriter, r *http.Request) {
 		"url": fileURL,
 	})
 }
+
+// uploadRoomMedia 以聊天室密钥加密保存上传的媒体，返回只有聊天室成员可以访问的地址
+func uploadRoomMedia(w http.ResponseWriter, r *http.Request, roomID, ext string, file io.Reader) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	inRoom, err := chatService.IsUserInRoom(ctx, roomObjectID, userID)
+	if err != nil || !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	fileURL, size, err := chatService.StoreRoomMedia(ctx, roomID, ext, file)
+	if err != nil {
+		log.Printf("Failed to store media for room %s: %v", roomID, err)
+		http.Error(w, `{"error": "保存文件失败"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":       fileURL,
+		"file_size": size,
+	})
+}
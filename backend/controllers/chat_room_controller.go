@@ -3,6 +3,8 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -10,6 +12,7 @@ import (
 
 	"chatwme/backend/middleware"
 	"chatwme/backend/models"
+	"chatwme/backend/services"
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
@@ -98,6 +101,24 @@ func GetChatRooms(w http.ResponseWriter, r *http.Request) {
 		rooms = []models.ChatRoom{}
 	}
 
+	// 🔥 填充當前用戶自己的未讀消息數與提及數
+	if chatService, ok := getChatService(r); ok && len(rooms) > 0 {
+		roomIDs := make([]string, 0, len(rooms))
+		for _, room := range rooms {
+			roomIDs = append(roomIDs, room.ID.Hex())
+		}
+		counts, err := chatService.GetUnreadCounts(ctx, userID, roomIDs)
+		if err != nil {
+			log.Printf("Error loading unread counts for user %s: %v", userID, err)
+		}
+		for i := range rooms {
+			count := counts[rooms[i].ID.Hex()]
+			rooms[i].UnreadCount = count.UnreadCount
+			rooms[i].MentionCount = count.MentionCount
+		}
+		chatService.DecryptRoomPreviews(ctx, rooms)
+	}
+
 	// 返回聊天室列表
 	response := map[string]interface{}{
 		"rooms": rooms,
@@ -242,6 +263,10 @@ func GetRoomDetails(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if chatService, ok := getChatService(r); ok {
+		room.LastMessage = chatService.DecryptRoomPreview(ctx, room.ID.Hex(), room.LastMessage)
+	}
+
 	// 返回聊天室詳情
 	response := map[string]interface{}{
 		"room": room,
@@ -395,11 +420,22 @@ func LeaveRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 🔥 移出用戶的所有連線，離開後不再收到聊天室廣播
+	if chatService, ok := getChatService(r); ok {
+		chatService.EvictFromRoom(ctx, roomID, userID)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "已離開聊天室"})
 }
 
-// MarkAsRead 標記聊天室為已讀
+// MarkReadRequest 標記已讀的請求結構，未提供位置時表示讀到最新一條
+type MarkReadRequest struct {
+	MessageID string `json:"message_id"`
+	Seq       int64  `json:"seq"`
+}
+
+// MarkAsRead 將用戶在聊天室中的已讀位置移動到指定消息
 func MarkAsRead(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -421,43 +457,54 @@ func MarkAsRead(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	store, ok := getStore(r)
+	// 請求體可以為空（舊版客戶端），此時標記到最新一條
+	var req MarkReadRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	chatService, ok := getChatService(r)
 	if !ok {
-		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
 		return
 	}
-	roomCollection := store.Collection("chat_rooms")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// 將未讀計數重置為 0
-	filter := bson.M{
-		"_id": objectID,
-		"$or": []bson.M{
-			{"participants": userID},
-			{"created_by": userID},
-		},
+	inRoom, err := chatService.IsUserInRoom(ctx, objectID, userID)
+	if err != nil {
+		log.Printf("檢查聊天室權限失敗: %v", err)
+		http.Error(w, `{"error": "檢查聊天室權限失敗"}`, http.StatusInternalServerError)
+		return
 	}
-
-	update := bson.M{
-		"$set": bson.M{
-			"unread_count": 0,
-			"updated_at":   time.Now(),
-		},
+	if !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusNotFound)
+		return
 	}
 
-	result, err := roomCollection.UpdateOne(ctx, filter, update)
+	cursor, advanced, err := chatService.MarkRoomRead(ctx, roomID, userID, services.ReadPosition{
+		MessageID: req.MessageID,
+		Seq:       req.Seq,
+	})
 	if err != nil {
+		if errors.Is(err, services.ErrInvalidReadPosition) {
+			http.Error(w, `{"error": "無效的已讀位置"}`, http.StatusBadRequest)
+			return
+		}
 		log.Printf("Error marking room as read: %v", err)
 		http.Error(w, `{"error": "標記已讀失敗"}`, http.StatusInternalServerError)
 		return
 	}
 
-	if result.MatchedCount == 0 {
-		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusNotFound)
-		return
+	readData := services.ReadCursorPayload(cursor)
+	if advanced {
+		chatService.BroadcastToRoom(roomID, "message_read", readData)
 	}
 
+	readData["message"] = "已標記為已讀"
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "已標記為已讀"})
+	json.NewEncoder(w).Encode(readData)
 }
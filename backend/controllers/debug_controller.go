@@ -53,6 +53,7 @@ func DebugSystemInfo(w http.ResponseWriter, r *http.Request) {
 		"storage_base_url":      storageBaseURL,
 		"mongo_db_name":         cfg.MongoDbName,
 		"encryption_key_length": len(cfg.EncryptionSecret),
+		"encryption_key_id":     cfg.EncryptionKeyID,
 		"environment":           getEnvironmentInfo(),
 		"timestamp":             time.Now().Format(time.RFC3339),
 	}
@@ -88,12 +89,16 @@ func DebugVoiceMessageDetailed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cfg := config.LoadConfig()
 	store, ok := getStore(r)
 	if !ok {
 		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
 		return
 	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
 	messageCollection := store.Collection("messages")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -128,8 +133,7 @@ func DebugVoiceMessageDetailed(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// 尝试解密内容
-		encryptionKey := []byte(cfg.EncryptionSecret)
-		decryptedContent, decryptErr := utils.Decrypt(message.Content, encryptionKey)
+		decryptedContent, decryptErr := chatService.DecryptMessage(ctx, message)
 
 		debugInfo["decryption"] = map[string]interface{}{
 			"success": decryptErr == nil,
@@ -195,12 +199,16 @@ func DebugVoiceMessageDetailed(w http.ResponseWriter, r *http.Request) {
 func DebugListVoiceMessages(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	cfg := config.LoadConfig()
 	store, ok := getStore(r)
 	if !ok {
 		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
 		return
 	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
 	messageCollection := store.Collection("messages")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -224,8 +232,6 @@ func DebugListVoiceMessages(w http.ResponseWriter, r *http.Request) {
 		"messages":             []map[string]interface{}{},
 	}
 
-	encryptionKey := []byte(cfg.EncryptionSecret)
-
 	for _, msg := range messages {
 		msgInfo := map[string]interface{}{
 			"id":             msg.ID.Hex(),
@@ -236,7 +242,7 @@ func DebugListVoiceMessages(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// 尝试解密和解析
-		decryptedContent, decryptErr := utils.Decrypt(msg.Content, encryptionKey)
+		decryptedContent, decryptErr := chatService.DecryptMessage(ctx, msg)
 		if decryptErr == nil {
 			var voiceInfo map[string]interface{}
 			if jsonErr := json.Unmarshal([]byte(decryptedContent), &voiceInfo); jsonErr == nil {
@@ -252,3 +258,47 @@ func DebugListVoiceMessages(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(debugInfo)
 }
+
+// DebugEncryptionStatus 返回當前使用的加密密鑰與重新加密任務的進度
+func DebugEncryptionStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	jobs, err := chatService.GetReencryptionJobs(ctx)
+	if err != nil {
+		http.Error(w, `{"error": "獲取重新加密進度失敗"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active_key_id": chatService.ActiveKeyID(),
+		"jobs":          jobs,
+	})
+}
+
+// DebugSocketRateLimits 返回本實例 Socket 事件限流的計數
+func DebugSocketRateLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+	stats := chatService.SocketRateLimitStats()
+	if stats == nil {
+		http.Error(w, `{"error": "Socket 服務尚未初始化"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
@@ -196,6 +196,15 @@ func TerminateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 已登出的設備不再接收端到端加密消息
+	if chatService, ok := getChatService(r); ok {
+		if err := chatService.DeleteDeviceKeys(ctx, sessionObjectID); err != nil {
+			log.Printf("刪除設備密鑰失敗: %v", err)
+		}
+		// 斷開該會話仍在線的連線
+		chatService.DisconnectUser(ctx, userID, sessionID, models.DisconnectReasonSessionTerminated)
+	}
+
 	log.Printf("會話終止成功 - UserID: %s, SessionID: %s", userID, sessionID)
 
 	w.WriteHeader(http.StatusOK)
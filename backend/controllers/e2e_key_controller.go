@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/models"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+)
+
+// PublishDeviceKeysRequest 發佈設備密鑰的請求結構，device_id 為登入時返回的 session_id
+type PublishDeviceKeysRequest struct {
+	IdentityKey    string                 `json:"identity_key"`
+	SignedPreKey   models.SignedPreKey    `json:"signed_pre_key"`
+	OneTimePreKeys []models.OneTimePreKey `json:"one_time_pre_keys"`
+}
+
+// UploadPreKeysRequest 補充一次性預共享密鑰的請求結構
+type UploadPreKeysRequest struct {
+	OneTimePreKeys []models.OneTimePreKey `json:"one_time_pre_keys"`
+}
+
+// PublishDeviceKeys 發佈或更新當前設備的身份密鑰、簽名預共享密鑰與一次性預共享密鑰
+func PublishDeviceKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req PublishDeviceKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deviceID := mux.Vars(r)["deviceId"]
+	remaining, err := chatService.PublishDeviceKeys(ctx, userID, deviceID, req.IdentityKey, req.SignedPreKey, req.OneTimePreKeys)
+	if err != nil {
+		writeE2EKeyError(w, "發佈設備密鑰失敗", err)
+		return
+	}
+
+	log.Printf("E2E keys published - UserID: %s, DeviceID: %s, PreKeys: %d", userID, deviceID, remaining)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id":              deviceID,
+		"one_time_pre_key_count": remaining,
+	})
+}
+
+// UploadOneTimePreKeys 為當前設備補充一次性預共享密鑰
+func UploadOneTimePreKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req UploadPreKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deviceID := mux.Vars(r)["deviceId"]
+	remaining, err := chatService.UploadOneTimePreKeys(ctx, userID, deviceID, req.OneTimePreKeys)
+	if err != nil {
+		writeE2EKeyError(w, "上傳預共享密鑰失敗", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id":              deviceID,
+		"one_time_pre_key_count": remaining,
+	})
+}
+
+// GetPreKeyCount 查詢當前設備剩餘的一次性預共享密鑰數
+func GetPreKeyCount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deviceID := mux.Vars(r)["deviceId"]
+	remaining, err := chatService.CountOneTimePreKeys(ctx, userID, deviceID)
+	if err != nil {
+		writeE2EKeyError(w, "查詢預共享密鑰失敗", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id":              deviceID,
+		"one_time_pre_key_count": remaining,
+	})
+}
+
+// ClaimPreKeyBundles 取得目標用戶所有設備的密鑰包，用於建立端到端加密會話
+// 每次請求都會取走每台設備的一把一次性密鑰，因此使用 POST
+func ClaimPreKeyBundles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	targetUserID := mux.Vars(r)["userId"]
+	bundles, err := chatService.ClaimPreKeyBundles(ctx, userID, targetUserID)
+	if err != nil {
+		writeE2EKeyError(w, "獲取密鑰包失敗", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": targetUserID,
+		"bundles": bundles,
+	})
+}
+
+func writeE2EKeyError(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, services.ErrDeviceNotFound):
+		http.Error(w, `{"error": "設備不存在或已登出"}`, http.StatusNotFound)
+	case errors.Is(err, services.ErrInvalidE2EKeys):
+		http.Error(w, `{"error": "密鑰格式不正確"}`, http.StatusBadRequest)
+	case errors.Is(err, services.ErrTooManyPreKeys):
+		http.Error(w, `{"error": "一次性預共享密鑰數量超過上限"}`, http.StatusBadRequest)
+	case errors.Is(err, services.ErrSenderBlocked):
+		http.Error(w, `{"error": "您已被對方封鎖"}`, http.StatusForbidden)
+	case errors.Is(err, services.ErrNoDirectRoom):
+		http.Error(w, `{"error": "只能取得私聊對象的密鑰包"}`, http.StatusForbidden)
+	default:
+		log.Printf("%s: %v", action, err)
+		http.Error(w, `{"error": "`+action+`"}`, http.StatusInternalServerError)
+	}
+}
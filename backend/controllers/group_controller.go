@@ -439,6 +439,11 @@ func LeaveGroup(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("用戶成功離開群組 - UserID: %s, GroupID: %s", userID, req.GroupID)
 
+	// 移出用戶的所有連線，離開後不再收到群組廣播
+	if chatService, ok := getChatService(r); ok {
+		chatService.EvictFromRoom(ctx, req.GroupID, userID)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "成功離開群組",
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/services"
+)
+
+// GetMentions 獲取各聊天室中提及當前用戶的消息，使用 before 游標向前分頁
+func GetMentions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	beforeID := r.URL.Query().Get("before")
+	limit := 20
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mentions, hasMore, err := chatService.GetMentions(ctx, userID, beforeID, limit)
+	if err != nil {
+		if errors.Is(err, services.ErrMessageNotFound) {
+			http.Error(w, `{"error": "無效的游標"}`, http.StatusBadRequest)
+		} else {
+			log.Printf("獲取提及消息失敗: %v", err)
+			http.Error(w, `{"error": "獲取提及消息失敗"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var nextCursor interface{}
+	if hasMore && len(mentions) > 0 {
+		nextCursor = mentions[len(mentions)-1]["id"]
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mentions":    mentions,
+		"limit":       limit,
+		"has_more":    hasMore,
+		"next_cursor": nextCursor,
+	})
+}
@@ -99,11 +99,11 @@ func DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 執行偽刪除
+	// 執行偽刪除；以未刪除作為條件，同時重複的請求只有一次生效，未讀計數不會被重複扣減
 	now := time.Now()
 	updateResult, err := messageCollection.UpdateOne(
 		ctx,
-		bson.M{"_id": messageObjectID},
+		bson.M{"_id": messageObjectID, "is_deleted": bson.M{"$ne": true}},
 		bson.M{
 			"$set": bson.M{
 				"is_deleted": true,
@@ -125,6 +125,11 @@ func DeleteMessage(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("消息刪除成功 - UserID: %s, MessageID: %s", userID, req.MessageID)
 
+	// 移除置頂並扣減其他成員的未讀計數；聊天室的最後消息預覽也可能因此改變
+	if chatService, ok := getChatService(r); ok {
+		chatService.MessageDeleted(ctx, message)
+	}
+
 	// 返回成功響應
 	response := DeleteMessageResponse{
 		Message: "消息刪除成功",
@@ -211,7 +216,7 @@ func RestoreMessage(w http.ResponseWriter, r *http.Request) {
 	// 執行恢復
 	updateResult, err := messageCollection.UpdateOne(
 		ctx,
-		bson.M{"_id": messageObjectID},
+		bson.M{"_id": messageObjectID, "is_deleted": true},
 		bson.M{
 			"$unset": bson.M{
 				"is_deleted": "",
@@ -233,6 +238,11 @@ func RestoreMessage(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("消息恢復成功 - UserID: %s, MessageID: %s", userID, req.MessageID)
 
+	// 加回其他成員的未讀計數；聊天室的最後消息預覽也可能因此改變
+	if chatService, ok := getChatService(r); ok {
+		chatService.MessageRestored(ctx, message)
+	}
+
 	// 返回成功響應
 	response := DeleteMessageResponse{
 		Message: "消息恢復成功",
@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"chatwme/backend/config"
+	"chatwme/backend/middleware"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// EditMessageRequest 編輯消息的請求結構
+type EditMessageRequest struct {
+	Content string `json:"content"`
+}
+
+// EditMessage 編輯自己發送的文字消息
+func EditMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	params := mux.Vars(r)
+	roomID := params["id"]
+	messageID := params["messageId"]
+
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Content) == "" {
+		http.Error(w, `{"error": "消息內容不能為空"}`, http.StatusBadRequest)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inRoom, err := chatService.IsUserInRoom(ctx, roomObjectID, userID)
+	if err != nil {
+		log.Printf("檢查聊天室權限失敗: %v", err)
+		http.Error(w, `{"error": "檢查聊天室權限失敗"}`, http.StatusInternalServerError)
+		return
+	}
+	if !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	cfg := config.LoadConfig()
+	message, err := chatService.EditMessage(ctx, roomID, messageID, userID, req.Content, cfg.MessageEditWindow)
+	if err != nil {
+		writeEditMessageError(w, err)
+		return
+	}
+
+	payload := services.MessageEditedPayload(message, req.Content)
+	chatService.BroadcastToRoom(roomID, "message_edited", payload)
+
+	log.Printf("消息編輯成功 - MessageID: %s, UserID: %s", messageID, userID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "消息編輯成功",
+		"data":    payload,
+	})
+}
+
+// writeEditMessageError 將編輯消息的錯誤轉換為對應的 HTTP 狀態碼
+func writeEditMessageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrMessageNotFound):
+		http.Error(w, `{"error": "消息不存在"}`, http.StatusNotFound)
+	case errors.Is(err, services.ErrNotMessageSender):
+		http.Error(w, `{"error": "只有發送者可以編輯消息"}`, http.StatusForbidden)
+	case errors.Is(err, services.ErrMessageNotEditable):
+		http.Error(w, `{"error": "此類型的消息不可編輯"}`, http.StatusBadRequest)
+	case errors.Is(err, services.ErrEditWindowExpired):
+		http.Error(w, `{"error": "已超過可編輯的時間"}`, http.StatusForbidden)
+	case errors.Is(err, services.ErrEditConflict):
+		http.Error(w, `{"error": "消息已被同時修改，請重試"}`, http.StatusConflict)
+	default:
+		log.Printf("編輯消息失敗: %v", err)
+		http.Error(w, `{"error": "編輯消息失敗"}`, http.StatusInternalServerError)
+	}
+}
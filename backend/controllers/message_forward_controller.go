@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/models"
+	"chatwme/backend/services"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ForwardMessagesRequest 轉發消息的請求結構
+type ForwardMessagesRequest struct {
+	SourceRoom  string   `json:"source_room"`
+	MessageIDs  []string `json:"message_ids"`
+	TargetRooms []string `json:"target_rooms"`
+}
+
+// ForwardMessages 將消息轉發到用戶所在的其他聊天室
+func ForwardMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req ForwardMessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.SourceRoom == "" || len(req.MessageIDs) == 0 || len(req.TargetRooms) == 0 {
+		http.Error(w, `{"error": "來源聊天室、消息與目標聊天室為必填項"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.MessageIDs) > services.MaxForwardMessages || len(req.TargetRooms) > services.MaxForwardTargets {
+		http.Error(w, `{"error": "一次轉發的消息或聊天室過多"}`, http.StatusBadRequest)
+		return
+	}
+
+	store, ok := getStore(r)
+	if !ok {
+		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// 獲取用戶信息以填充發送者名稱
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的用戶 ID"}`, http.StatusBadRequest)
+		return
+	}
+	var user models.User
+	if err := store.Collection("users").FindOne(ctx, bson.M{"_id": userObjectID}).Decode(&user); err != nil {
+		log.Printf("Warning: Could not get user info for %s: %v", userID, err)
+		user.Username = "未知用户"
+	}
+
+	results, err := chatService.ForwardMessages(ctx, userID, user.Username, req.SourceRoom, req.MessageIDs, req.TargetRooms)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrRoomNotFound), errors.Is(err, services.ErrNotRoomMember):
+			http.Error(w, `{"error": "來源聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		case errors.Is(err, services.ErrNothingToForward):
+			http.Error(w, `{"error": "沒有可轉發的消息"}`, http.StatusNotFound)
+		default:
+			log.Printf("轉發消息失敗: %v", err)
+			http.Error(w, `{"error": "轉發消息失敗"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("消息轉發完成 - UserID: %s, 來源: %s, 消息數: %d, 目標數: %d",
+		userID, req.SourceRoom, len(req.MessageIDs), len(req.TargetRooms))
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+	})
+}
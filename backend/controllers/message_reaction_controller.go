@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/models"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ReactionRequest 添加表情回應的請求結構
+type ReactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+// AddReaction 為消息添加表情回應
+func AddReaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req ReactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+		return
+	}
+
+	updateReaction(w, r, strings.TrimSpace(req.Emoji), "add")
+}
+
+// RemoveReaction 移除自己對消息的表情回應
+func RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	updateReaction(w, r, mux.Vars(r)["emoji"], "remove")
+}
+
+// updateReaction 處理添加與移除表情回應的共同流程
+func updateReaction(w http.ResponseWriter, r *http.Request, emoji, action string) {
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	params := mux.Vars(r)
+	roomID := params["id"]
+	messageID := params["messageId"]
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inRoom, err := chatService.IsUserInRoom(ctx, roomObjectID, userID)
+	if err != nil {
+		log.Printf("檢查聊天室權限失敗: %v", err)
+		http.Error(w, `{"error": "檢查聊天室權限失敗"}`, http.StatusInternalServerError)
+		return
+	}
+	if !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	var message models.Message
+	if action == "add" {
+		message, err = chatService.AddReaction(ctx, roomID, messageID, userID, emoji)
+	} else {
+		message, err = chatService.RemoveReaction(ctx, roomID, messageID, userID, emoji)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidReaction):
+			http.Error(w, `{"error": "無效的表情"}`, http.StatusBadRequest)
+		case errors.Is(err, services.ErrReactionLimitReached):
+			http.Error(w, `{"error": "消息的表情種類已達上限"}`, http.StatusConflict)
+		case errors.Is(err, services.ErrMessageNotFound):
+			http.Error(w, `{"error": "消息不存在"}`, http.StatusNotFound)
+		default:
+			log.Printf("更新表情回應失敗: %v", err)
+			http.Error(w, `{"error": "更新表情回應失敗"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	payload := services.ReactionUpdatedPayload(message, userID, emoji, action)
+	chatService.BroadcastToRoom(roomID, "reaction_updated", payload)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message_id": messageID,
+		"reactions":  payload["reactions"],
+	})
+}
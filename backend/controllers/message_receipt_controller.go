@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GetMessageReceipts 獲取消息的送達與已讀回執，包含每位成員的時間
+func GetMessageReceipts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	params := mux.Vars(r)
+	roomID := params["id"]
+	messageID := params["messageId"]
+
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inRoom, err := chatService.IsUserInRoom(ctx, roomObjectID, userID)
+	if err != nil {
+		log.Printf("檢查聊天室權限失敗: %v", err)
+		http.Error(w, `{"error": "檢查聊天室權限失敗"}`, http.StatusInternalServerError)
+		return
+	}
+	if !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	receipts, err := chatService.GetMessageReceipts(ctx, roomID, messageID)
+	if err != nil {
+		if errors.Is(err, services.ErrMessageNotFound) {
+			http.Error(w, `{"error": "消息不存在"}`, http.StatusNotFound)
+		} else {
+			log.Printf("獲取消息回執失敗: %v", err)
+			http.Error(w, `{"error": "獲取消息回執失敗"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(receipts)
+}
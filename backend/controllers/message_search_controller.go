@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SearchRoomMessages 在單個聊天室內搜尋消息
+func SearchRoomMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	roomID := mux.Vars(r)["id"]
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inRoom, err := chatService.IsUserInRoom(ctx, roomObjectID, userID)
+	if err != nil {
+		log.Printf("檢查聊天室權限失敗: %v", err)
+		http.Error(w, `{"error": "檢查聊天室權限失敗"}`, http.StatusInternalServerError)
+		return
+	}
+	if !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	query, ok := parseSearchQuery(w, r)
+	if !ok {
+		return
+	}
+	query.RoomIDs = []string{roomID}
+
+	runMessageSearch(ctx, w, chatService, query)
+}
+
+// SearchMessages 在當前用戶所在的所有聊天室中搜尋消息
+func SearchMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	query, ok := parseSearchQuery(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	roomIDs, err := chatService.GetUserRoomIDs(ctx, userID)
+	if err != nil {
+		log.Printf("獲取用戶聊天室失敗: %v", err)
+		http.Error(w, `{"error": "獲取聊天室失敗"}`, http.StatusInternalServerError)
+		return
+	}
+	query.RoomIDs = roomIDs
+
+	runMessageSearch(ctx, w, chatService, query)
+}
+
+// parseSearchQuery 解析搜尋關鍵字與篩選條件：q、sender、type、from、to、before、limit
+func parseSearchQuery(w http.ResponseWriter, r *http.Request) (services.MessageSearchQuery, bool) {
+	values := r.URL.Query()
+	query := services.MessageSearchQuery{
+		Query:    values.Get("q"),
+		SenderID: values.Get("sender"),
+		Type:     values.Get("type"),
+		BeforeID: values.Get("before"),
+		Limit:    20,
+	}
+
+	if limitStr := values.Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+			query.Limit = l
+		}
+	}
+
+	for _, field := range []struct {
+		name   string
+		target **time.Time
+	}{{"from", &query.From}, {"to", &query.To}} {
+		raw := values.Get(field.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			http.Error(w, `{"error": "時間格式必須為 RFC3339"}`, http.StatusBadRequest)
+			return query, false
+		}
+		*field.target = &t
+	}
+
+	return query, true
+}
+
+func runMessageSearch(ctx context.Context, w http.ResponseWriter, chatService *services.ChatService, query services.MessageSearchQuery) {
+	results, hasMore, err := chatService.SearchMessages(ctx, query)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrSearchDisabled):
+			http.Error(w, `{"error": "消息搜尋未啟用"}`, http.StatusServiceUnavailable)
+		case errors.Is(err, services.ErrEmptySearch):
+			http.Error(w, `{"error": "搜尋關鍵字為必填項"}`, http.StatusBadRequest)
+		case errors.Is(err, services.ErrMessageNotFound):
+			http.Error(w, `{"error": "無效的游標"}`, http.StatusBadRequest)
+		default:
+			log.Printf("搜尋消息失敗: %v", err)
+			http.Error(w, `{"error": "搜尋消息失敗"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var nextCursor interface{}
+	if hasMore && len(results) > 0 {
+		nextCursor = results[len(results)-1]["id"]
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages":    results,
+		"limit":       query.Limit,
+		"has_more":    hasMore,
+		"next_cursor": nextCursor,
+	})
+}
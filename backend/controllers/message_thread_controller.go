@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/models"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GetThreadMessages 獲取話題的根消息與回覆列表，使用 after 游標向後分頁
+func GetThreadMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	params := mux.Vars(r)
+	roomID := params["id"]
+	messageID := params["messageId"]
+	afterID := r.URL.Query().Get("after")
+
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inRoom, err := chatService.IsUserInRoom(ctx, roomObjectID, userID)
+	if err != nil {
+		log.Printf("檢查聊天室權限失敗: %v", err)
+		http.Error(w, `{"error": "檢查聊天室權限失敗"}`, http.StatusInternalServerError)
+		return
+	}
+	if !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	root, replies, hasMore, err := chatService.GetThread(ctx, roomID, messageID, afterID, limit)
+	if err != nil {
+		if errors.Is(err, services.ErrMessageNotFound) {
+			http.Error(w, `{"error": "消息不存在"}`, http.StatusNotFound)
+		} else {
+			log.Printf("獲取話題失敗: %v", err)
+			http.Error(w, `{"error": "獲取話題失敗"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	rootPayload := map[string]interface{}{
+		"id":         root.ID.Hex(),
+		"room":       root.Room,
+		"is_deleted": true,
+	}
+	if !root.IsDeleted {
+		rootPayload = chatService.FormatMessages(ctx, []models.Message{root})[0]
+	}
+
+	replyPayloads := chatService.FormatMessages(ctx, replies)
+	if err := chatService.AttachReplyContext(ctx, roomID, replyPayloads); err != nil {
+		log.Printf("Failed to attach reply context for thread %s: %v", root.ID.Hex(), err)
+	}
+
+	counts, err := chatService.CountThreadReplies(ctx, roomID, []string{root.ID.Hex()})
+	if err != nil {
+		log.Printf("統計話題回覆數失敗: %v", err)
+	}
+
+	var nextCursor interface{}
+	if hasMore && len(replyPayloads) > 0 {
+		nextCursor = replyPayloads[len(replyPayloads)-1]["id"]
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"root":        rootPayload,
+		"replies":     replyPayloads,
+		"reply_count": counts[root.ID.Hex()],
+		"limit":       limit,
+		"has_more":    hasMore,
+		"next_cursor": nextCursor,
+	})
+}
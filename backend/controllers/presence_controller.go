@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/services"
+)
+
+// GetPresence 批量查詢用戶的在線狀態，ids 以逗號分隔
+func GetPresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, ok := r.Context().Value(middleware.UserIDKey).(string); !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var userIDs []string
+	seen := map[string]bool{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		userIDs = append(userIDs, id)
+	}
+	if len(userIDs) == 0 {
+		http.Error(w, `{"error": "缺少用戶 ID"}`, http.StatusBadRequest)
+		return
+	}
+	if len(userIDs) > services.MaxPresenceLookup {
+		http.Error(w, `{"error": "查詢的用戶數過多"}`, http.StatusBadRequest)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	presence, err := chatService.GetPresence(ctx, userIDs)
+	if err != nil {
+		log.Printf("查詢在線狀態失敗: %v", err)
+		http.Error(w, `{"error": "查詢在線狀態失敗"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"presence": presence,
+	})
+}
@@ -124,8 +124,27 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 登入會話已終止的 token 不能再刷新
+	sessionCollection := store.Collection("login_sessions")
+	var sessionObjectID primitive.ObjectID
+	if claims.SessionID != "" {
+		sessionObjectID, err = primitive.ObjectIDFromHex(claims.SessionID)
+		if err == nil {
+			err = sessionCollection.FindOne(ctx, bson.M{
+				"_id":       sessionObjectID,
+				"user_id":   userObjectID,
+				"is_active": true,
+			}).Err()
+		}
+		if err != nil {
+			log.Printf("⛔ [RefreshToken] 登入會話已終止 - UserID: %s, SessionID: %s", user.ID.Hex(), claims.SessionID)
+			http.Error(w, `{"error": "登入會話已終止"}`, http.StatusUnauthorized)
+			return
+		}
+	}
+
 	// 9. 生成新的 Access Token
-	newAccessToken, err := utils.GenerateJWT(user.ID.Hex(), user.Username)
+	newAccessToken, err := utils.GenerateJWT(user.ID.Hex(), user.Username, claims.SessionID)
 	if err != nil {
 		log.Printf("❌ [RefreshToken] 生成 Access Token 失敗: %v", err)
 		http.Error(w, `{"error": "生成 token 失敗"}`, http.StatusInternalServerError)
@@ -134,7 +153,7 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 
 	// 10. 生成新的 Refresh Token（可選，增加安全性）
 	// 建議：每次刷新都生成新的 Refresh Token，並使舊的失效
-	newRefreshToken, err := utils.GenerateRefreshToken(user.ID.Hex(), user.Username)
+	newRefreshToken, err := utils.GenerateRefreshToken(user.ID.Hex(), user.Username, claims.SessionID)
 	if err != nil {
 		log.Printf("⚠️ [RefreshToken] 生成新 Refresh Token 失敗，使用舊的: %v", err)
 		// 如果生成失敗，返回空字符串，前端會保留舊的
@@ -157,6 +176,24 @@ func RefreshToken(w http.ResponseWriter, r *http.Request) {
 		// 不返回錯誤，繼續刷新流程
 	}
 
+	// 會話記錄改用新的 Access Token，GetCurrentSession 才能繼續找到當前會話
+	if claims.SessionID != "" {
+		_, err = sessionCollection.UpdateOne(
+			ctx,
+			bson.M{"_id": sessionObjectID},
+			bson.M{
+				"$set": bson.M{
+					"session_token": newAccessToken,
+					"last_active":   time.Now(),
+					"updated_at":    time.Now(),
+				},
+			},
+		)
+		if err != nil {
+			log.Printf("⚠️ [RefreshToken] 更新登入會話失敗: %v", err)
+		}
+	}
+
 	log.Printf("✅ [RefreshToken] Token 刷新成功 - UserID: %s, Username: %s", claims.UserID, user.Username)
 
 	// 12. 構建響應
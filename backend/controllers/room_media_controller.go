@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// GetRoomMedia 解密並返回聊天室的媒體文件，支援 Range 請求，只有聊天室成員可以下載
+func GetRoomMedia(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	params := mux.Vars(r)
+	roomID, name := params["id"], params["name"]
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	inRoom, err := chatService.IsUserInRoom(ctx, roomObjectID, userID)
+	if err != nil || !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	media, err := chatService.OpenRoomMedia(ctx, roomID, name)
+	switch {
+	case errors.Is(err, services.ErrMediaNotFound):
+		http.Error(w, `{"error": "文件不存在"}`, http.StatusNotFound)
+		return
+	case errors.Is(err, services.ErrRoomKeyShredded):
+		http.Error(w, `{"error": "文件已被永久刪除"}`, http.StatusGone)
+		return
+	case err != nil:
+		log.Printf("Failed to read media %s of room %s: %v", name, roomID, err)
+		http.Error(w, `{"error": "讀取文件失敗"}`, http.StatusInternalServerError)
+		return
+	}
+	defer media.Close()
+
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	// Range 請求只解密請求範圍所在的段
+	http.ServeContent(w, r, name, time.Time{}, media)
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"chatwme/backend/config"
+	"chatwme/backend/middleware"
+	"chatwme/backend/models"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PinMessage 置頂聊天室中的消息
+func PinMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	updatePin(w, r, "pin")
+}
+
+// UnpinMessage 取消置頂聊天室中的消息
+func UnpinMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	updatePin(w, r, "unpin")
+}
+
+// updatePin 處理置頂與取消置頂的共同流程
+func updatePin(w http.ResponseWriter, r *http.Request, action string) {
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	params := mux.Vars(r)
+	roomID := params["id"]
+	messageID := params["messageId"]
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var pins []models.PinnedMessage
+	var err error
+	if action == "pin" {
+		cfg := config.LoadConfig()
+		pins, err = chatService.PinMessage(ctx, roomID, messageID, userID, cfg.MaxPinnedMessages)
+	} else {
+		pins, err = chatService.UnpinMessage(ctx, roomID, messageID, userID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrRoomNotFound):
+			http.Error(w, `{"error": "聊天室不存在"}`, http.StatusNotFound)
+		case errors.Is(err, services.ErrPinNotAllowed):
+			http.Error(w, `{"error": "沒有置頂消息的權限"}`, http.StatusForbidden)
+		case errors.Is(err, services.ErrMessageNotFound):
+			http.Error(w, `{"error": "消息不存在"}`, http.StatusNotFound)
+		case errors.Is(err, services.ErrMessageNotPinned):
+			http.Error(w, `{"error": "消息未被置頂"}`, http.StatusNotFound)
+		case errors.Is(err, services.ErrPinLimitReached):
+			http.Error(w, `{"error": "置頂消息已達上限"}`, http.StatusConflict)
+		default:
+			log.Printf("更新置頂消息失敗: %v", err)
+			http.Error(w, `{"error": "更新置頂消息失敗"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	payload := services.PinsUpdatedPayload(roomID, messageID, userID, action, pins)
+	chatService.BroadcastToRoom(roomID, "pins_updated", payload)
+
+	log.Printf("置頂消息更新成功 - Action: %s, RoomID: %s, MessageID: %s, UserID: %s", action, roomID, messageID, userID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "置頂消息更新成功",
+		"pins":    payload["pins"],
+	})
+}
+
+// GetPinnedMessages 獲取聊天室的置頂消息
+func GetPinnedMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	roomID := mux.Vars(r)["id"]
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inRoom, err := chatService.IsUserInRoom(ctx, roomObjectID, userID)
+	if err != nil {
+		log.Printf("檢查聊天室權限失敗: %v", err)
+		http.Error(w, `{"error": "檢查聊天室權限失敗"}`, http.StatusInternalServerError)
+		return
+	}
+	if !inRoom {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	pinned, err := chatService.GetPinnedMessages(ctx, roomID)
+	if err != nil {
+		log.Printf("獲取置頂消息失敗: %v", err)
+		http.Error(w, `{"error": "獲取置頂消息失敗"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pins":  pinned,
+		"count": len(pinned),
+	})
+}
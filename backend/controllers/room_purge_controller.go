@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/models"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DissolveGroup 解散群組：銷毀群組密鑰並刪除所有消息與媒體，只有群組創建者可以操作
+func DissolveGroup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req JoinGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.GroupID == "" {
+		http.Error(w, `{"error": "群組 ID 為必填項"}`, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	group, ok := findRoomForPurge(ctx, w, r, req.GroupID)
+	if !ok {
+		return
+	}
+	if !group.IsGroup {
+		http.Error(w, `{"error": "群組不存在"}`, http.StatusNotFound)
+		return
+	}
+	if group.CreatedBy != userID {
+		http.Error(w, `{"error": "只有群組創建者可以解散群組"}`, http.StatusForbidden)
+		return
+	}
+
+	if !purgeRoom(ctx, w, r, group.ID) {
+		return
+	}
+	log.Printf("群組已解散 - GroupID: %s, UserID: %s", req.GroupID, userID)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "群組已解散",
+	})
+}
+
+// PurgeDirectChat 清除私聊：銷毀聊天室密鑰並刪除所有消息與媒體，雙方都無法再查看
+func PurgeDirectChat(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	roomID := mux.Vars(r)["id"]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	room, ok := findRoomForPurge(ctx, w, r, roomID)
+	if !ok {
+		return
+	}
+	if room.IsGroup {
+		http.Error(w, `{"error": "群組請使用解散群組"}`, http.StatusBadRequest)
+		return
+	}
+	isParticipant := false
+	for _, participant := range room.Participants {
+		if participant == userID {
+			isParticipant = true
+			break
+		}
+	}
+	if !isParticipant {
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+		return
+	}
+
+	if !purgeRoom(ctx, w, r, room.ID) {
+		return
+	}
+	log.Printf("私聊已清除 - RoomID: %s, UserID: %s", roomID, userID)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "聊天記錄已永久刪除",
+	})
+}
+
+func findRoomForPurge(ctx context.Context, w http.ResponseWriter, r *http.Request, roomID string) (models.ChatRoom, bool) {
+	var room models.ChatRoom
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+		return room, false
+	}
+	store, ok := getStore(r)
+	if !ok {
+		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
+		return room, false
+	}
+
+	err = store.Collection("chat_rooms").FindOne(ctx, bson.M{"_id": roomObjectID}).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, `{"error": "聊天室不存在"}`, http.StatusNotFound)
+		return room, false
+	}
+	if err != nil {
+		log.Printf("查找聊天室失敗: %v", err)
+		http.Error(w, `{"error": "查找聊天室失敗"}`, http.StatusInternalServerError)
+		return room, false
+	}
+	return room, true
+}
+
+func purgeRoom(ctx context.Context, w http.ResponseWriter, r *http.Request, roomID primitive.ObjectID) bool {
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return false
+	}
+	if err := chatService.PurgeRoom(ctx, roomID); err != nil {
+		log.Printf("清除聊天室 %s 失敗: %v", roomID.Hex(), err)
+		http.Error(w, `{"error": "刪除聊天室失敗"}`, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
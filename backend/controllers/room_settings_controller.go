@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/models"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SetMessageTTLRequest 設置消息自動刪除時間的請求結構
+type SetMessageTTLRequest struct {
+	MessageTTL *int64 `json:"message_ttl"` // 秒，0 表示關閉
+}
+
+// SetMessageTTL 設置聊天室新消息的自動刪除時間
+func SetMessageTTL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+	roomID := mux.Vars(r)["id"]
+
+	var req SetMessageTTLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageTTL == nil {
+		http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+		return
+	}
+	if *req.MessageTTL < 0 || *req.MessageTTL > int64(services.MaxMessageTTL/time.Second) {
+		http.Error(w, `{"error": "無效的消息保留時間"}`, http.StatusBadRequest)
+		return
+	}
+
+	store, ok := getStore(r)
+	if !ok {
+		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 獲取用戶信息以填充系統消息中的名稱
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的用戶 ID"}`, http.StatusBadRequest)
+		return
+	}
+	var user models.User
+	if err := store.Collection("users").FindOne(ctx, bson.M{"_id": userObjectID}).Decode(&user); err != nil {
+		log.Printf("Warning: Could not get user info for %s: %v", userID, err)
+		user.Username = "未知用户"
+	}
+
+	ttl := time.Duration(*req.MessageTTL) * time.Second
+	_, changed, err := chatService.SetMessageTTL(ctx, roomID, userID, user.Username, ttl)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrRoomNotFound):
+			http.Error(w, `{"error": "聊天室不存在"}`, http.StatusNotFound)
+		case errors.Is(err, services.ErrRoomSettingsNotAllowed):
+			http.Error(w, `{"error": "沒有修改聊天室設定的權限"}`, http.StatusForbidden)
+		case errors.Is(err, services.ErrInvalidMessageTTL):
+			http.Error(w, `{"error": "無效的消息保留時間"}`, http.StatusBadRequest)
+		default:
+			log.Printf("設置消息自動刪除時間失敗: %v", err)
+			http.Error(w, `{"error": "設置消息自動刪除時間失敗"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if changed {
+		log.Printf("消息自動刪除時間已更新 - Room: %s, User: %s, TTL: %ds", roomID, userID, *req.MessageTTL)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"room":        roomID,
+		"message_ttl": *req.MessageTTL,
+		"changed":     changed,
+	})
+}
@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"chatwme/backend/middleware"
+	"chatwme/backend/models"
+	"chatwme/backend/services"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ScheduledMessageRequest 建立或修改定時消息的請求結構，修改時未提供的欄位保持不變
+type ScheduledMessageRequest struct {
+	Content *string `json:"content"`
+	SendAt  *string `json:"send_at"` // RFC3339 格式
+}
+
+// CreateScheduledMessage 建立一條在指定時間發送的文字消息
+func CreateScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+	roomID := mux.Vars(r)["id"]
+
+	var req ScheduledMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Content == nil || strings.TrimSpace(*req.Content) == "" || req.SendAt == nil {
+		http.Error(w, `{"error": "消息內容與發送時間為必填項"}`, http.StatusBadRequest)
+		return
+	}
+	sendAt, err := time.Parse(time.RFC3339, *req.SendAt)
+	if err != nil {
+		http.Error(w, `{"error": "時間格式必須為 RFC3339"}`, http.StatusBadRequest)
+		return
+	}
+
+	store, ok := getStore(r)
+	if !ok {
+		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 獲取用戶信息以填充發送者名稱
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		http.Error(w, `{"error": "無效的用戶 ID"}`, http.StatusBadRequest)
+		return
+	}
+	var user models.User
+	if err := store.Collection("users").FindOne(ctx, bson.M{"_id": userObjectID}).Decode(&user); err != nil {
+		log.Printf("Warning: Could not get user info for %s: %v", userID, err)
+		user.Username = "未知用户"
+	}
+
+	job, err := chatService.CreateScheduledMessage(ctx, roomID, userID, user.Username, *req.Content, sendAt)
+	if err != nil {
+		writeScheduledMessageError(w, err)
+		return
+	}
+
+	log.Printf("定時消息已建立 - Room: %s, User: %s, SendAt: %s", roomID, userID, sendAt.Format(time.RFC3339))
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(chatService.ScheduledMessagePayload(ctx, job))
+}
+
+// GetScheduledMessages 列出當前用戶在聊天室中尚未發送的定時消息
+func GetScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+	roomID := mux.Vars(r)["id"]
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	jobs, err := chatService.ListScheduledMessages(ctx, roomID, userID)
+	if err != nil {
+		log.Printf("獲取定時消息失敗: %v", err)
+		http.Error(w, `{"error": "獲取定時消息失敗"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"scheduled_messages": jobs,
+	})
+}
+
+// UpdateScheduledMessage 修改尚未發送的定時消息的內容或發送時間
+func UpdateScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+	params := mux.Vars(r)
+
+	var req ScheduledMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error": "無效的請求格式"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Content == nil && req.SendAt == nil {
+		http.Error(w, `{"error": "沒有需要修改的內容"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Content != nil && strings.TrimSpace(*req.Content) == "" {
+		http.Error(w, `{"error": "消息內容不能為空"}`, http.StatusBadRequest)
+		return
+	}
+	var sendAt *time.Time
+	if req.SendAt != nil {
+		t, err := time.Parse(time.RFC3339, *req.SendAt)
+		if err != nil {
+			http.Error(w, `{"error": "時間格式必須為 RFC3339"}`, http.StatusBadRequest)
+			return
+		}
+		sendAt = &t
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	job, err := chatService.UpdateScheduledMessage(ctx, params["id"], params["scheduledId"], userID, req.Content, sendAt)
+	if err != nil {
+		writeScheduledMessageError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(chatService.ScheduledMessagePayload(ctx, job))
+}
+
+// CancelScheduledMessage 取消尚未發送的定時消息
+func CancelScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+	params := mux.Vars(r)
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := chatService.CancelScheduledMessage(ctx, params["id"], params["scheduledId"], userID); err != nil {
+		writeScheduledMessageError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "定時消息已取消",
+		"id":      params["scheduledId"],
+	})
+}
+
+func writeScheduledMessageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrRoomNotFound):
+		http.Error(w, `{"error": "無效的房間 ID"}`, http.StatusBadRequest)
+	case errors.Is(err, services.ErrNotRoomMember):
+		http.Error(w, `{"error": "聊天室不存在或無權限訪問"}`, http.StatusForbidden)
+	case errors.Is(err, services.ErrSenderBlocked):
+		http.Error(w, `{"error": "您已被聊天室中的用戶封鎖"}`, http.StatusForbidden)
+	case errors.Is(err, services.ErrScheduleInPast):
+		http.Error(w, `{"error": "發送時間必須晚於現在"}`, http.StatusBadRequest)
+	case errors.Is(err, services.ErrScheduledNotFound):
+		http.Error(w, `{"error": "定時消息不存在"}`, http.StatusNotFound)
+	case errors.Is(err, services.ErrScheduledNotEditable):
+		http.Error(w, `{"error": "定時消息已發送或已取消"}`, http.StatusConflict)
+	default:
+		log.Printf("處理定時消息失敗: %v", err)
+		http.Error(w, `{"error": "處理定時消息失敗"}`, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"chatwme/backend/middleware"
+)
+
+// GetUnreadSummary 獲取當前用戶所有聊天室的未讀總數，用於應用圖標角標
+func GetUnreadSummary(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// 從 JWT 中獲取用戶 ID
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		http.Error(w, `{"error": "無法獲取用戶 ID"}`, http.StatusUnauthorized)
+		return
+	}
+
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rooms, totalUnread, totalMentions, err := chatService.GetTotalUnread(ctx, userID)
+	if err != nil {
+		log.Printf("獲取未讀計數失敗: %v", err)
+		http.Error(w, `{"error": "獲取未讀計數失敗"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total_unread":   totalUnread,
+		"total_mentions": totalMentions,
+		"rooms":          rooms,
+	})
+}
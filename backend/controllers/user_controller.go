@@ -11,6 +11,7 @@ import (
 	"chatwme/backend/database"
 	"chatwme/backend/middleware" // 如果還沒有的話
 	"chatwme/backend/models"
+	"chatwme/backend/services"
 	"chatwme/backend/utils"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -58,6 +59,10 @@ func getStore(r *http.Request) (database.Store, bool) {
 	return database.StoreFromContext(r.Context())
 }
 
+func getChatService(r *http.Request) (*services.ChatService, bool) {
+	return services.ChatServiceFromContext(r.Context())
+}
+
 // GetProfile 獲取當前用戶的個人資料
 func GetProfile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -479,33 +484,34 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 提取設備信息
+	deviceInfo := utils.ExtractDeviceInfo(r)
+	log.Printf("設備信息 - IP: %s, 設備: %s, 系統: %s, 瀏覽器: %s",
+		deviceInfo.IPAddress, deviceInfo.DeviceType, deviceInfo.OS, deviceInfo.Browser)
+
+	// 創建設備信息記錄
+	deviceInfoModel := utils.CreateDeviceInfoModel(user.ID, deviceInfo)
+
+	// 創建登入會話，token 帶上會話 ID，終止會話時可撤銷其連線
+	loginSession := utils.CreateLoginSession(user.ID, deviceInfo, "")
+
 	// 生成 Access Token (24小時)
-	accessToken, err := utils.GenerateJWT(user.ID.Hex(), user.Username)
+	accessToken, err := utils.GenerateJWT(user.ID.Hex(), user.Username, loginSession.ID.Hex())
 	if err != nil {
 		log.Printf("無法生成 access token: %v", err)
 		http.Error(w, `{"error": "無法生成 token"}`, http.StatusInternalServerError)
 		return
 	}
+	loginSession.SessionToken = accessToken
 
 	// 生成 Refresh Token (7天)
-	refreshToken, err := utils.GenerateRefreshToken(user.ID.Hex(), user.Username)
+	refreshToken, err := utils.GenerateRefreshToken(user.ID.Hex(), user.Username, loginSession.ID.Hex())
 	if err != nil {
 		log.Printf("無法生成 refresh token: %v", err)
 		http.Error(w, `{"error": "無法生成 token"}`, http.StatusInternalServerError)
 		return
 	}
 
-	// 提取設備信息
-	deviceInfo := utils.ExtractDeviceInfo(r)
-	log.Printf("設備信息 - IP: %s, 設備: %s, 系統: %s, 瀏覽器: %s",
-		deviceInfo.IPAddress, deviceInfo.DeviceType, deviceInfo.OS, deviceInfo.Browser)
-
-	// 創建設備信息記錄
-	deviceInfoModel := utils.CreateDeviceInfoModel(user.ID, deviceInfo)
-
-	// 創建登入會話
-	loginSession := utils.CreateLoginSession(user.ID, deviceInfo, accessToken)
-
 	// 保存設備信息到數據庫
 	deviceCollection := store.Collection("device_info")
 	_, err = deviceCollection.InsertOne(ctx, deviceInfoModel)
@@ -522,13 +528,12 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		// 不返回錯誤，繼續登入流程
 	}
 
-	// 更新用戶在線狀態
+	// 在線狀態由 Socket 連線維護，登入只記錄活動時間
 	_, err = userCollection.UpdateOne(
 		ctx,
 		bson.M{"_id": user.ID},
 		bson.M{
 			"$set": bson.M{
-				"is_online":  true,
 				"last_seen":  time.Now(),
 				"updated_at": time.Now(),
 			},
@@ -558,8 +563,9 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":       "登入成功",
-		"access_token":  accessToken,  // 🔥 改名
-		"refresh_token": refreshToken, // 🔥 新增
+		"access_token":  accessToken,           // 🔥 改名
+		"refresh_token": refreshToken,          // 🔥 新增
+		"session_id":    loginSession.ID.Hex(), // 當前設備 ID，用於發佈端到端加密密鑰
 		"user":          userResponse,
 	})
 }
@@ -5,15 +5,13 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"chatwme/backend/config"
 	"chatwme/backend/middleware"
 	"chatwme/backend/models"
-	"chatwme/backend/services"
-	"chatwme/backend/utils"
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
@@ -33,13 +31,6 @@ type VoiceMessageResponse struct {
 	Type       string `json:"type"`
 }
 
-var storageService services.StorageService
-
-func init() {
-	// 初始化存儲服務（使用單例模式）
-	storageService = services.GetStorageService()
-}
-
 // UploadVoiceMessage 處理語音消息上傳 - 🔥 統一存儲到 messages 集合
 func UploadVoiceMessage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -99,7 +90,11 @@ func UploadVoiceMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cfg := config.LoadConfig()
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
 
 	// 驗證用戶是否有權限訪問此聊天室
 	roomCollection := store.Collection("chat_rooms")
@@ -127,30 +122,14 @@ func UploadVoiceMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 上傳文件到存儲服務
-	filePath, err := storageService.UploadFile(file, header, "audio")
+	// 🔥 以聊天室密鑰加密後保存，聊天室銷毀時語音一併無法解密
+	publicURL, fileSize, err := chatService.StoreRoomMedia(ctx, roomID, filepath.Ext(header.Filename), file)
 	if err != nil {
 		log.Printf("Error uploading voice file: %v", err)
 		http.Error(w, `{"error": "文件上傳失敗"}`, http.StatusInternalServerError)
 		return
 	}
 
-	// 獲取文件大小
-	fileSize, err := storageService.GetFileSize(filePath)
-	if err != nil {
-		log.Printf("Warning: Could not get file size for %s: %v", filePath, err)
-		fileSize = header.Size // 使用header中的大小作為備選
-		log.Printf("Using header size as fallback: %d bytes", fileSize)
-	} else {
-		log.Printf("Successfully got file size: %d bytes", fileSize)
-	}
-
-	// 驗證文件大小是否合理
-	if fileSize <= 0 {
-		log.Printf("Warning: File size is 0 or negative: %d, using header size: %d", fileSize, header.Size)
-		fileSize = header.Size
-	}
-
 	// 獲取用戶信息
 	userCollection := store.Collection("users")
 	userObjectID, err := primitive.ObjectIDFromHex(userID)
@@ -167,7 +146,6 @@ func UploadVoiceMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 🔥 關鍵修正：構建語音消息的內容，包含文件信息
-	publicURL := storageService.GetPublicURL(filePath)
 	voiceContent := map[string]interface{}{
 		"file_url":  publicURL,
 		"duration":  duration,
@@ -183,8 +161,7 @@ func UploadVoiceMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 加密內容
-	encryptionKey := []byte(cfg.EncryptionSecret)
-	encryptedContent, err := utils.Encrypt(string(contentBytes), encryptionKey)
+	encryptedContent, err := chatService.EncryptContent(ctx, roomID, string(contentBytes))
 	if err != nil {
 		log.Printf("Error encrypting voice message content: %v", err)
 		http.Error(w, `{"error": "處理語音消息失敗"}`, http.StatusInternalServerError)
@@ -203,28 +180,14 @@ func UploadVoiceMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 🔥 關鍵修正：保存到 messages 集合而不是獨立的 voice_messages 集合
-	messageCollection := store.Collection("messages")
-	result, err := messageCollection.InsertOne(ctx, voiceMessage)
-	if err != nil {
+	if err := chatService.InsertMessage(ctx, &voiceMessage); err != nil {
 		log.Printf("Failed to save voice message: %v", err)
 		http.Error(w, `{"error": "保存語音消息失敗"}`, http.StatusInternalServerError)
 		return
 	}
 
-	// 更新聊天室信息
-	roomUpdate := bson.M{
-		"$set": bson.M{
-			"last_message":      "[語音消息]",
-			"last_message_time": voiceMessage.Timestamp,
-			"updated_at":        time.Now(),
-		},
-		"$inc": bson.M{
-			"unread_count": 1,
-		},
-	}
-
-	_, err = roomCollection.UpdateOne(ctx, bson.M{"_id": roomObjectID}, roomUpdate)
-	if err != nil {
+	// 更新聊天室信息（預覽加密保存）
+	if err := chatService.UpdateRoomPreview(ctx, roomObjectID, voiceMessage, string(contentBytes)); err != nil {
 		log.Printf("Failed to update room last message: %v", err)
 	}
 
@@ -241,11 +204,12 @@ func UploadVoiceMessage(w http.ResponseWriter, r *http.Request) {
 			"file_size":   fileSize,
 			"timestamp":   voiceMessage.Timestamp.Format(time.RFC3339),
 			"type":        "voice",
+			"seq":         voiceMessage.Seq,
 		},
 	}
 
 	log.Printf("Voice message uploaded successfully - ID: %v, User: %s, Room: %s, Duration: %ds",
-		result.InsertedID, user.Username, roomID, duration)
+		voiceMessage.ID.Hex(), user.Username, roomID, duration)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
@@ -279,13 +243,17 @@ func GetVoiceMessageURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cfg := config.LoadConfig()
 	// 🔥 關鍵修正：從 messages 集合查找語音消息
 	store, ok := getStore(r)
 	if !ok {
 		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
 		return
 	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
 	messageCollection := store.Collection("messages")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -332,8 +300,7 @@ func GetVoiceMessageURL(w http.ResponseWriter, r *http.Request) {
 	log.Printf("✅ Room access verified: RoomID=%s, RoomName=%s", message.Room, room.Name)
 
 	// 🔥 關鍵修正：解密消息內容並解析語音信息
-	encryptionKey := []byte(cfg.EncryptionSecret)
-	decryptedContent, err := utils.Decrypt(message.Content, encryptionKey)
+	decryptedContent, err := chatService.DecryptContent(ctx, message.Room, message.Content)
 	if err != nil {
 		log.Printf("❌ Error decrypting message content for message %s: %v", messageID, err)
 		http.Error(w, `{"error": "無法解密語音消息"}`, http.StatusInternalServerError)
@@ -381,12 +348,16 @@ func DebugVoiceMessage(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	messageID := params["messageId"]
 
-	cfg := config.LoadConfig()
 	store, ok := getStore(r)
 	if !ok {
 		http.Error(w, `{"error": "資料庫尚未初始化"}`, http.StatusInternalServerError)
 		return
 	}
+	chatService, ok := getChatService(r)
+	if !ok {
+		http.Error(w, `{"error": "聊天服務尚未初始化"}`, http.StatusInternalServerError)
+		return
+	}
 	messageCollection := store.Collection("messages")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -406,8 +377,7 @@ func DebugVoiceMessage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		debugInfo["error"] = err.Error()
 	} else {
-		encryptionKey := []byte(cfg.EncryptionSecret)
-		decryptedContent, decryptErr := utils.Decrypt(message.Content, encryptionKey)
+		decryptedContent, decryptErr := chatService.DecryptContent(ctx, message.Room, message.Content)
 
 		debugInfo["encrypted_content"] = message.Content
 		debugInfo["decrypted_content"] = decryptedContent
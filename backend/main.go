@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"log"
 	"net/http"
 	"os"
@@ -16,6 +15,7 @@ import (
 	"chatwme/backend/database"
 	"chatwme/backend/routes"
 	"chatwme/backend/services"
+	"chatwme/backend/utils"
 	"chatwme/backend/websockets"
 
 	socketio "github.com/googollee/go-socket.io"
@@ -80,9 +80,27 @@ func main() {
 
 	// 3. 初始化 Socket.IO 伺服器
 	log.Println("Initializing Socket.IO server...")
-	keyHash := sha256.Sum256([]byte(cfg.EncryptionSecret))
-	encryptionKey := keyHash[:]
-	chatService := services.NewChatService(store, encryptionKey)
+	keyring, err := utils.LoadKeyring(cfg)
+	if err != nil {
+		log.Fatalf("Invalid encryption keys: %v", err)
+	}
+	log.Printf("Active encryption key: %s", keyring.ActiveKeyID())
+	chatService := services.NewChatService(store, keyring)
+	indexCtx, indexCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := chatService.EnsureIndexes(indexCtx); err != nil {
+		log.Printf("Warning: Could not create indexes: %v", err)
+	}
+	indexCancel()
+	if cfg.SearchSecret != "" {
+		chatService.SetSearchKey([]byte(cfg.SearchSecret))
+		indexCtx, indexCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := chatService.EnsureSearchIndex(indexCtx); err != nil {
+			log.Printf("Warning: Could not create message search index: %v", err)
+		}
+		indexCancel()
+	} else {
+		log.Println("Warning: SEARCH_INDEX_SECRET not set, message search is disabled")
+	}
 	redisAddr := strings.TrimSpace(os.Getenv("REDIS_ADDR"))
 	var redisOptions *socketio.RedisAdapterOptions
 	if redisAddr != "" {
@@ -91,6 +109,7 @@ func main() {
 		}
 	}
 	socketServer := websockets.NewSocketIOServer(chatService, redisOptions)
+	chatService.SetBroadcaster(socketServer)
 
 	// 啟動 Socket.IO 伺服器
 	go func() {
@@ -102,9 +121,25 @@ func main() {
 	defer socketServer.Close()
 	log.Println("✓ Socket.IO server initialized")
 
+	// 啟動定時消息發送器與過期消息清理，多個實例同時運行時以資料庫操作的結果協調
+	workerCtx, workerCancel := context.WithCancel(context.Background())
+	defer workerCancel()
+	go chatService.RunScheduledMessageWorker(workerCtx, cfg.ScheduledMessageInterval)
+	go chatService.RunMessageExpirySweeper(workerCtx, cfg.MessageSweepInterval, services.GetStorageService())
+	// 將舊密鑰加密的內容遷移到當前密鑰，並為既有的文字消息補建搜尋索引，進度可在 /api/v1/debug/encryption 查看
+	go chatService.RunReencryptionWorker(workerCtx)
+	// 為本實例的連線續期在線記錄，並清理崩潰實例留下的連線
+	go chatService.RunPresenceWorker(workerCtx)
+	// 執行其他實例發出的連線操作，例如將離開聊天室的用戶移出房間
+	go chatService.RunSocketCommandWorker(workerCtx)
+	// 結束客戶端沒有續期的輸入狀態
+	go chatService.RunTypingSweeper(workerCtx)
+	// 冷靜期結束後永久銷毀已刪除帳號的私聊內容
+	go chatService.RunAccountPurgeWorker(workerCtx, cfg.AccountPurgeDelay)
+
 	// 4. 初始化 HTTP API 路由
 	log.Println("Setting up HTTP routes...")
-	apiHandler := routes.SetupRoutes(store)
+	apiHandler := routes.SetupRoutes(store, chatService)
 	log.Println("✓ HTTP routes configured")
 
 	// 5. 設定 HTTP 伺服器
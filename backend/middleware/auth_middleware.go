@@ -5,7 +5,9 @@ import (
 	"net/http"
 	"strings"
 
+	"chatwme/backend/config"
 	"chatwme/backend/database"
+	"chatwme/backend/services"
 	"chatwme/backend/utils"
 )
 
@@ -46,6 +48,22 @@ func JwtAuthentication(next http.Handler) http.Handler {
 	})
 }
 
+// RequireAdmin 只允許 ADMIN_USER_IDS 中的用戶存取，必須在 JwtAuthentication 之後使用
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value(UserIDKey).(string)
+		if userID != "" {
+			for _, adminID := range config.LoadConfig().AdminUserIDs {
+				if adminID == userID {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		http.Error(w, `{"error": "需要管理員權限"}`, http.StatusForbidden)
+	})
+}
+
 func WithStore(store database.Store) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -54,3 +72,12 @@ func WithStore(store database.Store) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+func WithChatService(chatService *services.ChatService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := services.ContextWithChatService(r.Context(), chatService)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -20,12 +20,23 @@ type ChatRoom struct {
 	LastMessage     string             `bson:"last_message" json:"last_message"`
 	LastMessageTime time.Time          `bson:"last_message_time" json:"last_message_time"`
 	UnreadCount     int                `bson:"unread_count" json:"unread_count"`
+	MentionCount    int                `bson:"-" json:"mention_count"`                                     // 當前用戶的未讀提及數，只在返回列表時填充
+	MessageSeq      int64              `bson:"message_seq" json:"message_seq"`                             // 最後分配的消息序號
+	PinnedMessages  []PinnedMessage    `bson:"pinned_messages,omitempty" json:"pinned_messages,omitempty"` // 置頂消息，最新置頂的在前
+	MessageTTL      int64              `bson:"message_ttl,omitempty" json:"message_ttl"`                   // 新消息自動刪除的秒數，0 表示不刪除
 	AvatarURL       string             `bson:"avatar_url,omitempty" json:"avatar_url,omitempty"`
 	IsActive        bool               `bson:"is_active" json:"is_active"` // 群組是否活躍
 	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
+// PinnedMessage 聊天室中被置頂的消息
+type PinnedMessage struct {
+	MessageID string    `bson:"message_id" json:"message_id"`
+	PinnedBy  string    `bson:"pinned_by" json:"pinned_by"`
+	PinnedAt  time.Time `bson:"pinned_at" json:"pinned_at"`
+}
+
 // GroupInvitation 群組邀請模型
 type GroupInvitation struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
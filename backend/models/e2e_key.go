@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// E2EDeviceKeys 設備發佈的端到端加密公鑰，每個登入會話（設備）一條記錄
+// 伺服器只保存公鑰，私鑰永遠不離開設備
+type E2EDeviceKeys struct {
+	ID           primitive.ObjectID `bson:"_id" json:"device_id"` // 對應 LoginSession 的 ID
+	UserID       string             `bson:"user_id" json:"user_id"`
+	IdentityKey  string             `bson:"identity_key" json:"identity_key"` // 長期身份公鑰（base64）
+	SignedPreKey SignedPreKey       `bson:"signed_pre_key" json:"signed_pre_key"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// SignedPreKey 以身份密鑰簽名的中期預共享公鑰，設備定期輪換
+type SignedPreKey struct {
+	KeyID     int    `bson:"key_id" json:"key_id"`
+	PublicKey string `bson:"public_key" json:"public_key"`
+	Signature string `bson:"signature" json:"signature"`
+}
+
+// OneTimePreKey 一次性預共享公鑰，每把只會發給一個請求者
+type OneTimePreKey struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	DeviceID  primitive.ObjectID `bson:"device_id" json:"-"`
+	UserID    string             `bson:"user_id" json:"-"`
+	KeyID     int                `bson:"key_id" json:"key_id"`
+	PublicKey string             `bson:"public_key" json:"public_key"`
+	CreatedAt time.Time          `bson:"created_at" json:"-"`
+}
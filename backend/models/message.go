@@ -8,25 +8,60 @@ import (
 
 // Message 代表一条聊天讯息
 type Message struct {
-	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	SenderID   string             `bson:"sender_id" json:"sender_id"`
-	SenderName string             `bson:"sender_name" json:"sender_name"` // 新增：发送者用户名
-	Room       string             `bson:"room" json:"room"`
-	Content    string             `bson:"content" json:"content"`
-	FileURL    string             `bson:"file_url,omitempty" json:"file_url,omitempty"`
-	Duration   int                `bson:"duration,omitempty" json:"duration,omitempty"`
-	FileSize   int64              `bson:"file_size,omitempty" json:"file_size,omitempty"`
-	Timestamp  time.Time          `bson:"timestamp" json:"timestamp"`
-	Type       string             `bson:"type" json:"type"`                                 // 新增：消息类型
-	IsDeleted  bool               `bson:"is_deleted" json:"is_deleted"`                     // 新增：是否已刪除
-	DeletedAt  *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"` // 新增：刪除時間
-	DeletedBy  *string            `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"` // 新增：刪除者ID
-	ReadBy     []string           `bson:"read_by,omitempty" json:"read_by,omitempty"`       // 新增：已读用户ID列表
+	ID            primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	SenderID      string              `bson:"sender_id" json:"sender_id"`
+	SenderName    string              `bson:"sender_name" json:"sender_name"` // 新增：发送者用户名
+	Room          string              `bson:"room" json:"room"`
+	Content       string              `bson:"content" json:"content"`
+	FileURL       string              `bson:"file_url,omitempty" json:"file_url,omitempty"`
+	Duration      int                 `bson:"duration,omitempty" json:"duration,omitempty"`
+	FileSize      int64               `bson:"file_size,omitempty" json:"file_size,omitempty"`
+	Timestamp     time.Time           `bson:"timestamp" json:"timestamp"`
+	Type          string              `bson:"type" json:"type"`                                         // 新增：消息类型
+	IsDeleted     bool                `bson:"is_deleted" json:"is_deleted"`                             // 新增：是否已刪除
+	DeletedAt     *time.Time          `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`         // 新增：刪除時間
+	DeletedBy     *string             `bson:"deleted_by,omitempty" json:"deleted_by,omitempty"`         // 新增：刪除者ID
+	ReadBy        []string            `bson:"read_by,omitempty" json:"read_by,omitempty"`               // 新增：已读用户ID列表（舊數據；新的已讀狀態由 read_cursors 推導）
+	DeliveredTo   []MessageReceipt    `bson:"delivered_to,omitempty" json:"-"`                          // 已確認收到消息的用戶與時間
+	Seq           int64               `bson:"seq,omitempty" json:"seq,omitempty"`                       // 房間內嚴格遞增的序號
+	EditedAt      *time.Time          `bson:"edited_at,omitempty" json:"edited_at,omitempty"`           // 最後編輯時間
+	EditHistory   []MessageEdit       `bson:"edit_history,omitempty" json:"-"`                          // 編輯前的加密內容，按時間先後排列
+	ReplyTo       string              `bson:"reply_to,omitempty" json:"reply_to,omitempty"`             // 被回覆的消息 ID
+	ThreadRoot    string              `bson:"thread_root,omitempty" json:"thread_root,omitempty"`       // 所屬話題的根消息 ID
+	ForwardedFrom *ForwardInfo        `bson:"forwarded_from,omitempty" json:"forwarded_from,omitempty"` // 轉發來源
+	Mentions      []string            `bson:"mentions,omitempty" json:"mentions,omitempty"`             // 被提及的用戶 ID（明文，供查詢）
+	MentionAll    bool                `bson:"mention_all,omitempty" json:"mention_all,omitempty"`       // 是否使用了 @all
+	SearchTokens  []string            `bson:"search_tokens,omitempty" json:"-"`                         // 內容詞元的盲索引（HMAC），供搜尋使用
+	Reactions     map[string][]string `bson:"reactions,omitempty" json:"reactions,omitempty"`           // 表情回應：表情 -> 用戶 ID 列表
+	ExpiresAt     *time.Time          `bson:"expires_at,omitempty" json:"expires_at,omitempty"`         // 到期後由清理任務永久刪除（阅后即焚）
+}
+
+// MessageEdit 保存消息被編輯前的一個版本
+type MessageEdit struct {
+	Content  string    `bson:"content" json:"content"` // 編輯前的加密內容
+	EditedAt time.Time `bson:"edited_at" json:"edited_at"`
+}
+
+// MessageReceipt 記錄某位用戶收到或讀取消息的時間
+type MessageReceipt struct {
+	UserID string    `bson:"user_id" json:"user_id"`
+	At     time.Time `bson:"at" json:"at"`
+}
+
+// ForwardInfo 記錄被轉發消息的原始出處，多次轉發時保留最初的來源
+type ForwardInfo struct {
+	MessageID  string    `bson:"message_id" json:"message_id"`
+	RoomID     string    `bson:"room_id" json:"room_id"`
+	SenderID   string    `bson:"sender_id" json:"sender_id"`
+	SenderName string    `bson:"sender_name" json:"sender_name"`
+	SentAt     time.Time `bson:"sent_at" json:"sent_at"`
 }
 
 // 定义消息类型常量
 const (
-	MessageTypeText  = "text"
-	MessageTypeVoice = "voice"
-	MessageTypeImage = "image"
+	MessageTypeText   = "text"
+	MessageTypeVoice  = "voice"
+	MessageTypeImage  = "image"
+	MessageTypeSystem = "system" // 系統通知，例如聊天室設定變更
+	MessageTypeE2E    = "e2e"    // 端到端加密消息，內容是客戶端加密的密文，伺服器原樣保存與轉發
 )
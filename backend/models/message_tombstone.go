@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 墓碑記錄的原因
+const (
+	TombstoneReasonExpired   = "expired"    // 消息到期後被清理任務永久刪除
+	TombstoneReasonUnusedSeq = "unused_seq" // 序號已分配但消息寫入失敗，這個序號從未有過消息
+)
+
+// MessageTombstone 記錄被永久刪除的消息與沒有消息的序號
+// 斷線重連的客戶端在同步時據此移除本地副本，並區分序號的空缺是從未存在還是尚未取得
+type MessageTombstone struct {
+	ID        primitive.ObjectID `bson:"_id"` // 被刪除的消息 ID；未使用的序號為新產生的 ID
+	Room      string             `bson:"room"`
+	Seq       int64              `bson:"seq,omitempty"`
+	Reason    string             `bson:"reason"`
+	RemovedAt time.Time          `bson:"removed_at"`
+}
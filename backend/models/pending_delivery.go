@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// PendingDelivery 消息寫入時接收者沒有連線在聊天室中，等待其下次連線時補發
+// 客戶端以 message_received 確認收到後刪除
+type PendingDelivery struct {
+	ID        string    `bson:"_id"` // message_id:user_id，同一條消息對每位用戶只有一條記錄
+	UserID    string    `bson:"user_id"`
+	RoomID    string    `bson:"room_id"`
+	MessageID string    `bson:"message_id"`
+	Seq       int64     `bson:"seq"`
+	CreatedAt time.Time `bson:"created_at"`
+}
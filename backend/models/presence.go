@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// 用戶在線狀態
+const (
+	PresenceOnline  = "online"  // 至少一台設備在線且未閒置
+	PresenceAway    = "away"    // 所有在線設備都已閒置
+	PresenceOffline = "offline" // 沒有任何連線
+)
+
+// PresenceConnection 一個 Socket 連線的在線記錄，所有實例共用，用於跨設備統計用戶的連線
+type PresenceConnection struct {
+	ID          string    `bson:"_id"` // Socket ID
+	UserID      string    `bson:"user_id"`
+	Idle        bool      `bson:"idle"` // 客戶端在心跳中回報的閒置狀態
+	ConnectedAt time.Time `bson:"connected_at"`
+	ExpiresAt   time.Time `bson:"expires_at"` // 由持有連線的實例定期續期，實例崩潰後過期即視為斷線
+}
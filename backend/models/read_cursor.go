@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// ReadCursor 用戶在聊天室中的已讀位置，位置之前（含）的消息都視為已讀
+type ReadCursor struct {
+	ID                string    `bson:"_id" json:"-"` // room_id:user_id，保證每位用戶在每個聊天室只有一條記錄
+	RoomID            string    `bson:"room_id" json:"room"`
+	UserID            string    `bson:"user_id" json:"user_id"`
+	LastReadMessageID string    `bson:"last_read_message_id" json:"last_read_message_id"`
+	LastReadSeq       int64     `bson:"last_read_seq" json:"last_read_seq"`
+	LastReadAt        time.Time `bson:"last_read_at" json:"last_read_at"`   // 已讀位置消息的發送時間，用於沒有序號的舊消息
+	UnreadCount       int       `bson:"unread_count" json:"unread_count"`   // 位置之後他人發送的消息數，發送消息時遞增
+	MentionCount      int       `bson:"mention_count" json:"mention_count"` // 其中提及該用戶的消息數
+	CountsVersion     int64     `bson:"counts_version,omitempty" json:"-"`  // 計數每次變動時遞增，重新計算時用於檢查期間沒有新的變動
+	CountsSeq         int64     `bson:"counts_seq,omitempty" json:"-"`      // 重新計算時已計入的最大序號，不超過它的新消息不再遞增
+	UpdatedAt         time.Time `bson:"updated_at" json:"updated_at"`       // 已讀位置最後移動的時間
+}
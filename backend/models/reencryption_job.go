@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 重新加密任務狀態
+const (
+	ReencryptionStatusRunning   = "running"   // 正在遷移，中斷後從 LastID 繼續
+	ReencryptionStatusCompleted = "completed" // 所有內容都已使用目標密鑰加密
+)
+
+// ReencryptionJob 記錄將既有密文遷移到某把密鑰的進度，每把密鑰與遷移版本只有一條記錄
+type ReencryptionJob struct {
+	ID          string             `bson:"_id" json:"id"`        // 目標密鑰 ID 與遷移版本，啟用搜尋時加上 "+search"，例如 "v2@3+search"
+	KeyID       string             `bson:"key_id" json:"key_id"` // 目標密鑰 ID
+	Status      string             `bson:"status" json:"status"`
+	Collection  string             `bson:"collection" json:"collection"` // 目前正在處理的集合
+	LastID      primitive.ObjectID `bson:"last_id" json:"-"`             // 目前集合中已處理到的最後一條記錄
+	Total       int64              `bson:"total" json:"total"`           // 開始時各集合的記錄總數，用於估算進度
+	Processed   int64              `bson:"processed" json:"processed"`
+	Migrated    int64              `bson:"migrated" json:"migrated"` // 實際重新加密的記錄數
+	Indexed     int64              `bson:"indexed" json:"indexed"`   // 補建搜尋索引的消息數
+	Failed      int64              `bson:"failed" json:"failed"`     // 無法解密而跳過的記錄數
+	LockedBy    string             `bson:"locked_by,omitempty" json:"-"`
+	LockedUntil time.Time          `bson:"locked_until" json:"-"`
+	StartedAt   time.Time          `bson:"started_at" json:"started_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+	CompletedAt *time.Time         `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
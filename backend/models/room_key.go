@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RoomKey 聊天室的資料密鑰，以主密鑰包裝後保存
+// 聊天室的消息與媒體都使用這把密鑰加密，刪除記錄後這些內容即無法再解密（加密銷毀）
+type RoomKey struct {
+	ID         primitive.ObjectID `bson:"_id"`         // 聊天室 ID
+	WrappedKey string             `bson:"wrapped_key"` // 以主密鑰環加密的資料密鑰
+	CreatedAt  time.Time          `bson:"created_at"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 定時消息狀態
+const (
+	ScheduledStatusPending    = "pending"    // 等待發送
+	ScheduledStatusProcessing = "processing" // 已被某個實例認領，正在發送
+	ScheduledStatusSent       = "sent"       // 已發送
+	ScheduledStatusCancelled  = "cancelled"  // 已被用戶取消
+	ScheduledStatusFailed     = "failed"     // 發送失敗（例如已離開聊天室）
+)
+
+// ScheduledMessage 代表一條等待在未來時間發送的消息
+type ScheduledMessage struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	RoomID     string             `bson:"room_id" json:"room"`
+	SenderID   string             `bson:"sender_id" json:"sender_id"`
+	SenderName string             `bson:"sender_name" json:"sender_name"`
+	Content    string             `bson:"content" json:"-"`             // 加密後的內容
+	MessageID  primitive.ObjectID `bson:"message_id" json:"message_id"` // 預先分配的消息 ID，重試時避免重複發送
+	SendAt     time.Time          `bson:"send_at" json:"send_at"`
+	Status     string             `bson:"status" json:"status"`
+	ClaimedBy  string             `bson:"claimed_by,omitempty" json:"-"` // 認領任務的實例
+	ClaimedAt  *time.Time         `bson:"claimed_at,omitempty" json:"-"`
+	Attempts   int                `bson:"attempts" json:"attempts"`
+	Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+	SentAt     *time.Time         `bson:"sent_at,omitempty" json:"sent_at,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Socket 命令類型
+const (
+	SocketCommandLeaveRoom  = "leave_room" // 將用戶的連線移出聊天室，未指定用戶時移出所有連線
+	SocketCommandDisconnect = "disconnect" // 強制斷開用戶的連線，指定會話時只斷開該會話的連線
+)
+
+// 強制斷開連線的原因，隨 "force_disconnect" 事件發送給客戶端
+const (
+	DisconnectReasonSessionTerminated = "session_terminated" // 登入會話已被終止
+	DisconnectReasonAccountDeleted    = "account_deleted"    // 帳號已刪除
+	DisconnectReasonTokenExpired      = "token_expired"      // token 已過期且未重新驗證
+	DisconnectReasonRateLimited       = "rate_limited"       // 屢次超出事件速率限制
+)
+
+// SocketCommand 需要所有實例對本地連線執行的操作，發出的實例已在本地執行，其他實例輪詢後執行
+type SocketCommand struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Type      string             `bson:"type"`
+	Origin    string             `bson:"origin"` // 發出命令的實例 ID
+	RoomID    string             `bson:"room_id,omitempty"`
+	UserID    string             `bson:"user_id,omitempty"`
+	SessionID string             `bson:"session_id,omitempty"`
+	Reason    string             `bson:"reason,omitempty"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
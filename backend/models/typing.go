@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// TypingState 用戶在聊天室中正在輸入的狀態，所有實例共用，過期後視為停止輸入
+type TypingState struct {
+	ID        string    `bson:"_id"` // 聊天室 ID 與用戶 ID，例如 "roomid:userid"
+	RoomID    string    `bson:"room_id"`
+	UserID    string    `bson:"user_id"`
+	Username  string    `bson:"username"`
+	ExpiresAt time.Time `bson:"expires_at"` // 客戶端持續輸入時會定期續期
+}
+
+// TypingUser 正在輸入列表中的一個用戶
+type TypingUser struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+}
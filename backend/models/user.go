@@ -15,12 +15,15 @@ type User struct {
 	Language  string             `bson:"language" json:"language"`
 	AvatarURL *string            `bson:"avatar_url,omitempty" json:"avatar_url,omitempty"`
 	IsOnline  bool               `bson:"is_online" json:"is_online"`
+	Presence  string             `bson:"presence,omitempty" json:"presence,omitempty"` // online、away 或 offline，由 Socket 連線維護
 	LastSeen  *time.Time         `bson:"last_seen,omitempty" json:"last_seen,omitempty"`
 	// 帳號狀態相關字段
 	IsActive       bool       `bson:"is_active" json:"is_active"`                                 // 帳號是否活躍
 	IsDeleted      bool       `bson:"is_deleted" json:"is_deleted"`                               // 帳號是否已刪除
 	DeletedAt      *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`           // 刪除時間
 	DeletionReason *string    `bson:"deletion_reason,omitempty" json:"deletion_reason,omitempty"` // 刪除原因
+	PurgeStartedAt *time.Time `bson:"purge_started_at,omitempty" json:"-"`                        // 開始永久清除資料的時間，之後不能再取消刪除
+	DataPurgedAt   *time.Time `bson:"data_purged_at,omitempty" json:"-"`                          // 私聊內容已永久銷毀的時間
 	CreatedAt      time.Time  `bson:"created_at" json:"created_at"`
 	UpdatedAt      time.Time  `bson:"updated_at" json:"updated_at"`
 }
@@ -13,9 +13,15 @@ func SetupChatMessageRoutes(router *mux.Router) {
 	messageRouter := router.PathPrefix("/messages").Subrouter()
 	messageRouter.Use(middleware.JwtAuthentication)
 
+	// 跨聊天室搜尋消息（必須在 /{room} 之前註冊）
+	messageRouter.HandleFunc("/search", controllers.SearchMessages).Methods("GET")
+
 	// 將路由註冊到新的子路由器上
 	// 現在 GET /api/v1/messages/{room} 會受到保護
 	messageRouter.HandleFunc("/{room}", controllers.GetMessagesByRoom).Methods("GET")
+
+	// 轉發消息到其他聊天室
+	messageRouter.HandleFunc("/forward", controllers.ForwardMessages).Methods("POST")
 	
 	// 注意：聊天室的消息路由現在移到了 chat_room_routes.go 中
 	// 作為 /api/v1/rooms/{id}/messages
@@ -15,14 +15,34 @@ func SetupChatRoomRoutes(router *mux.Router) {
 	// 聊天室管理路由
 	roomRouter.HandleFunc("", controllers.GetChatRooms).Methods("GET")              // 獲取聊天室列表
 	roomRouter.HandleFunc("", controllers.CreateChatRoom).Methods("POST")           // 創建聊天室
+	roomRouter.HandleFunc("/unread", controllers.GetUnreadSummary).Methods("GET")   // 未讀總數（需在 /{id} 之前註冊）
 	roomRouter.HandleFunc("/{id}", controllers.GetRoomDetails).Methods("GET")       // 獲取聊天室詳情
+	roomRouter.HandleFunc("/{id}", controllers.PurgeDirectChat).Methods("DELETE")   // 永久刪除私聊
 	roomRouter.HandleFunc("/{id}/invite", controllers.InviteToRoom).Methods("POST") // 邀請用戶
 	roomRouter.HandleFunc("/{id}/leave", controllers.LeaveRoom).Methods("POST")     // 離開聊天室
 	roomRouter.HandleFunc("/{id}/read", controllers.MarkAsRead).Methods("POST")     // 標記已讀
+	roomRouter.HandleFunc("/{id}/message-ttl", controllers.SetMessageTTL).Methods("PUT") // 設置消息自動刪除時間
 
 	// 聊天室消息路由
 	roomRouter.HandleFunc("/{id}/messages", controllers.GetMessagesByRoom).Methods("GET") // 獲取聊天記錄
 	roomRouter.HandleFunc("/{id}/messages", controllers.SendMessage).Methods("POST")      // 發送消息
+	roomRouter.HandleFunc("/{id}/messages/search", controllers.SearchRoomMessages).Methods("GET") // 搜尋消息
+	roomRouter.HandleFunc("/{id}/messages/{messageId}", controllers.EditMessage).Methods("PUT") // 編輯消息
+	roomRouter.HandleFunc("/{id}/messages/{messageId}/thread", controllers.GetThreadMessages).Methods("GET") // 獲取話題回覆
+	roomRouter.HandleFunc("/{id}/messages/{messageId}/receipts", controllers.GetMessageReceipts).Methods("GET") // 獲取送達與已讀回執
+	roomRouter.HandleFunc("/{id}/messages/{messageId}/reactions", controllers.AddReaction).Methods("POST")             // 添加表情回應
+	roomRouter.HandleFunc("/{id}/messages/{messageId}/reactions/{emoji}", controllers.RemoveReaction).Methods("DELETE") // 移除表情回應
+
+	// 置頂消息路由
+	roomRouter.HandleFunc("/{id}/pins", controllers.GetPinnedMessages).Methods("GET")           // 獲取置頂消息
+	roomRouter.HandleFunc("/{id}/pins/{messageId}", controllers.PinMessage).Methods("POST")     // 置頂消息
+	roomRouter.HandleFunc("/{id}/pins/{messageId}", controllers.UnpinMessage).Methods("DELETE") // 取消置頂
+
+	// 定時消息路由
+	roomRouter.HandleFunc("/{id}/scheduled-messages", controllers.GetScheduledMessages).Methods("GET")                     // 獲取定時消息
+	roomRouter.HandleFunc("/{id}/scheduled-messages", controllers.CreateScheduledMessage).Methods("POST")                  // 建立定時消息
+	roomRouter.HandleFunc("/{id}/scheduled-messages/{scheduledId}", controllers.UpdateScheduledMessage).Methods("PUT")     // 修改定時消息
+	roomRouter.HandleFunc("/{id}/scheduled-messages/{scheduledId}", controllers.CancelScheduledMessage).Methods("DELETE") // 取消定時消息
 	
 	// 語音消息路由 - 修正路由路徑
 	roomRouter.HandleFunc("/{id}/voice", controllers.UploadVoiceMessage).Methods("POST")           // 上傳語音消息
@@ -33,4 +53,7 @@ func SetupChatRoomRoutes(router *mux.Router) {
 
 	// 视频消息路由
 	roomRouter.HandleFunc("/upload/video", controllers.UploadVideo).Methods("POST") // 上传视频
+
+	// 聊天室加密媒体（需为聊天室成员）
+	roomRouter.HandleFunc("/{id}/media/{name}", controllers.GetRoomMedia).Methods("GET") // 下载并解密媒体
 }
\ No newline at end of file
@@ -11,6 +11,8 @@ func SetupDebugRoutes(router *mux.Router) {
 	// 创建调试子路由器
 	debugRouter := router.PathPrefix("/debug").Subrouter()
 	debugRouter.Use(middleware.JwtAuthentication)
+	// 調試端點會返回解密後的內容與內部狀態，僅限管理員
+	debugRouter.Use(middleware.RequireAdmin)
 
 	// 系统信息调试
 	debugRouter.HandleFunc("/system", controllers.DebugSystemInfo).Methods("GET")
@@ -18,4 +20,10 @@ func SetupDebugRoutes(router *mux.Router) {
 	// 语音消息调试
 	debugRouter.HandleFunc("/voice/list", controllers.DebugListVoiceMessages).Methods("GET")
 	debugRouter.HandleFunc("/voice/{messageId}", controllers.DebugVoiceMessageDetailed).Methods("GET")
+
+	// 加密密鑰與重新加密進度
+	debugRouter.HandleFunc("/encryption", controllers.DebugEncryptionStatus).Methods("GET")
+
+	// Socket 事件限流計數
+	debugRouter.HandleFunc("/socket-rate-limits", controllers.DebugSocketRateLimits).Methods("GET")
 }
\ No newline at end of file
@@ -0,0 +1,25 @@
+package routes
+
+import (
+	"net/http"
+
+	"chatwme/backend/controllers"
+	"chatwme/backend/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// SetupE2EKeyRoutes 設置端到端加密密鑰目錄路由，deviceId 為登入返回的 session_id
+func SetupE2EKeyRoutes(r *mux.Router) {
+	// 發佈或更新設備密鑰 - 需要認證
+	r.Handle("/keys/devices/{deviceId}", middleware.JwtAuthentication(http.HandlerFunc(controllers.PublishDeviceKeys))).Methods("PUT")
+
+	// 補充一次性預共享密鑰 - 需要認證
+	r.Handle("/keys/devices/{deviceId}/one-time-prekeys", middleware.JwtAuthentication(http.HandlerFunc(controllers.UploadOneTimePreKeys))).Methods("POST")
+
+	// 查詢剩餘的一次性預共享密鑰數 - 需要認證
+	r.Handle("/keys/devices/{deviceId}/one-time-prekeys/count", middleware.JwtAuthentication(http.HandlerFunc(controllers.GetPreKeyCount))).Methods("GET")
+
+	// 取得並消耗目標用戶的密鑰包 - 需要認證
+	r.Handle("/keys/users/{userId}/bundles", middleware.JwtAuthentication(http.HandlerFunc(controllers.ClaimPreKeyBundles))).Methods("POST")
+}
@@ -23,6 +23,9 @@ func SetupGroupRoutes(r *mux.Router) {
 	// 離開群組 - 需要認證
 	r.Handle("/groups/leave", middleware.JwtAuthentication(http.HandlerFunc(controllers.LeaveGroup))).Methods("POST")
 
+	// 解散群組（永久刪除所有消息與媒體）- 需要認證
+	r.Handle("/groups/dissolve", middleware.JwtAuthentication(http.HandlerFunc(controllers.DissolveGroup))).Methods("POST")
+
 	// 獲取群組成員列表 - 需要認證
 	r.Handle("/groups/members", middleware.JwtAuthentication(http.HandlerFunc(controllers.GetGroupMembers))).Methods("GET")
 
@@ -0,0 +1,16 @@
+package routes
+
+import (
+	"net/http"
+
+	"chatwme/backend/controllers"
+	"chatwme/backend/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// SetupMentionRoutes 設置提及相關路由
+func SetupMentionRoutes(r *mux.Router) {
+	// 獲取提及自己的消息 - 需要認證
+	r.Handle("/mentions", middleware.JwtAuthentication(http.HandlerFunc(controllers.GetMentions))).Methods("GET")
+}
@@ -0,0 +1,16 @@
+package routes
+
+import (
+	"net/http"
+
+	"chatwme/backend/controllers"
+	"chatwme/backend/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+// SetupPresenceRoutes 設置在線狀態路由
+func SetupPresenceRoutes(r *mux.Router) {
+	// 批量查詢用戶在線狀態 - 需要認證
+	r.Handle("/presence", middleware.JwtAuthentication(http.HandlerFunc(controllers.GetPresence))).Methods("GET")
+}
@@ -8,6 +8,7 @@ import (
 	"chatwme/backend/config"
 	"chatwme/backend/database"
 	"chatwme/backend/middleware"
+	"chatwme/backend/services"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -25,9 +26,10 @@ func helloHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // SetupRoutes 設定並返回一個新的 mux.Router
-func SetupRoutes(store database.Store) http.Handler {
+func SetupRoutes(store database.Store, chatService *services.ChatService) http.Handler {
 	r := mux.NewRouter()
 	r.Use(middleware.WithStore(store))
+	r.Use(middleware.WithChatService(chatService))
 
 	// 為所有 API 加上 /api/v1 前綴
 	api := r.PathPrefix("/api/v1").Subrouter()
@@ -78,6 +80,9 @@ func SetupRoutes(store database.Store) http.Handler {
 	SetupMessageDeleteRoutes(api) // 🔥 新增：消息刪除路由
 	SetupAccountDeleteRoutes(api) // 🔥 新增：帳號刪除路由
 	SetupGroupRoutes(api)         // 🔥 新增：群組路由
+	SetupMentionRoutes(api)       // 提及路由
+	SetupE2EKeyRoutes(api)        // 端到端加密密鑰目錄路由
+	SetupPresenceRoutes(api)      // 在線狀態路由
 	SetupDebugRoutes(api)         // 🔥 新增：调试路由
 	SetupStaticRoutes(r)          // 注意：這個要在 api 子路由之外
 	SetupRefreshTokenRoutes(api)  // 🔥 新增這一行
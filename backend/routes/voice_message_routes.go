@@ -18,7 +18,7 @@ func SetupVoiceMessageRoutes(router *mux.Router) {
 
 	// 🔥 修正：語音消息路由 - 配合前端API調用
 	voiceRouter.HandleFunc("/{messageId}/url", controllers.GetVoiceMessageURL).Methods("GET")   // 獲取語音消息播放URL
-	voiceRouter.HandleFunc("/{messageId}/debug", controllers.DebugVoiceMessage).Methods("GET") // 调试端点
+	voiceRouter.Handle("/{messageId}/debug", middleware.RequireAdmin(http.HandlerFunc(controllers.DebugVoiceMessage))).Methods("GET") // 调试端点，會返回解密內容，僅限管理員
 	
 	// 🔥 新增：語音服務狀態檢查端點
 	voiceRouter.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	accountPurgeInterval = 10 * time.Minute // 檢查到期帳號的間隔
+	accountPurgeLease    = 30 * time.Minute // 清除失敗或實例崩潰後，多久之後由其他實例重試
+)
+
+// ClaimDueAccountPurge 認領一個已超過冷靜期、尚未清除資料的已刪除帳號
+// 認領後帳號不能再取消刪除；多個實例同時運行時每個帳號只會被一個實例認領
+func (s *ChatService) ClaimDueAccountPurge(ctx context.Context, delay time.Duration) (*models.User, error) {
+	now := time.Now()
+	filter := bson.M{
+		"is_deleted":     true,
+		"deleted_at":     bson.M{"$lte": now.Add(-delay)},
+		"data_purged_at": bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"purge_started_at": bson.M{"$exists": false}},
+			{"purge_started_at": bson.M{"$lte": now.Add(-accountPurgeLease)}},
+		},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "deleted_at", Value: 1}}).
+		SetProjection(bson.M{"_id": 1, "deleted_at": 1}).
+		SetReturnDocument(options.After)
+
+	var user models.User
+	err := s.store.Collection("users").FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": bson.M{"purge_started_at": now}}, opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// PurgeDeletedAccount 永久銷毀已刪除帳號的私聊內容；失敗時保留認領記錄，租期過後重試
+func (s *ChatService) PurgeDeletedAccount(ctx context.Context, user models.User) error {
+	userID := user.ID.Hex()
+	if err := s.PurgeUserDirectChats(ctx, userID); err != nil {
+		return err
+	}
+	_, err := s.store.Collection("users").UpdateOne(ctx,
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"data_purged_at": time.Now()}})
+	return err
+}
+
+// RunAccountPurgeWorker 定期永久清除超過冷靜期的已刪除帳號，直到 ctx 被取消
+func (s *ChatService) RunAccountPurgeWorker(ctx context.Context, delay time.Duration) {
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+
+	log.Printf("Account purge worker started (delay %s)", delay)
+	for {
+		for ctx.Err() == nil {
+			workCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			user, err := s.ClaimDueAccountPurge(workCtx, delay)
+			if err != nil {
+				cancel()
+				log.Printf("Failed to claim deleted account: %v", err)
+				break
+			}
+			if user == nil {
+				cancel()
+				break
+			}
+			if err := s.PurgeDeletedAccount(workCtx, *user); err != nil {
+				log.Printf("Failed to purge deleted account %s: %v", user.ID.Hex(), err)
+			} else {
+				log.Printf("Purged data of deleted account %s", user.ID.Hex())
+			}
+			cancel()
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Account purge worker stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,6 +2,8 @@ package services
 
 import (
 	"context"
+	"errors"
+	"log"
 	"time"
 
 	"chatwme/backend/database"
@@ -11,22 +13,131 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrNotRoomMember = errors.New("不是聊天室成員")
+	ErrSenderBlocked = errors.New("已被聊天室中的參與者封鎖")
 )
 
 type ChatService struct {
-	store         database.Store
-	encryptionKey []byte
+	store       database.Store
+	keyring     *utils.Keyring
+	broadcaster Broadcaster
+	searchKey   []byte // 盲索引密鑰，為空時不建立搜尋索引
+	roomKeys    roomKeyCache
+	sockets     socketRegistry
+	typing      typingThrottle
+
+	socketController SocketController
+	instanceID       string // 區分各實例發出的 Socket 命令
 }
 
-func NewChatService(store database.Store, encryptionKey []byte) *ChatService {
+// Broadcaster 向 Socket.IO 房間廣播事件，由 *socketio.Server 實現
+type Broadcaster interface {
+	BroadcastToRoom(namespace string, room, event string, args ...interface{}) bool
+}
+
+type contextKey string
+
+const chatServiceContextKey contextKey = "chat_service"
+
+func NewChatService(store database.Store, keyring *utils.Keyring) *ChatService {
 	return &ChatService{
-		store:         store,
-		encryptionKey: encryptionKey,
+		store:      store,
+		keyring:    keyring,
+		instanceID: primitive.NewObjectID().Hex(),
+	}
+}
+
+// SetBroadcaster 設置廣播器，使 REST 請求產生的變更也能即時推送給房間內的連線
+func (s *ChatService) SetBroadcaster(broadcaster Broadcaster) {
+	s.broadcaster = broadcaster
+}
+
+// BroadcastToRoom 向聊天室廣播事件；尚未設置廣播器時忽略
+func (s *ChatService) BroadcastToRoom(roomID, event string, data interface{}) {
+	if s.broadcaster == nil {
+		return
+	}
+	s.broadcaster.BroadcastToRoom("/", roomID, event, data)
+}
+
+func ContextWithChatService(ctx context.Context, chatService *ChatService) context.Context {
+	return context.WithValue(ctx, chatServiceContextKey, chatService)
+}
+
+func ChatServiceFromContext(ctx context.Context) (*ChatService, bool) {
+	chatService, ok := ctx.Value(chatServiceContextKey).(*ChatService)
+	return chatService, ok && chatService != nil
+}
+
+// NextMessageSeq 以原子方式遞增聊天室的消息計數器，返回新分配的序號
+func (s *ChatService) NextMessageSeq(ctx context.Context, roomID string) (int64, error) {
+	counter, err := s.allocateMessageSeq(ctx, roomID)
+	return counter.MessageSeq, err
+}
+
+// roomMessageCounter 分配序號時一併讀出的聊天室資料，避免寫入消息時再次查詢
+type roomMessageCounter struct {
+	MessageSeq   int64    `bson:"message_seq"`
+	MessageTTL   int64    `bson:"message_ttl"`
+	Participants []string `bson:"participants"`
+	CreatedBy    string   `bson:"created_by"`
+}
+
+// allocateMessageSeq 遞增消息計數器，同時讀出聊天室當前的消息保留時間（秒）與成員
+func (s *ChatService) allocateMessageSeq(ctx context.Context, roomID string) (roomMessageCounter, error) {
+	var counter roomMessageCounter
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return counter, err
+	}
+
+	collection := s.store.Collection("chat_rooms")
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"message_seq": 1, "message_ttl": 1, "participants": 1, "created_by": 1})
+
+	err = collection.FindOneAndUpdate(ctx, bson.M{"_id": roomObjectID}, bson.M{"$inc": bson.M{"message_seq": 1}}, opts).Decode(&counter)
+	return counter, err
+}
+
+// InsertMessage 為已加密的消息分配序號並寫入資料庫，所有消息寫入都應經過這裡
+// 聊天室開啟了消息自動刪除時，同時設置消息的到期時間（系統消息除外）；寫入後遞增其他成員的未讀計數，
+// 並為不在聊天室中的成員記錄待送達消息
+func (s *ChatService) InsertMessage(ctx context.Context, message *models.Message) error {
+	counter, err := s.allocateMessageSeq(ctx, message.Room)
+	if err != nil {
+		return err
+	}
+	message.Seq = counter.MessageSeq
+	if counter.MessageTTL > 0 && message.ExpiresAt == nil && message.Type != models.MessageTypeSystem {
+		expiresAt := message.Timestamp.Add(time.Duration(counter.MessageTTL) * time.Second)
+		message.ExpiresAt = &expiresAt
 	}
+
+	collection := s.store.Collection("messages")
+	if _, err := collection.InsertOne(ctx, message); err != nil {
+		// 序號已經分配，記錄下來讓同步與區間查詢的客戶端知道這個序號不會有消息
+		if tombstoneErr := s.recordTombstone(ctx, primitive.NewObjectID(), message.Room, message.Seq, models.TombstoneReasonUnusedSeq); tombstoneErr != nil {
+			log.Printf("Failed to record unused seq %d of room %s: %v", message.Seq, message.Room, tombstoneErr)
+		}
+		return err
+	}
+
+	members := counter.Participants
+	if counter.CreatedBy != "" {
+		members = append(members, counter.CreatedBy)
+	}
+	s.incrementUnreadCounts(ctx, *message, members)
+	s.enqueuePendingDeliveries(ctx, *message, members)
+	return nil
 }
 
-func (s *ChatService) SaveMessage(ctx context.Context, senderID, senderName, roomID, content, messageType, fileURL string, duration int, fileSize int64) (models.Message, error) {
-	encryptedContent, err := utils.Encrypt(content, s.encryptionKey)
+func (s *ChatService) SaveMessage(ctx context.Context, senderID, senderName, roomID, content, messageType, fileURL string, duration int, fileSize int64, opts ...MessageOption) (models.Message, error) {
+	encryptedContent, err := s.encryptMessageContent(ctx, roomID, messageType, content)
 	if err != nil {
 		return models.Message{}, err
 	}
@@ -43,26 +154,45 @@ func (s *ChatService) SaveMessage(ctx context.Context, senderID, senderName, roo
 		Timestamp:  time.Now(),
 		Type:       messageType,
 	}
+	if messageType == models.MessageTypeText {
+		message.SearchTokens = s.SearchTokens(content)
+	}
+	for _, opt := range opts {
+		opt(&message)
+	}
 
-	collection := s.store.Collection("messages")
-	if _, err := collection.InsertOne(ctx, message); err != nil {
+	if err := s.InsertMessage(ctx, &message); err != nil {
 		return models.Message{}, err
 	}
 
 	return message, nil
 }
 
-func (s *ChatService) SaveMessageWithID(ctx context.Context, messageIDHex, senderID, senderName, roomID, content, messageType, fileURL string, duration int, fileSize int64) (models.Message, bool, error) {
-	encryptedContent, err := utils.Encrypt(content, s.encryptionKey)
+// SaveMessageWithID 以客戶端提供的 ID 保存消息，重送時返回已保存的消息且 inserted 為 false
+// 只有同一聊天室、同一發送者的消息才視為重送；ID 無效或已被其他消息使用時改用新的 ID
+func (s *ChatService) SaveMessageWithID(ctx context.Context, messageIDHex, senderID, senderName, roomID, content, messageType, fileURL string, duration int, fileSize int64, opts ...MessageOption) (models.Message, bool, error) {
+	messageID, err := primitive.ObjectIDFromHex(messageIDHex)
 	if err != nil {
-		return models.Message{}, false, err
+		messageID = primitive.NewObjectID()
 	}
 
-	messageID, err := primitive.ObjectIDFromHex(messageIDHex)
+	// 客戶端重送時直接返回已保存的消息，避免重複分配序號而造成序號空洞；先查詢再加密，重送不必重新加密
+	existing, found, err := s.findResentMessage(ctx, messageID, senderID, roomID)
 	if err != nil {
+		return models.Message{}, false, err
+	}
+	if found {
+		return existing, false, nil
+	}
+	if existing.ID == messageID {
 		messageID = primitive.NewObjectID()
 	}
 
+	encryptedContent, err := s.encryptMessageContent(ctx, roomID, messageType, content)
+	if err != nil {
+		return models.Message{}, false, err
+	}
+
 	message := models.Message{
 		ID:         messageID,
 		SenderID:   senderID,
@@ -75,23 +205,66 @@ func (s *ChatService) SaveMessageWithID(ctx context.Context, messageIDHex, sende
 		Timestamp:  time.Now(),
 		Type:       messageType,
 	}
+	if messageType == models.MessageTypeText {
+		message.SearchTokens = s.SearchTokens(content)
+	}
+	for _, opt := range opts {
+		opt(&message)
+	}
 
-	collection := s.store.Collection("messages")
-	if _, err := collection.InsertOne(ctx, message); err != nil {
-		if mongo.IsDuplicateKeyError(err) {
-			return message, false, nil
+	if err := s.InsertMessage(ctx, &message); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return models.Message{}, false, err
+		}
+		// 同一 ID 同時被寫入：是本人的重送則返回已保存的消息，否則改用新的 ID 保存
+		existing, found, err := s.findResentMessage(ctx, messageID, senderID, roomID)
+		if err != nil {
+			return models.Message{}, false, err
+		}
+		if found {
+			return existing, false, nil
+		}
+		message.ID = primitive.NewObjectID()
+		if err := s.InsertMessage(ctx, &message); err != nil {
+			return models.Message{}, false, err
 		}
-		return models.Message{}, false, err
 	}
 
 	return message, true, nil
 }
 
+// findResentMessage 查找同一發送者在同一聊天室以該 ID 保存過的消息
+// ID 已被其他聊天室或其他發送者的消息使用時 found 為 false，返回的消息只帶有 ID
+func (s *ChatService) findResentMessage(ctx context.Context, messageID primitive.ObjectID, senderID, roomID string) (models.Message, bool, error) {
+	var existing models.Message
+	err := s.store.Collection("messages").FindOne(ctx, bson.M{"_id": messageID}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return models.Message{}, false, nil
+	}
+	if err != nil {
+		return models.Message{}, false, err
+	}
+	if existing.Room != roomID || existing.SenderID != senderID {
+		return models.Message{ID: existing.ID}, false, nil
+	}
+	return existing, true, nil
+}
+
+// UpdateRoomLastMessage 更新聊天室的最後消息；預覽與消息本身一樣加密保存
 func (s *ChatService) UpdateRoomLastMessage(ctx context.Context, roomID primitive.ObjectID, lastMessage string, lastMessageTime time.Time) error {
+	encryptedPreview := ""
+	if lastMessage != "" {
+		var err error
+		encryptedPreview, err = s.EncryptContent(ctx, roomID.Hex(), lastMessage)
+		if err != nil {
+			return err
+		}
+	}
+
 	collection := s.store.Collection("chat_rooms")
 	update := bson.M{
 		"$set": bson.M{
-			"last_message":      lastMessage,
+			"last_message":      encryptedPreview,
 			"last_message_time": lastMessageTime,
 			"updated_at":        time.Now(),
 		},
@@ -121,27 +294,6 @@ func (s *ChatService) IsUserInRoom(ctx context.Context, roomID primitive.ObjectI
 	return false, err
 }
 
-// MarkMessagesAsRead 标记房间内的消息为已读
-func (s *ChatService) MarkMessagesAsRead(ctx context.Context, roomID primitive.ObjectID, userID string) error {
-	collection := s.store.Collection("messages")
-
-	// 更新该房间内所有非自己发送且未读的消息
-	filter := bson.M{
-		"room":      roomID.Hex(),
-		"sender_id": bson.M{"$ne": userID},
-		"read_by":   bson.M{"$ne": userID},
-	}
-
-	update := bson.M{
-		"$addToSet": bson.M{
-			"read_by": userID,
-		},
-	}
-
-	_, err := collection.UpdateMany(ctx, filter, update)
-	return err
-}
-
 // IsUserBlocked 檢查 blockedID 是否被 blockerID 封鎖
 func (s *ChatService) IsUserBlocked(ctx context.Context, blockerID, blockedID string) (bool, error) {
 	collection := s.store.Collection("blocked_users")
@@ -164,6 +316,40 @@ func (s *ChatService) IsUserBlockedByAny(ctx context.Context, blockerIDs []strin
 	return count > 0, err
 }
 
+// CheckSendPermission 檢查用戶是否可以在聊天室發送消息：必須是成員，且未被任何其他參與者封鎖
+func (s *ChatService) CheckSendPermission(ctx context.Context, roomID primitive.ObjectID, userID string) error {
+	isMember, err := s.IsUserInRoom(ctx, roomID, userID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return ErrNotRoomMember
+	}
+
+	participants, err := s.GetRoomParticipants(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	blockerIDs := make([]string, 0, len(participants))
+	for _, participantID := range participants {
+		if participantID != userID {
+			blockerIDs = append(blockerIDs, participantID)
+		}
+	}
+
+	isBlocked, err := s.IsUserBlockedByAny(ctx, blockerIDs, userID)
+	if err != nil {
+		// 封鎖檢查失敗時不阻止發送，與原有行為一致
+		log.Printf("Error checking block status: %v", err)
+		return nil
+	}
+	if isBlocked {
+		return ErrSenderBlocked
+	}
+	return nil
+}
+
 // GetRoomParticipants 獲取聊天室的所有參與者 ID
 func (s *ChatService) GetRoomParticipants(ctx context.Context, roomID primitive.ObjectID) ([]string, error) {
 	collection := s.store.Collection("chat_rooms")
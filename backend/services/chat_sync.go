@@ -0,0 +1,228 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SyncCursor 客戶端在某個聊天室最後看到的消息位置，LastSeq 優先於 LastID
+type SyncCursor struct {
+	LastSeq int64
+	LastID  string
+}
+
+// RoomSyncResult 單個聊天室在斷線期間的變更
+type RoomSyncResult struct {
+	RoomID         string
+	Messages       []map[string]interface{}
+	Deletions      []map[string]interface{}
+	ReadReceipts   []map[string]interface{}
+	HasMore        bool // 遺漏的消息超過上限，客戶端需改用 REST 分頁補齊
+	CursorNotFound bool // 游標消息已不存在，Messages 只包含最新的消息，客戶端應重新載入該聊天室
+}
+
+// GetUserRoomIDs 獲取用戶參與的所有聊天室 ID
+func (s *ChatService) GetUserRoomIDs(ctx context.Context, userID string) ([]string, error) {
+	collection := s.store.Collection("chat_rooms")
+	filter := bson.M{
+		"$or": []bson.M{
+			{"participants": userID},
+			{"created_by": userID},
+		},
+	}
+
+	cursor, err := collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rooms []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &rooms); err != nil {
+		return nil, err
+	}
+
+	roomIDs := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		roomIDs = append(roomIDs, room.ID.Hex())
+	}
+	return roomIDs, nil
+}
+
+// CollectRoomChanges 收集聊天室在游標之後遺漏的消息、刪除與已讀變更
+// since 為客戶端上次同步的時間；若為空則以游標消息的時間作為刪除與已讀變更的起點
+// 沒有游標也沒有 since 時只返回最新的 limit 條消息
+func (s *ChatService) CollectRoomChanges(ctx context.Context, roomID string, cursor *SyncCursor, since *time.Time, limit int) (RoomSyncResult, error) {
+	result := RoomSyncResult{
+		RoomID:       roomID,
+		Messages:     []map[string]interface{}{},
+		Deletions:    []map[string]interface{}{},
+		ReadReceipts: []map[string]interface{}{},
+	}
+	collection := s.store.Collection("messages")
+
+	// 🔥 根據游標決定遺漏消息的查詢條件
+	filter := bson.M{
+		"room":       roomID,
+		"is_deleted": bson.M{"$ne": true},
+	}
+	changesSince := since
+	hasLowerBound := false
+	if cursor != nil && cursor.LastSeq > 0 {
+		filter["seq"] = bson.M{"$gt": cursor.LastSeq}
+		hasLowerBound = true
+		if changesSince == nil {
+			// 游標消息可能已被刪除或過期清理，取游標之前最近的一條消息的時間作為變更起點
+			var lastMessage models.Message
+			err := collection.FindOne(ctx,
+				bson.M{"room": roomID, "seq": bson.M{"$lte": cursor.LastSeq}},
+				options.FindOne().SetSort(bson.M{"seq": -1}).SetProjection(bson.M{"timestamp": 1})).Decode(&lastMessage)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return result, err
+			}
+			if err == nil {
+				changesSince = &lastMessage.Timestamp
+			}
+		}
+	} else if cursor != nil && cursor.LastID != "" {
+		lastObjectID, err := primitive.ObjectIDFromHex(cursor.LastID)
+		if err != nil {
+			return result, err
+		}
+		var lastMessage models.Message
+		err = collection.FindOne(ctx, bson.M{"_id": lastObjectID, "room": roomID}).Decode(&lastMessage)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return result, err
+		}
+		if err == nil {
+			filter["$or"] = []bson.M{
+				{"timestamp": bson.M{"$gt": lastMessage.Timestamp}},
+				{"timestamp": lastMessage.Timestamp, "_id": bson.M{"$gt": lastObjectID}},
+			}
+			hasLowerBound = true
+			if changesSince == nil {
+				changesSince = &lastMessage.Timestamp
+			}
+		} else if since != nil {
+			filter["timestamp"] = bson.M{"$gt": *since}
+			hasLowerBound = true
+		} else {
+			// 游標消息已不存在（例如已過期清理），無法判斷遺漏了哪些消息
+			result.CursorNotFound = true
+		}
+	} else if since != nil {
+		filter["timestamp"] = bson.M{"$gt": *since}
+		hasLowerBound = true
+	}
+
+	// 沒有起點時只返回最新的 limit 條消息，避免從聊天室最舊的消息開始重放
+	sortOrder := 1
+	if !hasLowerBound {
+		sortOrder = -1
+	}
+	sort := bson.D{{Key: "timestamp", Value: sortOrder}, {Key: "_id", Value: sortOrder}}
+	if _, bySeq := filter["seq"]; bySeq {
+		// 時間戳在分配序號之前寫入，同時發送的消息兩者順序可能不同；
+		// 以序號游標同步時必須按序號截斷，否則客戶端推進 last_seq 後會永久跳過較小的序號
+		sort = bson.D{{Key: "seq", Value: 1}}
+	}
+	findOptions := options.Find().
+		SetSort(sort).
+		SetLimit(int64(limit + 1))
+	msgCursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return result, err
+	}
+	var messages []models.Message
+	if err := msgCursor.All(ctx, &messages); err != nil {
+		return result, err
+	}
+	if len(messages) > limit {
+		result.HasMore = true
+		messages = messages[:limit]
+	}
+	if !hasLowerBound {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	result.Messages = s.FormatMessages(ctx, messages)
+	if err := s.AttachReplyContext(ctx, roomID, result.Messages); err != nil {
+		return result, err
+	}
+
+	// 沒有任何時間起點時無法判斷哪些刪除或已讀是新的，只返回遺漏的消息
+	if changesSince == nil {
+		return result, nil
+	}
+
+	// 🔥 斷線期間被刪除的消息
+	deletedOptions := options.Find().
+		SetSort(bson.M{"deleted_at": 1}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"_id": 1, "seq": 1, "deleted_at": 1, "deleted_by": 1})
+	deletedCursor, err := collection.Find(ctx, bson.M{
+		"room":       roomID,
+		"is_deleted": true,
+		"deleted_at": bson.M{"$gt": *changesSince},
+	}, deletedOptions)
+	if err != nil {
+		return result, err
+	}
+	var deleted []models.Message
+	if err := deletedCursor.All(ctx, &deleted); err != nil {
+		return result, err
+	}
+	for _, msg := range deleted {
+		result.Deletions = append(result.Deletions, map[string]interface{}{
+			"id":         msg.ID.Hex(),
+			"room":       roomID,
+			"seq":        msg.Seq,
+			"deleted_at": msg.DeletedAt,
+			"deleted_by": msg.DeletedBy,
+		})
+	}
+
+	// 🔥 斷線期間過期清理而永久刪除的消息
+	tombstoneCursor, err := s.store.Collection("message_tombstones").Find(ctx, bson.M{
+		"room":       roomID,
+		"removed_at": bson.M{"$gt": *changesSince},
+	}, options.Find().SetSort(bson.M{"removed_at": 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return result, err
+	}
+	var tombstones []models.MessageTombstone
+	if err := tombstoneCursor.All(ctx, &tombstones); err != nil {
+		return result, err
+	}
+	for _, tombstone := range tombstones {
+		result.Deletions = append(result.Deletions, map[string]interface{}{
+			"id":         tombstone.ID.Hex(),
+			"room":       roomID,
+			"seq":        tombstone.Seq,
+			"deleted_at": tombstone.RemovedAt,
+			"reason":     tombstone.Reason,
+		})
+	}
+
+	// 🔥 斷線期間有變化的已讀位置，客戶端據此更新各條消息的已讀狀態
+	readCursors, err := s.GetRoomReadCursors(ctx, roomID, changesSince)
+	if err != nil {
+		return result, err
+	}
+	for _, readCursor := range readCursors {
+		result.ReadReceipts = append(result.ReadReceipts, ReadCursorPayload(readCursor))
+	}
+
+	return result, nil
+}
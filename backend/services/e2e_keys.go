@@ -0,0 +1,324 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxPreKeysPerUpload = 100  // 每次最多上傳的一次性預共享密鑰數
+	maxStoredPreKeys    = 500  // 每台設備最多保存的一次性預共享密鑰數
+	maxE2EKeyLength     = 1024 // 公鑰與簽名（base64）的最大長度
+	lowPreKeyThreshold  = 10   // 剩餘一次性密鑰少於此數時通知設備補充
+)
+
+var (
+	ErrDeviceNotFound = errors.New("設備不存在或已登出")
+	ErrInvalidE2EKeys = errors.New("密鑰格式不正確")
+	ErrTooManyPreKeys = errors.New("一次性預共享密鑰數量超過上限")
+	ErrE2EDirectOnly  = errors.New("端到端加密消息只能在私聊中發送")
+	ErrNoDirectRoom   = errors.New("只能取得私聊對象的密鑰包")
+)
+
+// PublishDeviceKeys 發佈或更新設備的身份密鑰與簽名預共享密鑰，並追加一次性預共享密鑰，返回剩餘的一次性密鑰數
+// 身份密鑰改變表示設備重新產生了密鑰，之前的一次性密鑰已沒有對應的私鑰，一併刪除
+func (s *ChatService) PublishDeviceKeys(ctx context.Context, userID, deviceID, identityKey string, signedPreKey models.SignedPreKey, oneTimePreKeys []models.OneTimePreKey) (int64, error) {
+	deviceObjectID, err := s.activeDeviceSession(ctx, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	if !validE2EKey(identityKey) || !validE2EKey(signedPreKey.PublicKey) || !validE2EKey(signedPreKey.Signature) {
+		return 0, ErrInvalidE2EKeys
+	}
+
+	now := time.Now()
+	var previous models.E2EDeviceKeys
+	err = s.store.Collection("e2e_devices").FindOneAndUpdate(ctx,
+		bson.M{"_id": deviceObjectID},
+		bson.M{
+			"$set": bson.M{
+				"user_id":        userID,
+				"identity_key":   identityKey,
+				"signed_pre_key": signedPreKey,
+				"updated_at":     now,
+			},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before),
+	).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return 0, err
+	}
+	if err == nil && previous.IdentityKey != identityKey {
+		if _, err := s.store.Collection("e2e_one_time_prekeys").DeleteMany(ctx, bson.M{"device_id": deviceObjectID}); err != nil {
+			return 0, err
+		}
+	}
+
+	return s.addOneTimePreKeys(ctx, userID, deviceObjectID, oneTimePreKeys)
+}
+
+// UploadOneTimePreKeys 為已發佈密鑰的設備補充一次性預共享密鑰，返回剩餘數量
+func (s *ChatService) UploadOneTimePreKeys(ctx context.Context, userID, deviceID string, oneTimePreKeys []models.OneTimePreKey) (int64, error) {
+	deviceObjectID, err := s.activeDeviceSession(ctx, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	count, err := s.store.Collection("e2e_devices").CountDocuments(ctx, bson.M{"_id": deviceObjectID})
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, ErrDeviceNotFound
+	}
+	return s.addOneTimePreKeys(ctx, userID, deviceObjectID, oneTimePreKeys)
+}
+
+// addOneTimePreKeys 保存一次性密鑰；同一設備重複上傳的 key_id 保持原樣，已被取走的密鑰不會復活
+func (s *ChatService) addOneTimePreKeys(ctx context.Context, userID string, deviceID primitive.ObjectID, keys []models.OneTimePreKey) (int64, error) {
+	collection := s.store.Collection("e2e_one_time_prekeys")
+	if len(keys) > maxPreKeysPerUpload {
+		return 0, ErrTooManyPreKeys
+	}
+	for _, key := range keys {
+		if !validE2EKey(key.PublicKey) {
+			return 0, ErrInvalidE2EKeys
+		}
+	}
+	if len(keys) == 0 {
+		return collection.CountDocuments(ctx, bson.M{"device_id": deviceID})
+	}
+
+	existing, err := collection.CountDocuments(ctx, bson.M{"device_id": deviceID})
+	if err != nil {
+		return 0, err
+	}
+	if existing+int64(len(keys)) > maxStoredPreKeys {
+		return 0, ErrTooManyPreKeys
+	}
+
+	now := time.Now()
+	writes := make([]mongo.WriteModel, 0, len(keys))
+	for _, key := range keys {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"device_id": deviceID, "key_id": key.KeyID}).
+			SetUpdate(bson.M{"$setOnInsert": bson.M{
+				"user_id":    userID,
+				"public_key": key.PublicKey,
+				"created_at": now,
+			}}).
+			SetUpsert(true))
+	}
+	// 同時上傳同一個預密鑰時唯一索引會拒絕其中一次插入，記錄已經存在，可以忽略
+	if _, err := collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return 0, err
+	}
+	return collection.CountDocuments(ctx, bson.M{"device_id": deviceID})
+}
+
+// CountOneTimePreKeys 返回設備剩餘的一次性預共享密鑰數，客戶端據此決定是否補充
+func (s *ChatService) CountOneTimePreKeys(ctx context.Context, userID, deviceID string) (int64, error) {
+	deviceObjectID, err := s.activeDeviceSession(ctx, userID, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	return s.store.Collection("e2e_one_time_prekeys").CountDocuments(ctx, bson.M{"device_id": deviceObjectID})
+}
+
+// ClaimPreKeyBundles 取得目標用戶每台在線設備的密鑰包，每個包最多附帶一把一次性密鑰
+// 一次性密鑰以 FindOneAndDelete 取出，並發請求不會拿到同一把；用完時只返回簽名預共享密鑰
+// 端到端加密只用於私聊，因此只有與目標用戶有私聊的用戶（或目標用戶自己的其他設備）可以取得，避免任意用戶耗盡一次性密鑰
+func (s *ChatService) ClaimPreKeyBundles(ctx context.Context, requesterID, targetUserID string) ([]map[string]interface{}, error) {
+	if requesterID != targetUserID {
+		blocked, err := s.IsUserBlocked(ctx, targetUserID, requesterID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, ErrSenderBlocked
+		}
+
+		count, err := s.store.Collection("chat_rooms").CountDocuments(ctx, bson.M{
+			"is_group":     bson.M{"$ne": true},
+			"participants": bson.M{"$all": []string{requesterID, targetUserID}},
+		}, options.Count().SetLimit(1))
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, ErrNoDirectRoom
+		}
+	}
+
+	cursor, err := s.store.Collection("e2e_devices").Find(ctx, bson.M{"user_id": targetUserID})
+	if err != nil {
+		return nil, err
+	}
+	var devices []models.E2EDeviceKeys
+	if err := cursor.All(ctx, &devices); err != nil {
+		return nil, err
+	}
+
+	active, err := s.activeDeviceIDs(ctx, devices)
+	if err != nil {
+		return nil, err
+	}
+
+	prekeys := s.store.Collection("e2e_one_time_prekeys")
+	bundles := make([]map[string]interface{}, 0, len(devices))
+	for _, device := range devices {
+		if !active[device.ID] {
+			continue
+		}
+		bundle := map[string]interface{}{
+			"user_id":        device.UserID,
+			"device_id":      device.ID.Hex(),
+			"identity_key":   device.IdentityKey,
+			"signed_pre_key": device.SignedPreKey,
+		}
+
+		var prekey models.OneTimePreKey
+		err := prekeys.FindOneAndDelete(ctx, bson.M{"device_id": device.ID},
+			options.FindOneAndDelete().SetSort(bson.D{{Key: "key_id", Value: 1}})).Decode(&prekey)
+		switch {
+		case err == nil:
+			bundle["one_time_pre_key"] = prekey
+			s.notifyLowPreKeys(ctx, device)
+		case err != mongo.ErrNoDocuments:
+			return nil, err
+		}
+		bundles = append(bundles, bundle)
+	}
+	return bundles, nil
+}
+
+// notifyLowPreKeys 一次性密鑰快用完時通知設備所屬用戶補充
+func (s *ChatService) notifyLowPreKeys(ctx context.Context, device models.E2EDeviceKeys) {
+	remaining, err := s.store.Collection("e2e_one_time_prekeys").CountDocuments(ctx, bson.M{"device_id": device.ID})
+	if err != nil || remaining >= lowPreKeyThreshold {
+		return
+	}
+	s.EmitToUser(device.UserID, "prekeys_low", map[string]interface{}{
+		"device_id": device.ID.Hex(),
+		"remaining": remaining,
+	})
+}
+
+// DeleteDeviceKeys 刪除設備發佈的所有密鑰，用於登出或終止會話
+func (s *ChatService) DeleteDeviceKeys(ctx context.Context, deviceID primitive.ObjectID) error {
+	if _, err := s.store.Collection("e2e_one_time_prekeys").DeleteMany(ctx, bson.M{"device_id": deviceID}); err != nil {
+		return err
+	}
+	_, err := s.store.Collection("e2e_devices").DeleteOne(ctx, bson.M{"_id": deviceID})
+	return err
+}
+
+// DeleteUserE2EKeys 刪除用戶所有設備的密鑰，用於刪除帳號
+func (s *ChatService) DeleteUserE2EKeys(ctx context.Context, userID string) error {
+	if _, err := s.store.Collection("e2e_one_time_prekeys").DeleteMany(ctx, bson.M{"user_id": userID}); err != nil {
+		return err
+	}
+	_, err := s.store.Collection("e2e_devices").DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
+
+// CheckE2ERoom 端到端加密消息只允許在私聊中發送，群組沒有對應的密鑰協商
+func (s *ChatService) CheckE2ERoom(ctx context.Context, roomID primitive.ObjectID) error {
+	var room models.ChatRoom
+	err := s.store.Collection("chat_rooms").FindOne(ctx, bson.M{"_id": roomID},
+		options.FindOne().SetProjection(bson.M{"is_group": 1})).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return ErrRoomNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if room.IsGroup {
+		return ErrE2EDirectOnly
+	}
+	return nil
+}
+
+// activeDeviceSession 確認設備 ID 是該用戶仍然有效的登入會話
+func (s *ChatService) activeDeviceSession(ctx context.Context, userID, deviceID string) (primitive.ObjectID, error) {
+	deviceObjectID, err := primitive.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return primitive.NilObjectID, ErrDeviceNotFound
+	}
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return primitive.NilObjectID, ErrDeviceNotFound
+	}
+	count, err := s.store.Collection("login_sessions").CountDocuments(ctx, bson.M{
+		"_id":       deviceObjectID,
+		"user_id":   userObjectID,
+		"is_active": true,
+	})
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if count == 0 {
+		return primitive.NilObjectID, ErrDeviceNotFound
+	}
+	return deviceObjectID, nil
+}
+
+// activeDeviceIDs 篩選出登入會話仍然有效的設備，已登出設備的密鑰不再發出
+func (s *ChatService) activeDeviceIDs(ctx context.Context, devices []models.E2EDeviceKeys) (map[primitive.ObjectID]bool, error) {
+	active := make(map[primitive.ObjectID]bool, len(devices))
+	if len(devices) == 0 {
+		return active, nil
+	}
+	ids := make([]primitive.ObjectID, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.ID)
+	}
+
+	cursor, err := s.store.Collection("login_sessions").Find(ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "is_active": true},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var sessions []models.LoginSession
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		active[session.ID] = true
+	}
+	return active, nil
+}
+
+func validE2EKey(key string) bool {
+	if key == "" || len(key) > maxE2EKeyLength {
+		return false
+	}
+	_, err := base64.StdEncoding.DecodeString(key)
+	return err == nil
+}
+
+// encryptMessageContent 加密要保存的消息內容；端到端加密消息已由客戶端加密，原樣保存
+func (s *ChatService) encryptMessageContent(ctx context.Context, roomID, messageType, content string) (string, error) {
+	if messageType == models.MessageTypeE2E {
+		return content, nil
+	}
+	return s.EncryptContent(ctx, roomID, content)
+}
+
+// DecryptMessage 解密消息內容；端到端加密消息原樣返回密文，由接收設備解密
+func (s *ChatService) DecryptMessage(ctx context.Context, msg models.Message) (string, error) {
+	if msg.Type == models.MessageTypeE2E {
+		return msg.Content, nil
+	}
+	return s.DecryptContent(ctx, msg.Room, msg.Content)
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// serviceIndexes 各集合上常用查詢所需的索引
+var serviceIndexes = map[string][]mongo.IndexModel{
+	"messages": {
+		// 聊天室內按序號增量同步與範圍查詢
+		{Keys: bson.D{{Key: "room", Value: 1}, {Key: "seq", Value: 1}}, Options: options.Index().SetName("room_seq")},
+		// 清理任務按到期時間取出過期消息；大部分消息沒有到期時間
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetName("expires_at").SetSparse(true)},
+	},
+	"message_tombstones": {
+		{Keys: bson.D{{Key: "room", Value: 1}, {Key: "removed_at", Value: 1}}, Options: options.Index().SetName("room_removed_at")},
+		{Keys: bson.D{{Key: "room", Value: 1}, {Key: "seq", Value: 1}}, Options: options.Index().SetName("room_seq")},
+	},
+	"read_cursors": {
+		{Keys: bson.D{{Key: "room_id", Value: 1}}, Options: options.Index().SetName("room_id")},
+	},
+	"pending_deliveries": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetName("user_id")},
+	},
+	"presence_connections": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "expires_at", Value: 1}}, Options: options.Index().SetName("user_id_expires_at")},
+	},
+	"typing_states": {
+		{Keys: bson.D{{Key: "room_id", Value: 1}}, Options: options.Index().SetName("room_id")},
+	},
+	"e2e_one_time_prekeys": {
+		// 唯一索引保證同時上傳同一個預密鑰時不會產生重複的記錄
+		{Keys: bson.D{{Key: "device_id", Value: 1}, {Key: "key_id", Value: 1}}, Options: options.Index().SetName("device_id_key_id").SetUnique(true)},
+	},
+}
+
+// EnsureIndexes 建立各服務查詢所需的索引；索引已存在時不變，某個集合失敗時仍會繼續建立其他集合的索引
+func (s *ChatService) EnsureIndexes(ctx context.Context) error {
+	var errs []error
+	for collection, indexes := range serviceIndexes {
+		if _, err := s.store.Collection(collection).Indexes().CreateMany(ctx, indexes); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", collection, err))
+		}
+	}
+	return errors.Join(errs...)
+}
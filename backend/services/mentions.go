@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MentionAllToken 提及聊天室內所有成員
+const MentionAllToken = "all"
+
+// mentionPattern 匹配行首或空白後的 @token
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@([^\s@]+)`)
+
+// UserChannel 用戶的私有 Socket 頻道，連線時自動加入
+func UserChannel(userID string) string {
+	return "user:" + userID
+}
+
+// EmitToUser 向用戶的所有連線推送事件
+func (s *ChatService) EmitToUser(userID, event string, data interface{}) {
+	s.BroadcastToRoom(UserChannel(userID), event, data)
+}
+
+// NotifyMentions 向每個被提及的用戶推送 "mentioned" 事件
+func (s *ChatService) NotifyMentions(message models.Message, content string) {
+	for _, mentionedID := range message.Mentions {
+		s.EmitToUser(mentionedID, "mentioned", map[string]interface{}{
+			"message_id":  message.ID.Hex(),
+			"room":        message.Room,
+			"sender_id":   message.SenderID,
+			"sender_name": message.SenderName,
+			"content":     content,
+			"timestamp":   message.Timestamp.Format(time.RFC3339),
+			"mention_all": message.MentionAll,
+		})
+	}
+}
+
+// WithMentions 記錄消息中被提及的用戶
+func WithMentions(userIDs []string, mentionAll bool) MessageOption {
+	return func(message *models.Message) {
+		message.Mentions = userIDs
+		message.MentionAll = mentionAll
+	}
+}
+
+// ParseMentionTokens 從明文內容中解析 @username 與 @all，結尾的標點不算在用戶名內
+func ParseMentionTokens(content string) ([]string, bool) {
+	var usernames []string
+	mentionAll := false
+	seen := map[string]bool{}
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		token := strings.TrimRight(match[1], ",.!?:;，。！？：；、)）")
+		if token == "" {
+			continue
+		}
+		if strings.EqualFold(token, MentionAllToken) {
+			mentionAll = true
+			continue
+		}
+		if !seen[token] {
+			seen[token] = true
+			usernames = append(usernames, token)
+		}
+	}
+	return usernames, mentionAll
+}
+
+// ResolveMentions 將內容中的提及解析為聊天室成員的用戶 ID，不包含發送者自己
+func (s *ChatService) ResolveMentions(ctx context.Context, roomID primitive.ObjectID, senderID, content string) ([]string, bool, error) {
+	usernames, mentionAll := ParseMentionTokens(content)
+	if len(usernames) == 0 && !mentionAll {
+		return nil, false, nil
+	}
+
+	participants, err := s.GetRoomParticipants(ctx, roomID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	mentioned := []string{}
+	if mentionAll {
+		for _, participantID := range participants {
+			if participantID != senderID {
+				mentioned = append(mentioned, participantID)
+			}
+		}
+		return mentioned, true, nil
+	}
+
+	participantIDs := make([]primitive.ObjectID, 0, len(participants))
+	for _, participantID := range participants {
+		if participantID == senderID {
+			continue
+		}
+		if objectID, err := primitive.ObjectIDFromHex(participantID); err == nil {
+			participantIDs = append(participantIDs, objectID)
+		}
+	}
+	if len(participantIDs) == 0 {
+		return nil, false, nil
+	}
+
+	cursor, err := s.store.Collection("users").Find(ctx, bson.M{
+		"_id":      bson.M{"$in": participantIDs},
+		"username": bson.M{"$in": usernames},
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, false, err
+	}
+	for _, user := range users {
+		mentioned = append(mentioned, user.ID.Hex())
+	}
+	return mentioned, false, nil
+}
+
+// GetMentions 獲取提及用戶的消息（由新到舊），只包含用戶仍在其中的聊天室
+// beforeID 為上一頁最舊的一條消息
+func (s *ChatService) GetMentions(ctx context.Context, userID, beforeID string, limit int) ([]map[string]interface{}, bool, error) {
+	roomIDs, err := s.GetUserRoomIDs(ctx, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(roomIDs) == 0 {
+		return []map[string]interface{}{}, false, nil
+	}
+
+	collection := s.store.Collection("messages")
+	filter := bson.M{
+		"mentions":   userID,
+		"room":       bson.M{"$in": roomIDs},
+		"is_deleted": bson.M{"$ne": true},
+	}
+	if beforeID != "" {
+		beforeObjectID, err := primitive.ObjectIDFromHex(beforeID)
+		if err != nil {
+			return nil, false, ErrMessageNotFound
+		}
+		var before models.Message
+		err = collection.FindOne(ctx, bson.M{"_id": beforeObjectID}).Decode(&before)
+		if err == mongo.ErrNoDocuments {
+			return nil, false, ErrMessageNotFound
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		filter["$or"] = []bson.M{
+			{"timestamp": bson.M{"$lt": before.Timestamp}},
+			{"timestamp": before.Timestamp, "_id": bson.M{"$lt": beforeObjectID}},
+		}
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return s.FormatMessages(ctx, messages), hasMore, nil
+}
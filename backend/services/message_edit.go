@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrMessageNotFound    = errors.New("消息不存在")
+	ErrNotMessageSender   = errors.New("只有發送者可以編輯消息")
+	ErrMessageNotEditable = errors.New("此類型的消息不可編輯")
+	ErrEditWindowExpired  = errors.New("已超過可編輯的時間")
+	ErrEditConflict       = errors.New("消息已被同時修改，請重試")
+)
+
+// EditMessage 編輯文字消息：重新加密新內容，並把舊的加密內容追加到編輯歷史
+// window 為發送後允許編輯的時間，0 表示不限制
+func (s *ChatService) EditMessage(ctx context.Context, roomID, messageID, editorID, newContent string, window time.Duration) (models.Message, error) {
+	messageObjectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return models.Message{}, ErrMessageNotFound
+	}
+
+	collection := s.store.Collection("messages")
+	var message models.Message
+	err = collection.FindOne(ctx, bson.M{
+		"_id":        messageObjectID,
+		"room":       roomID,
+		"is_deleted": bson.M{"$ne": true},
+	}).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return models.Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	if message.SenderID != editorID {
+		return models.Message{}, ErrNotMessageSender
+	}
+	if message.Type != "" && message.Type != models.MessageTypeText {
+		return models.Message{}, ErrMessageNotEditable
+	}
+	if window > 0 && time.Since(message.Timestamp) > window {
+		return models.Message{}, ErrEditWindowExpired
+	}
+
+	encryptedContent, err := s.EncryptContent(ctx, roomID, newContent)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	// 以舊內容作為條件，避免兩次並發編輯互相覆蓋而遺失歷史版本
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"content":       encryptedContent,
+			"edited_at":     now,
+			"search_tokens": s.SearchTokens(newContent),
+		},
+		"$push": bson.M{
+			"edit_history": models.MessageEdit{
+				Content:  message.Content,
+				EditedAt: now,
+			},
+		},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.Message
+	err = collection.FindOneAndUpdate(ctx, bson.M{
+		"_id":        messageObjectID,
+		"content":    message.Content,
+		"is_deleted": bson.M{"$ne": true},
+	}, update, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return models.Message{}, ErrEditConflict
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	// 被編輯的可能是聊天室的最後一條消息，重新計算預覽
+	if roomObjectID, err := primitive.ObjectIDFromHex(roomID); err == nil {
+		if err := s.RefreshRoomLastMessage(ctx, roomObjectID); err != nil {
+			log.Printf("Failed to refresh last message of room %s: %v", roomID, err)
+		}
+	}
+
+	return updated, nil
+}
+
+// MessageEditedPayload 構建 "message_edited" 廣播事件的內容
+func MessageEditedPayload(message models.Message, content string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         message.ID.Hex(),
+		"room":       message.Room,
+		"sender_id":  message.SenderID,
+		"content":    content,
+		"seq":        message.Seq,
+		"edited_at":  message.EditedAt.Format(time.RFC3339),
+		"edit_count": len(message.EditHistory),
+	}
+}
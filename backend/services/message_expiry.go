@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+	"chatwme/backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	MinMessageTTL = 5 * time.Second      // 最短的消息保留時間
+	MaxMessageTTL = 365 * 24 * time.Hour // 最長的消息保留時間
+
+	expirySweepBatchSize = 200 // 每次最多清理的過期消息數
+)
+
+var (
+	ErrRoomSettingsNotAllowed = errors.New("沒有修改聊天室設定的權限")
+	ErrInvalidMessageTTL      = errors.New("無效的消息保留時間")
+)
+
+// SetMessageTTL 設置聊天室新消息的自動刪除時間，ttl 為 0 時關閉
+// 只影響之後發送的消息；設定變更後在聊天室中發送一條系統消息
+func (s *ChatService) SetMessageTTL(ctx context.Context, roomID, userID, username string, ttl time.Duration) (models.Message, bool, error) {
+	if ttl != 0 && (ttl < MinMessageTTL || ttl > MaxMessageTTL) {
+		return models.Message{}, false, ErrInvalidMessageTTL
+	}
+
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return models.Message{}, false, ErrRoomNotFound
+	}
+	var room models.ChatRoom
+	err = s.store.Collection("chat_rooms").FindOne(ctx, bson.M{"_id": roomObjectID}).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return models.Message{}, false, ErrRoomNotFound
+	}
+	if err != nil {
+		return models.Message{}, false, err
+	}
+	if !CanManageRoom(room, userID) {
+		return models.Message{}, false, ErrRoomSettingsNotAllowed
+	}
+
+	seconds := int64(ttl / time.Second)
+	if room.MessageTTL == seconds {
+		return models.Message{}, false, nil
+	}
+
+	update := bson.M{"$set": bson.M{"message_ttl": seconds, "updated_at": time.Now()}}
+	if seconds == 0 {
+		update = bson.M{"$set": bson.M{"updated_at": time.Now()}, "$unset": bson.M{"message_ttl": ""}}
+	}
+	if _, err := s.store.Collection("chat_rooms").UpdateOne(ctx, bson.M{"_id": roomObjectID}, update); err != nil {
+		return models.Message{}, false, err
+	}
+
+	var notice string
+	if seconds > 0 {
+		notice = fmt.Sprintf("%s 開啟了消息自動刪除：新消息將在 %s 後刪除", username, FormatMessageTTL(ttl))
+	} else {
+		notice = fmt.Sprintf("%s 關閉了消息自動刪除", username)
+	}
+	systemMessage, err := s.SaveMessage(ctx, userID, username, roomID, notice, models.MessageTypeSystem, "", 0, 0)
+	if err != nil {
+		return models.Message{}, true, err
+	}
+
+	s.BroadcastToRoom(roomID, "message_ttl_updated", map[string]interface{}{
+		"room":        roomID,
+		"message_ttl": seconds,
+		"updated_by":  userID,
+	})
+	s.BroadcastToRoom(roomID, "chat_message", BuildMessagePayload(systemMessage, username, notice))
+	if err := s.UpdateRoomPreview(ctx, roomObjectID, systemMessage, notice); err != nil {
+		log.Printf("Failed to update room last message: %v", err)
+	}
+	return systemMessage, true, nil
+}
+
+// FormatMessageTTL 將保留時間轉換為易讀的文字，例如「1 天」「30 分鐘」
+func FormatMessageTTL(ttl time.Duration) string {
+	switch {
+	case ttl >= 7*24*time.Hour && ttl%(7*24*time.Hour) == 0:
+		return fmt.Sprintf("%d 週", ttl/(7*24*time.Hour))
+	case ttl >= 24*time.Hour && ttl%(24*time.Hour) == 0:
+		return fmt.Sprintf("%d 天", ttl/(24*time.Hour))
+	case ttl >= time.Hour && ttl%time.Hour == 0:
+		return fmt.Sprintf("%d 小時", ttl/time.Hour)
+	case ttl >= time.Minute && ttl%time.Minute == 0:
+		return fmt.Sprintf("%d 分鐘", ttl/time.Minute)
+	default:
+		return fmt.Sprintf("%d 秒", ttl/time.Second)
+	}
+}
+
+// SweepExpiredMessages 永久刪除已到期的消息及其上傳的文件，並通知聊天室中的客戶端
+// 以 DeleteOne 的結果判斷由哪個實例負責後續清理，多個實例同時運行也不會重複處理
+func (s *ChatService) SweepExpiredMessages(ctx context.Context, storage StorageService) (int, error) {
+	collection := s.store.Collection("messages")
+	cursor, err := collection.Find(ctx,
+		bson.M{"expires_at": bson.M{"$lte": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "expires_at", Value: 1}}).SetLimit(expirySweepBatchSize))
+	if err != nil {
+		return 0, err
+	}
+	var expired []models.Message
+	if err := cursor.All(ctx, &expired); err != nil {
+		return 0, err
+	}
+
+	removedByRoom := map[string][]models.Message{}
+	for _, msg := range expired {
+		// 先寫入墓碑再刪除，離線的客戶端同步時才能得知這條消息已被刪除
+		if err := s.recordTombstone(ctx, msg.ID, msg.Room, msg.Seq, models.TombstoneReasonExpired); err != nil {
+			log.Printf("Failed to record tombstone of expired message %s: %v", msg.ID.Hex(), err)
+			continue
+		}
+		result, err := collection.DeleteOne(ctx, bson.M{"_id": msg.ID})
+		if err != nil {
+			log.Printf("Failed to delete expired message %s: %v", msg.ID.Hex(), err)
+			continue
+		}
+		if result.DeletedCount == 0 {
+			continue // 已被其他實例刪除
+		}
+		removedByRoom[msg.Room] = append(removedByRoom[msg.Room], msg)
+		s.deleteMessageFile(ctx, storage, msg)
+	}
+
+	removed := 0
+	for roomID, messages := range removedByRoom {
+		removed += len(messages)
+		messageIDs := make([]string, 0, len(messages))
+		for _, msg := range messages {
+			messageIDs = append(messageIDs, msg.ID.Hex())
+		}
+		s.afterMessagesRemoved(ctx, roomID, messages)
+		s.BroadcastToRoom(roomID, "messages_expired", map[string]interface{}{
+			"room":        roomID,
+			"message_ids": messageIDs,
+		})
+	}
+	return removed, nil
+}
+
+// deleteMessageFile 刪除消息上傳的語音、圖片或視頻文件；轉發產生的副本共用同一個文件，仍有引用時保留
+func (s *ChatService) deleteMessageFile(ctx context.Context, storage StorageService, msg models.Message) {
+	if msg.FileURL == "" || storage == nil {
+		return
+	}
+	filePath := utils.ExtractFilePathFromURL(msg.FileURL)
+	if filePath == "" {
+		filePath = roomMediaFilePath(msg.FileURL)
+	}
+	if filePath == "" {
+		return
+	}
+
+	count, err := s.store.Collection("messages").CountDocuments(ctx, bson.M{"file_url": msg.FileURL})
+	if err != nil {
+		log.Printf("Failed to check file references for %s: %v", filePath, err)
+		return
+	}
+	if count > 0 {
+		return
+	}
+	if err := storage.DeleteFile(filePath); err != nil {
+		log.Printf("Failed to delete file of expired message %s: %v", msg.ID.Hex(), err)
+	}
+}
+
+// afterMessagesRemoved 移除被刪除消息的置頂記錄，扣減未讀計數，並重新計算聊天室預覽，避免已刪除的內容仍顯示在列表中
+func (s *ChatService) afterMessagesRemoved(ctx context.Context, roomID string, messages []models.Message) {
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return
+	}
+	messageIDs := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		messageIDs = append(messageIDs, msg.ID.Hex())
+	}
+
+	_, err = s.store.Collection("chat_rooms").UpdateOne(ctx,
+		bson.M{"_id": roomObjectID},
+		bson.M{"$pull": bson.M{"pinned_messages": bson.M{"message_id": bson.M{"$in": messageIDs}}}})
+	if err != nil {
+		log.Printf("Failed to unpin removed messages in room %s: %v", roomID, err)
+	}
+	s.adjustUnreadCounts(ctx, roomID, messages, -1)
+
+	if err := s.RefreshRoomLastMessage(ctx, roomObjectID); err != nil {
+		log.Printf("Failed to refresh last message of room %s: %v", roomID, err)
+	}
+}
+
+// MessageDeleted 用戶刪除消息後與過期清理一樣移除置頂、扣減成員的未讀計數，並重新計算聊天室預覽
+// message 為刪除前讀取的消息
+func (s *ChatService) MessageDeleted(ctx context.Context, message models.Message) {
+	s.afterMessagesRemoved(ctx, message.Room, []models.Message{message})
+}
+
+// MessageRestored 用戶恢復消息後加回成員的未讀計數，並重新計算聊天室預覽
+// message 為恢復前讀取的消息
+func (s *ChatService) MessageRestored(ctx context.Context, message models.Message) {
+	s.adjustUnreadCounts(ctx, message.Room, []models.Message{message}, 1)
+	s.refreshRoomLastMessage(ctx, message.Room)
+}
+
+func (s *ChatService) refreshRoomLastMessage(ctx context.Context, roomID string) {
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return
+	}
+	if err := s.RefreshRoomLastMessage(ctx, roomObjectID); err != nil {
+		log.Printf("Failed to refresh last message of room %s: %v", roomID, err)
+	}
+}
+
+// RunMessageExpirySweeper 定期清理到期的消息，直到 ctx 被取消
+func (s *ChatService) RunMessageExpirySweeper(ctx context.Context, interval time.Duration, storage StorageService) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Message expiry sweeper started (interval %s)", interval)
+	for {
+		// 一次清理不完時連續處理，直到本輪沒有剩餘的過期消息
+		for ctx.Err() == nil {
+			sweepCtx, cancel := context.WithTimeout(ctx, time.Minute)
+			removed, err := s.SweepExpiredMessages(sweepCtx, storage)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to sweep expired messages: %v", err)
+				break
+			}
+			if removed > 0 {
+				log.Printf("Removed %d expired messages", removed)
+			}
+			if removed < expirySweepBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Message expiry sweeper stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
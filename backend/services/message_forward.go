@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	MaxForwardMessages = 20 // 單次最多轉發的消息數
+	MaxForwardTargets  = 10 // 單次最多轉發到的聊天室數
+)
+
+var ErrNothingToForward = errors.New("沒有可轉發的消息")
+
+// ForwardResult 轉發到單個聊天室的結果
+type ForwardResult struct {
+	RoomID     string   `json:"room"`
+	OK         bool     `json:"ok"`
+	Error      string   `json:"error,omitempty"`
+	MessageIDs []string `json:"message_ids,omitempty"`
+}
+
+// WithForwardedFrom 將消息標記為轉發的副本
+func WithForwardedFrom(info models.ForwardInfo) MessageOption {
+	return func(message *models.Message) {
+		message.ForwardedFrom = &info
+	}
+}
+
+// ForwardMessages 將來源聊天室的消息複製到其他聊天室
+// 聊天室加密的媒體會以目標聊天室的密鑰重新加密一份，原文件的 URL 對目標成員不可讀；每個目標聊天室都需通過成員與封鎖檢查
+func (s *ChatService) ForwardMessages(ctx context.Context, userID, username, sourceRoomID string, messageIDs, targetRoomIDs []string) ([]ForwardResult, error) {
+	sourceObjectID, err := primitive.ObjectIDFromHex(sourceRoomID)
+	if err != nil {
+		return nil, ErrRoomNotFound
+	}
+	isMember, err := s.IsUserInRoom(ctx, sourceObjectID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotRoomMember
+	}
+
+	sources, err := s.loadForwardSources(ctx, sourceRoomID, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, ErrNothingToForward
+	}
+
+	results := make([]ForwardResult, 0, len(targetRoomIDs))
+	for _, targetRoomID := range targetRoomIDs {
+		results = append(results, s.forwardToRoom(ctx, userID, username, targetRoomID, sources))
+	}
+	return results, nil
+}
+
+// forwardedSource 已解密、待轉發的消息
+type forwardedSource struct {
+	message   models.Message
+	plaintext string
+	origin    models.ForwardInfo
+}
+
+// loadForwardSources 按請求順序載入並解密要轉發的消息，忽略不存在或已刪除的消息
+func (s *ChatService) loadForwardSources(ctx context.Context, roomID string, messageIDs []string) ([]forwardedSource, error) {
+	objectIDs := make([]primitive.ObjectID, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+	if len(objectIDs) == 0 {
+		return nil, nil
+	}
+
+	cursor, err := s.store.Collection("messages").Find(ctx, bson.M{
+		"_id":        bson.M{"$in": objectIDs},
+		"room":       roomID,
+		"is_deleted": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	byID := make(map[primitive.ObjectID]models.Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+
+	sources := make([]forwardedSource, 0, len(messages))
+	for _, objectID := range objectIDs {
+		msg, exists := byID[objectID]
+		if !exists {
+			continue
+		}
+		if msg.Type == models.MessageTypeE2E {
+			// 密文只有原本的接收設備能解密，轉發到其他聊天室沒有意義
+			continue
+		}
+		if msg.Type == models.MessageTypeSystem {
+			// 系統通知只能由伺服器產生，轉發會讓用戶在其他聊天室偽造通知
+			continue
+		}
+		plaintext, err := s.DecryptContent(ctx, msg.Room, msg.Content)
+		if err != nil {
+			log.Printf("Skip forwarding message %s: could not decrypt: %v", msg.ID.Hex(), err)
+			continue
+		}
+
+		origin := models.ForwardInfo{
+			MessageID:  msg.ID.Hex(),
+			RoomID:     msg.Room,
+			SenderID:   msg.SenderID,
+			SenderName: msg.SenderName,
+			SentAt:     msg.Timestamp,
+		}
+		if msg.ForwardedFrom != nil {
+			origin = *msg.ForwardedFrom
+		}
+		sources = append(sources, forwardedSource{message: msg, plaintext: plaintext, origin: origin})
+	}
+	return sources, nil
+}
+
+func (s *ChatService) forwardToRoom(ctx context.Context, userID, username, targetRoomID string, sources []forwardedSource) ForwardResult {
+	result := ForwardResult{RoomID: targetRoomID}
+
+	targetObjectID, err := primitive.ObjectIDFromHex(targetRoomID)
+	if err != nil {
+		result.Error = "invalid_room"
+		return result
+	}
+	if err := s.CheckSendPermission(ctx, targetObjectID, userID); err != nil {
+		switch {
+		case errors.Is(err, ErrNotRoomMember):
+			result.Error = "not_in_room"
+		case errors.Is(err, ErrSenderBlocked):
+			result.Error = "blocked"
+		default:
+			log.Printf("Failed to validate forward target %s for %s: %v", targetRoomID, userID, err)
+			result.Error = "room_access_check_failed"
+		}
+		return result
+	}
+
+	var last *models.Message
+	var lastPlaintext string
+	for _, source := range sources {
+		src := source.message
+		plaintext, fileURL := source.plaintext, src.FileURL
+		// 聊天室加密的媒體需以目標聊天室的密鑰重新加密一份
+		if sourceURL := mediaFileURL(src, plaintext); sourceURL != "" {
+			copiedURL, err := s.copyRoomMedia(ctx, src, sourceURL, targetRoomID)
+			if err != nil {
+				log.Printf("Failed to copy media of message %s to room %s: %v", src.ID.Hex(), targetRoomID, err)
+				result.Error = "media_copy_failed"
+				break
+			}
+			if copiedURL != sourceURL {
+				plaintext, fileURL = replaceFileURL(plaintext, copiedURL), copiedURL
+			}
+		}
+
+		saved, err := s.SaveMessage(ctx, userID, username, targetRoomID, plaintext, src.Type,
+			fileURL, src.Duration, src.FileSize, WithForwardedFrom(source.origin))
+		if err != nil {
+			log.Printf("Failed to forward message %s to room %s: %v", src.ID.Hex(), targetRoomID, err)
+			result.Error = "message_save_failed"
+			break
+		}
+		result.MessageIDs = append(result.MessageIDs, saved.ID.Hex())
+		last = &saved
+		lastPlaintext = plaintext
+
+		s.BroadcastToRoom(targetRoomID, MessageEventName(saved.Type), BuildMessagePayload(saved, username, plaintext))
+	}
+
+	if last != nil {
+		if err := s.UpdateRoomPreview(ctx, targetObjectID, *last, lastPlaintext); err != nil {
+			log.Printf("Failed to update room last message: %v", err)
+		}
+	}
+
+	result.OK = result.Error == ""
+	return result
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BuildMessagePayload 將資料庫中的消息與解密後的內容組裝成客戶端使用的格式
+func BuildMessagePayload(msg models.Message, senderName, decryptedContent string) map[string]interface{} {
+	messageObj := map[string]interface{}{
+		"id":          msg.ID.Hex(),
+		"sender_id":   msg.SenderID,
+		"sender_name": senderName,
+		"room":        msg.Room,
+		"timestamp":   msg.Timestamp.Format(time.RFC3339),
+		"type":        msg.Type,
+		"read_by":     msg.ReadBy, // 🔥 新增：已读状态
+		"seq":         msg.Seq,
+	}
+
+	if msg.ReplyTo != "" {
+		messageObj["reply_to"] = msg.ReplyTo
+		messageObj["thread_root"] = msg.ThreadRoot
+	}
+
+	if len(msg.Mentions) > 0 || msg.MentionAll {
+		messageObj["mentions"] = msg.Mentions
+		messageObj["mention_all"] = msg.MentionAll
+	}
+
+	if msg.ForwardedFrom != nil {
+		messageObj["forwarded_from"] = msg.ForwardedFrom
+	}
+
+	if len(msg.Reactions) > 0 {
+		messageObj["reactions"] = AggregateReactions(msg.Reactions)
+	}
+
+	// 被編輯過的消息帶上 edited_at，客戶端據此顯示「已編輯」
+	if msg.EditedAt != nil {
+		messageObj["edited_at"] = msg.EditedAt.Format(time.RFC3339)
+		messageObj["edit_count"] = len(msg.EditHistory)
+	}
+
+	// 已確認收到的用戶，配合 read_by 區分已發送、已送達與已讀
+	if len(msg.DeliveredTo) > 0 {
+		deliveredTo := make([]string, 0, len(msg.DeliveredTo))
+		for _, receipt := range msg.DeliveredTo {
+			deliveredTo = append(deliveredTo, receipt.UserID)
+		}
+		messageObj["delivered_to"] = deliveredTo
+	}
+
+	if msg.ExpiresAt != nil {
+		messageObj["expires_at"] = msg.ExpiresAt.Format(time.RFC3339)
+	}
+
+	if msg.Type == "voice" {
+		// 语音消息：解析JSON内容并添加相关字段
+		var voiceInfo map[string]interface{}
+		if err := json.Unmarshal([]byte(decryptedContent), &voiceInfo); err == nil {
+			messageObj["content"] = "[语音消息]" // 显示文本
+			messageObj["file_url"] = voiceInfo["file_url"]
+			messageObj["duration"] = voiceInfo["duration"]
+			messageObj["file_size"] = voiceInfo["file_size"]
+		} else {
+			log.Printf("Error parsing voice message content for message %s: %v", msg.ID.Hex(), err)
+			// 🔥 新增：尝试处理旧格式的语音消息
+			if strings.Contains(decryptedContent, "audio/") || strings.Contains(decryptedContent, ".m4a") {
+				// 可能是旧格式，直接作为文件路径使用
+				baseURL := "https://api-chatwmex.phdev.uk/uploads"
+				fileURL := decryptedContent
+				if !strings.HasPrefix(fileURL, "http") {
+					normalizedPath := strings.ReplaceAll(decryptedContent, "\\", "/")
+					fileURL = fmt.Sprintf("%s/%s", strings.TrimRight(baseURL, "/"), strings.TrimLeft(normalizedPath, "/"))
+				}
+
+				messageObj["content"] = "[语音消息]"
+				messageObj["file_url"] = fileURL
+				messageObj["duration"] = 0  // 默认值
+				messageObj["file_size"] = 0 // 默认值
+
+				log.Printf("✅ Processed legacy voice message %s: %s", msg.ID.Hex(), fileURL)
+			} else {
+				// 完全无法解析的消息
+				messageObj["content"] = "[语音消息解析失败]"
+				messageObj["file_url"] = nil
+				messageObj["duration"] = 0
+				messageObj["file_size"] = 0
+			}
+		}
+	} else if msg.Type == "image" {
+		// 图片消息
+		var imageInfo map[string]interface{}
+		if err := json.Unmarshal([]byte(decryptedContent), &imageInfo); err == nil {
+			messageObj["content"] = "[图片]"
+			messageObj["file_url"] = imageInfo["file_url"]
+		} else {
+			messageObj["content"] = "[图片解析失败]"
+		}
+	} else if msg.Type == "video" {
+		// 视频消息
+		var videoInfo map[string]interface{}
+		if err := json.Unmarshal([]byte(decryptedContent), &videoInfo); err == nil {
+			messageObj["content"] = "[视频]"
+			messageObj["file_url"] = videoInfo["file_url"]
+			messageObj["duration"] = videoInfo["duration"]
+			messageObj["file_size"] = videoInfo["file_size"]
+		} else {
+			messageObj["content"] = "[视频解析失败]"
+		}
+	} else {
+		// 普通文本消息
+		messageObj["content"] = decryptedContent
+	}
+
+	return messageObj
+}
+
+// FormatMessages 解密一組消息並轉換為客戶端格式
+func (s *ChatService) FormatMessages(ctx context.Context, messages []models.Message) []map[string]interface{} {
+	if err := s.ApplyReadCursors(ctx, messages); err != nil {
+		log.Printf("Failed to load read cursors: %v", err)
+	}
+	formatted := make([]map[string]interface{}, 0, len(messages))
+	senderNames := map[string]string{}
+	for _, msg := range messages {
+		decryptedContent, err := s.DecryptMessage(ctx, msg)
+		if err != nil {
+			log.Printf("Could not decrypt message ID %s: %v", msg.ID.Hex(), err)
+			decryptedContent = "[讯息无法解密]"
+		}
+		senderName := s.resolveSenderName(ctx, msg, senderNames)
+		formatted = append(formatted, BuildMessagePayload(msg, senderName, decryptedContent))
+	}
+	return formatted
+}
+
+// resolveSenderName 舊消息可能沒有保存發送者名稱，此時從用戶表查詢並緩存
+func (s *ChatService) resolveSenderName(ctx context.Context, msg models.Message, cache map[string]string) string {
+	if msg.SenderName != "" {
+		return msg.SenderName
+	}
+	if name, ok := cache[msg.SenderID]; ok {
+		return name
+	}
+
+	name := "未知用户"
+	if senderObjectID, err := primitive.ObjectIDFromHex(msg.SenderID); err == nil {
+		var user models.User
+		if err := s.store.Collection("users").FindOne(ctx, bson.M{"_id": senderObjectID}).Decode(&user); err == nil {
+			name = user.Username
+		}
+	}
+	cache[msg.SenderID] = name
+	return name
+}
+
+// MessageEventName 返回新消息廣播時使用的 Socket 事件名稱，與客戶端發送時的事件一致
+func MessageEventName(messageType string) string {
+	switch messageType {
+	case models.MessageTypeVoice:
+		return "voice_message"
+	case models.MessageTypeImage:
+		return "image_message"
+	case "video":
+		return "video_message"
+	default:
+		return "chat_message"
+	}
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxReactionLength = 16 // 單個表情的最大字元數（組合表情可能由多個碼點組成）
+	maxReactionKinds  = 20 // 每條消息最多的不同表情數
+)
+
+var (
+	ErrInvalidReaction      = errors.New("無效的表情")
+	ErrReactionLimitReached = errors.New("消息的表情種類已達上限")
+)
+
+// ValidateReaction 檢查表情是單個 emoji（可包含膚色、變體選擇符與 ZWJ 組合），並且可以安全地作為 MongoDB 欄位名
+func ValidateReaction(emoji string) error {
+	if err := validateReactionKey(emoji); err != nil {
+		return err
+	}
+	if !isSingleEmoji([]rune(emoji)) {
+		return ErrInvalidReaction
+	}
+	return nil
+}
+
+// validateReactionKey 只檢查可以安全地作為 MongoDB 欄位名，用於移除舊版本留下的表情
+func validateReactionKey(emoji string) error {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxReactionLength {
+		return ErrInvalidReaction
+	}
+	if strings.HasPrefix(emoji, "$") || strings.ContainsAny(emoji, ".\x00") {
+		return ErrInvalidReaction
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) {
+			return ErrInvalidReaction
+		}
+	}
+	return nil
+}
+
+// isSingleEmoji 判斷是否為一個 emoji：國旗、按鍵帽，或以 ZWJ 連接的圖形符號序列
+func isSingleEmoji(runes []rune) bool {
+	if len(runes) == 2 && isRegionalIndicator(runes[0]) && isRegionalIndicator(runes[1]) {
+		return true
+	}
+	if isKeycapBase(runes[0]) {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == 0xFE0F {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == 0x20E3
+	}
+
+	expectBase := true
+	for _, r := range runes {
+		switch {
+		case expectBase:
+			if !isPictographic(r) {
+				return false
+			}
+			expectBase = false
+		case r == 0x200D: // ZWJ，之後必須是另一個圖形符號
+			expectBase = true
+		case r == 0xFE0E || r == 0xFE0F: // 變體選擇符
+		case r >= 0x1F3FB && r <= 0x1F3FF: // 膚色
+		case r >= 0xE0020 && r <= 0xE007F: // 標籤序列，例如英格蘭旗
+		default:
+			return false
+		}
+	}
+	return !expectBase
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isKeycapBase(r rune) bool {
+	return r == '#' || r == '*' || (r >= '0' && r <= '9')
+}
+
+// isPictographic 常用 emoji 所在的 Unicode 區段
+func isPictographic(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF: // 表情、符號與象形文字、交通、補充符號等
+		return !isRegionalIndicator(r) && !(r >= 0x1F3FB && r <= 0x1F3FF)
+	case r >= 0x2600 && r <= 0x27BF: // 雜項符號與裝飾符號
+		return true
+	case r >= 0x2190 && r <= 0x21FF, r >= 0x2300 && r <= 0x23FF, r >= 0x2B00 && r <= 0x2BFF:
+		return true
+	case r >= 0x25A0 && r <= 0x25FF, r >= 0x2934 && r <= 0x2935:
+		return true
+	}
+	switch r {
+	case 0x00A9, 0x00AE, 0x203C, 0x2049, 0x2122, 0x2139, 0x24C2, 0x3030, 0x303D, 0x3297, 0x3299:
+		return true
+	}
+	return false
+}
+
+// AddReaction 為消息添加表情回應，同一用戶對同一表情只記錄一次
+func (s *ChatService) AddReaction(ctx context.Context, roomID, messageID, userID, emoji string) (models.Message, error) {
+	if err := ValidateReaction(emoji); err != nil {
+		return models.Message{}, err
+	}
+	filter, err := reactionMessageFilter(roomID, messageID)
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	// 已有的表情可以繼續添加用戶；新的表情只在不同表情數未達上限時添加，避免消息文檔無限增長
+	field := "reactions." + emoji
+	filter["$or"] = []bson.M{
+		{field: bson.M{"$exists": true}},
+		{"$expr": bson.M{"$lt": bson.A{
+			bson.M{"$size": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$reactions", bson.M{}}}}},
+			maxReactionKinds,
+		}}},
+	}
+	message, err := s.updateReaction(ctx, filter, bson.M{"$addToSet": bson.M{field: userID}})
+	if !errors.Is(err, ErrMessageNotFound) {
+		return message, err
+	}
+
+	// 條件不成立：消息不存在，或是表情種類已達上限
+	delete(filter, "$or")
+	count, countErr := s.store.Collection("messages").CountDocuments(ctx, filter)
+	if countErr != nil {
+		return models.Message{}, countErr
+	}
+	if count > 0 {
+		return models.Message{}, ErrReactionLimitReached
+	}
+	return models.Message{}, ErrMessageNotFound
+}
+
+// RemoveReaction 移除用戶的表情回應，沒有人使用的表情會從消息中刪除
+// 只檢查欄位名是否安全，舊版本留下的非 emoji 表情也可以移除
+func (s *ChatService) RemoveReaction(ctx context.Context, roomID, messageID, userID, emoji string) (models.Message, error) {
+	if err := validateReactionKey(emoji); err != nil {
+		return models.Message{}, err
+	}
+	filter, err := reactionMessageFilter(roomID, messageID)
+	if err != nil {
+		return models.Message{}, err
+	}
+	message, err := s.updateReaction(ctx, filter, bson.M{
+		"$pull": bson.M{"reactions." + emoji: userID},
+	})
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	if users, exists := message.Reactions[emoji]; exists && len(users) == 0 {
+		field := "reactions." + emoji
+		_, err := s.store.Collection("messages").UpdateOne(ctx,
+			bson.M{"_id": message.ID, field: bson.M{"$size": 0}},
+			bson.M{"$unset": bson.M{field: ""}},
+		)
+		if err != nil {
+			return models.Message{}, err
+		}
+		delete(message.Reactions, emoji)
+	}
+	return message, nil
+}
+
+// reactionMessageFilter 構建可以回應的消息的查詢條件：屬於該聊天室且未被刪除
+func reactionMessageFilter(roomID, messageID string) (bson.M, error) {
+	messageObjectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+	return bson.M{
+		"_id":        messageObjectID,
+		"room":       roomID,
+		"is_deleted": bson.M{"$ne": true},
+	}, nil
+}
+
+func (s *ChatService) updateReaction(ctx context.Context, filter, update bson.M) (models.Message, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var message models.Message
+	err := s.store.Collection("messages").FindOneAndUpdate(ctx, filter, update, opts).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return models.Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+	return message, nil
+}
+
+// AggregateReactions 將表情回應轉換為按人數排序的列表，每項包含表情、人數與用戶
+func AggregateReactions(reactions map[string][]string) []map[string]interface{} {
+	aggregated := make([]map[string]interface{}, 0, len(reactions))
+	for emoji, users := range reactions {
+		if len(users) == 0 {
+			continue
+		}
+		aggregated = append(aggregated, map[string]interface{}{
+			"emoji": emoji,
+			"count": len(users),
+			"users": users,
+		})
+	}
+
+	sort.Slice(aggregated, func(i, j int) bool {
+		ci, cj := aggregated[i]["count"].(int), aggregated[j]["count"].(int)
+		if ci != cj {
+			return ci > cj
+		}
+		return aggregated[i]["emoji"].(string) < aggregated[j]["emoji"].(string)
+	})
+	return aggregated
+}
+
+// ReactionUpdatedPayload 構建 "reaction_updated" 廣播事件的內容
+func ReactionUpdatedPayload(message models.Message, userID, emoji, action string) map[string]interface{} {
+	return map[string]interface{}{
+		"message_id": message.ID.Hex(),
+		"room":       message.Room,
+		"user_id":    userID,
+		"emoji":      emoji,
+		"action":     action,
+		"reactions":  AggregateReactions(message.Reactions),
+	}
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxDeliveryAckBatch 單次確認送達的消息數上限
+const MaxDeliveryAckBatch = 100
+
+// ReceiptEntry 回執列表中的一位用戶；舊消息的已讀記錄可能沒有時間
+type ReceiptEntry struct {
+	UserID   string     `json:"user_id"`
+	Username string     `json:"username"`
+	At       *time.Time `json:"at,omitempty"`
+}
+
+// MessageReceipts 單條消息的送達與已讀情況
+type MessageReceipts struct {
+	MessageID string         `json:"message_id"`
+	Delivered []ReceiptEntry `json:"delivered"`
+	Read      []ReceiptEntry `json:"read"`
+	Pending   []string       `json:"pending"` // 尚未確認收到的成員
+}
+
+// MarkMessagesDelivered 記錄用戶已收到消息，返回本次新記錄的消息（按發送者分組），供通知發送者使用
+// 自己發送的消息與已記錄過的消息會被忽略
+func (s *ChatService) MarkMessagesDelivered(ctx context.Context, roomID, userID string, messageIDs []string) (map[string][]string, time.Time, error) {
+	now := time.Now()
+	collection := s.store.Collection("messages")
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"sender_id": 1})
+	delivered := map[string][]string{}
+
+	for _, messageID := range messageIDs {
+		messageObjectID, err := primitive.ObjectIDFromHex(messageID)
+		if err != nil {
+			continue
+		}
+
+		// 以「尚未記錄此用戶」作為條件，同一用戶的多個連線重複確認時只記錄一次
+		var message models.Message
+		err = collection.FindOneAndUpdate(ctx, bson.M{
+			"_id":                  messageObjectID,
+			"room":                 roomID,
+			"sender_id":            bson.M{"$ne": userID},
+			"delivered_to.user_id": bson.M{"$ne": userID},
+		}, bson.M{
+			"$push": bson.M{"delivered_to": models.MessageReceipt{UserID: userID, At: now}},
+		}, opts).Decode(&message)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return delivered, now, err
+		}
+		delivered[message.SenderID] = append(delivered[message.SenderID], messageID)
+	}
+	return delivered, now, nil
+}
+
+// GetMessageReceipts 列出聊天室成員收到與讀取消息的時間，已讀狀態由各成員的已讀位置推導
+func (s *ChatService) GetMessageReceipts(ctx context.Context, roomID, messageID string) (MessageReceipts, error) {
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return MessageReceipts{}, ErrRoomNotFound
+	}
+	messageObjectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return MessageReceipts{}, ErrMessageNotFound
+	}
+
+	var message models.Message
+	err = s.store.Collection("messages").FindOne(ctx, bson.M{
+		"_id":        messageObjectID,
+		"room":       roomID,
+		"is_deleted": bson.M{"$ne": true},
+	}).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return MessageReceipts{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return MessageReceipts{}, err
+	}
+
+	participants, err := s.GetRoomParticipants(ctx, roomObjectID)
+	if err != nil {
+		return MessageReceipts{}, err
+	}
+	usernames := s.lookupUsernames(ctx, participants)
+
+	cursors, err := s.GetRoomReadCursors(ctx, roomID, nil)
+	if err != nil {
+		return MessageReceipts{}, err
+	}
+	// 已讀位置只記錄最後一次移動的時間，作為讀取時間的近似值
+	readAt := map[string]time.Time{}
+	for _, cursor := range cursors {
+		if cursor.UserID != message.SenderID && HasRead(cursor, message) {
+			readAt[cursor.UserID] = cursor.UpdatedAt
+		}
+	}
+	deliveredAt := map[string]time.Time{}
+	for _, receipt := range message.DeliveredTo {
+		deliveredAt[receipt.UserID] = receipt.At
+	}
+
+	result := MessageReceipts{
+		MessageID: messageID,
+		Delivered: []ReceiptEntry{},
+		Read:      []ReceiptEntry{},
+		Pending:   []string{},
+	}
+
+	// 舊數據直接寫入 read_by，沒有讀取時間
+	readers := map[string]bool{}
+	for _, readerID := range message.ReadBy {
+		readers[readerID] = true
+	}
+	for readerID := range readAt {
+		readers[readerID] = true
+	}
+
+	for _, participantID := range participants {
+		if participantID == message.SenderID {
+			continue
+		}
+		if readers[participantID] {
+			entry := ReceiptEntry{UserID: participantID, Username: usernames[participantID]}
+			if at, ok := readAt[participantID]; ok {
+				entry.At = &at
+			}
+			result.Read = append(result.Read, entry)
+		}
+
+		switch at, delivered := deliveredAt[participantID]; {
+		case delivered:
+			result.Delivered = append(result.Delivered, ReceiptEntry{UserID: participantID, Username: usernames[participantID], At: &at})
+		case readers[participantID]:
+			// 已讀但沒有送達記錄（例如舊版客戶端），視為在讀取時送達
+			entry := ReceiptEntry{UserID: participantID, Username: usernames[participantID]}
+			if at, ok := readAt[participantID]; ok {
+				entry.At = &at
+			}
+			result.Delivered = append(result.Delivered, entry)
+		default:
+			result.Pending = append(result.Pending, participantID)
+		}
+	}
+	return result, nil
+}
+
+// lookupUsernames 批量查詢用戶名稱
+func (s *ChatService) lookupUsernames(ctx context.Context, userIDs []string) map[string]string {
+	objectIDs := make([]primitive.ObjectID, 0, len(userIDs))
+	for _, id := range userIDs {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+
+	usernames := make(map[string]string, len(objectIDs))
+	if len(objectIDs) == 0 {
+		return usernames
+	}
+	cursor, err := s.store.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": objectIDs}})
+	if err != nil {
+		return usernames
+	}
+	defer cursor.Close(ctx)
+
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return usernames
+	}
+	for _, user := range users {
+		usernames[user.ID.Hex()] = user.Username
+	}
+	return usernames
+}
+
+// MessageDeliveredPayload 構建發給發送者的 "message_delivered" 事件內容
+func MessageDeliveredPayload(roomID, recipientID string, messageIDs []string, deliveredAt time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"room":         roomID,
+		"user_id":      recipientID,
+		"message_ids":  messageIDs,
+		"delivered_at": deliveredAt.Format(time.RFC3339),
+	}
+}
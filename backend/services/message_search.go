@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"chatwme/backend/models"
+	"chatwme/backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxSearchTokens 單條消息最多保存的索引詞元數
+const maxSearchTokens = 512
+
+var (
+	ErrSearchDisabled = errors.New("消息搜尋未啟用")
+	ErrEmptySearch    = errors.New("搜尋關鍵字與篩選條件不能同時為空")
+)
+
+// MessageSearchQuery 消息搜尋條件，RoomIDs 必須是調用者所在的聊天室
+type MessageSearchQuery struct {
+	Query    string
+	RoomIDs  []string
+	SenderID string
+	Type     string
+	From     *time.Time
+	To       *time.Time
+	BeforeID string // 上一頁最舊的一條消息
+	Limit    int
+}
+
+// SetSearchKey 設置盲索引密鑰，未設置時不建立索引且搜尋不可用
+func (s *ChatService) SetSearchKey(key []byte) {
+	s.searchKey = key
+}
+
+// SearchEnabled 是否已啟用消息搜尋
+func (s *ChatService) SearchEnabled() bool {
+	return len(s.searchKey) > 0
+}
+
+// EnsureSearchIndex 建立 search_tokens 的多鍵索引，避免搜尋時掃描聊天室的全部消息；索引已存在時不變
+func (s *ChatService) EnsureSearchIndex(ctx context.Context) error {
+	_, err := s.store.Collection("messages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "search_tokens", Value: 1}, {Key: "room", Value: 1}},
+		Options: options.Index().SetName("search_tokens_room"),
+	})
+	return err
+}
+
+// SearchTokens 將明文內容轉換為盲索引詞元，與消息一起保存
+// 伺服器只保存詞元的 HMAC，無法從索引還原原文
+func (s *ChatService) SearchTokens(plaintext string) []string {
+	if !s.SearchEnabled() {
+		return nil
+	}
+	return s.blindTokens(tokenize(plaintext, true))
+}
+
+func (s *ChatService) blindTokens(tokens []string) []string {
+	blinded := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		blinded = append(blinded, utils.BlindIndex(token, s.searchKey))
+	}
+	return blinded
+}
+
+// isCJK 中日韓文字沒有空格分詞，改用單字與相鄰雙字作為詞元
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// tokenize 切分詞元：英文等以單詞為單位（轉小寫），中日韓文字以單字與雙字為單位
+// 建立索引時保存單字與雙字；查詢時只用雙字（單個字時用單字）以減少誤判
+func tokenize(text string, forIndex bool) []string {
+	seen := map[string]bool{}
+	var tokens []string
+	add := func(token string) {
+		if token != "" && !seen[token] && len(tokens) < maxSearchTokens {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	var word []rune
+	var cjkRun []rune
+	flushWord := func() {
+		add(strings.ToLower(string(word)))
+		word = word[:0]
+	}
+	flushCJK := func() {
+		if len(cjkRun) == 1 || forIndex {
+			for _, r := range cjkRun {
+				add(string(r))
+			}
+		}
+		for i := 0; i+1 < len(cjkRun); i++ {
+			add(string(cjkRun[i : i+2]))
+		}
+		cjkRun = cjkRun[:0]
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjkRun = append(cjkRun, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return tokens
+}
+
+// SearchMessages 以盲索引搜尋消息，結果按時間由新到舊排列
+func (s *ChatService) SearchMessages(ctx context.Context, query MessageSearchQuery) ([]map[string]interface{}, bool, error) {
+	if !s.SearchEnabled() {
+		return nil, false, ErrSearchDisabled
+	}
+
+	tokens := tokenize(query.Query, false)
+	if len(tokens) == 0 && query.SenderID == "" && query.Type == "" && query.From == nil && query.To == nil {
+		return nil, false, ErrEmptySearch
+	}
+	if len(query.RoomIDs) == 0 {
+		return []map[string]interface{}{}, false, nil
+	}
+
+	filter := bson.M{
+		"room":       bson.M{"$in": query.RoomIDs},
+		"is_deleted": bson.M{"$ne": true},
+	}
+	if len(tokens) > 0 {
+		filter["search_tokens"] = bson.M{"$all": s.blindTokens(tokens)}
+	}
+	if query.SenderID != "" {
+		filter["sender_id"] = query.SenderID
+	}
+	if query.Type != "" {
+		filter["type"] = query.Type
+	}
+
+	timeRange := bson.M{}
+	if query.From != nil {
+		timeRange["$gte"] = *query.From
+	}
+	if query.To != nil {
+		timeRange["$lte"] = *query.To
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	collection := s.store.Collection("messages")
+	if query.BeforeID != "" {
+		beforeObjectID, err := primitive.ObjectIDFromHex(query.BeforeID)
+		if err != nil {
+			return nil, false, ErrMessageNotFound
+		}
+		var before models.Message
+		err = collection.FindOne(ctx, bson.M{"_id": beforeObjectID}).Decode(&before)
+		if err == mongo.ErrNoDocuments {
+			return nil, false, ErrMessageNotFound
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		filter["$or"] = []bson.M{
+			{"timestamp": bson.M{"$lt": before.Timestamp}},
+			{"timestamp": before.Timestamp, "_id": bson.M{"$lt": beforeObjectID}},
+		}
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(query.Limit + 1))
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > query.Limit
+	if hasMore {
+		messages = messages[:query.Limit]
+	}
+	return s.FormatMessages(ctx, messages), hasMore, nil
+}
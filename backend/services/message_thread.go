@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// replySnippetLength 引用消息摘要的最大字數
+const replySnippetLength = 100
+
+var ErrInvalidReplyTarget = errors.New("回覆的消息不存在或不在此聊天室")
+
+// MessageOption 在消息寫入前設置可選欄位
+type MessageOption func(*models.Message)
+
+// WithReply 將消息標記為對 replyTo 的回覆，threadRoot 為所屬話題的第一條消息
+func WithReply(replyTo, threadRoot string) MessageOption {
+	return func(message *models.Message) {
+		message.ReplyTo = replyTo
+		message.ThreadRoot = threadRoot
+	}
+}
+
+// ResolveReplyTarget 檢查被回覆的消息屬於同一聊天室，並找出話題根消息
+// 回覆一條回覆時沿用其話題根，使整個話題只有一層
+func (s *ChatService) ResolveReplyTarget(ctx context.Context, roomID, replyToID string) (string, string, error) {
+	parentObjectID, err := primitive.ObjectIDFromHex(replyToID)
+	if err != nil {
+		return "", "", ErrInvalidReplyTarget
+	}
+
+	var parent models.Message
+	err = s.store.Collection("messages").FindOne(ctx, bson.M{
+		"_id":        parentObjectID,
+		"room":       roomID,
+		"is_deleted": bson.M{"$ne": true},
+	}).Decode(&parent)
+	if err == mongo.ErrNoDocuments {
+		return "", "", ErrInvalidReplyTarget
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	threadRoot := parent.ThreadRoot
+	if threadRoot == "" {
+		threadRoot = parent.ID.Hex()
+	}
+	return parent.ID.Hex(), threadRoot, nil
+}
+
+// CountThreadReplies 統計各話題根消息下未刪除的回覆數
+func (s *ChatService) CountThreadReplies(ctx context.Context, roomID string, rootIDs []string) (map[string]int64, error) {
+	counts := map[string]int64{}
+	if len(rootIDs) == 0 {
+		return counts, nil
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"room":        roomID,
+			"thread_root": bson.M{"$in": rootIDs},
+			"is_deleted":  bson.M{"$ne": true},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$thread_root",
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+
+	cursor, err := s.store.Collection("messages").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		ID    string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		counts[result.ID] = result.Count
+	}
+	return counts, nil
+}
+
+// GetReplySnippets 獲取被引用消息的解密摘要，以消息 ID 為鍵
+// 已刪除的消息只返回刪除標記，不返回內容
+func (s *ChatService) GetReplySnippets(ctx context.Context, messageIDs []string) (map[string]map[string]interface{}, error) {
+	snippets := map[string]map[string]interface{}{}
+	objectIDs := make([]primitive.ObjectID, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+	if len(objectIDs) == 0 {
+		return snippets, nil
+	}
+
+	cursor, err := s.store.Collection("messages").Find(ctx, bson.M{"_id": bson.M{"$in": objectIDs}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var parents []models.Message
+	if err := cursor.All(ctx, &parents); err != nil {
+		return nil, err
+	}
+
+	senderNames := map[string]string{}
+	for _, parent := range parents {
+		snippet := map[string]interface{}{
+			"id":          parent.ID.Hex(),
+			"sender_id":   parent.SenderID,
+			"sender_name": s.resolveSenderName(ctx, parent, senderNames),
+			"type":        parent.Type,
+			"is_deleted":  parent.IsDeleted,
+		}
+		if !parent.IsDeleted {
+			decryptedContent, err := s.DecryptMessage(ctx, parent)
+			if err != nil {
+				decryptedContent = "[讯息无法解密]"
+			}
+			content, _ := BuildMessagePayload(parent, "", decryptedContent)["content"].(string)
+			snippet["content"] = truncateRunes(content, replySnippetLength)
+		}
+		snippets[parent.ID.Hex()] = snippet
+	}
+	return snippets, nil
+}
+
+// AttachReplyContext 為一頁消息補上引用摘要與話題回覆數
+func (s *ChatService) AttachReplyContext(ctx context.Context, roomID string, messages []map[string]interface{}) error {
+	var parentIDs, messageIDs []string
+	for _, messageObj := range messages {
+		if replyTo, ok := messageObj["reply_to"].(string); ok && replyTo != "" {
+			parentIDs = append(parentIDs, replyTo)
+		}
+		if id, ok := messageObj["id"].(string); ok {
+			messageIDs = append(messageIDs, id)
+		}
+	}
+
+	snippets, err := s.GetReplySnippets(ctx, parentIDs)
+	if err != nil {
+		return err
+	}
+	counts, err := s.CountThreadReplies(ctx, roomID, messageIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, messageObj := range messages {
+		if replyTo, ok := messageObj["reply_to"].(string); ok && replyTo != "" {
+			if snippet, exists := snippets[replyTo]; exists {
+				messageObj["reply_to_message"] = snippet
+			}
+		}
+		if id, ok := messageObj["id"].(string); ok {
+			if count := counts[id]; count > 0 {
+				messageObj["reply_count"] = count
+			}
+		}
+	}
+	return nil
+}
+
+// GetThread 獲取話題根消息及其回覆（按時間先後），afterID 為上一頁最後一條回覆
+// messageID 可以是話題中的任意一條消息
+func (s *ChatService) GetThread(ctx context.Context, roomID, messageID, afterID string, limit int) (models.Message, []models.Message, bool, error) {
+	collection := s.store.Collection("messages")
+
+	messageObjectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return models.Message{}, nil, false, ErrMessageNotFound
+	}
+
+	var root models.Message
+	err = collection.FindOne(ctx, bson.M{"_id": messageObjectID, "room": roomID}).Decode(&root)
+	if err == mongo.ErrNoDocuments {
+		return models.Message{}, nil, false, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.Message{}, nil, false, err
+	}
+	if root.ThreadRoot != "" {
+		rootObjectID, err := primitive.ObjectIDFromHex(root.ThreadRoot)
+		if err != nil {
+			return models.Message{}, nil, false, ErrMessageNotFound
+		}
+		if err := collection.FindOne(ctx, bson.M{"_id": rootObjectID, "room": roomID}).Decode(&root); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return models.Message{}, nil, false, ErrMessageNotFound
+			}
+			return models.Message{}, nil, false, err
+		}
+	}
+
+	filter := bson.M{
+		"room":        roomID,
+		"thread_root": root.ID.Hex(),
+		"is_deleted":  bson.M{"$ne": true},
+	}
+	if afterID != "" {
+		afterObjectID, err := primitive.ObjectIDFromHex(afterID)
+		if err != nil {
+			return models.Message{}, nil, false, ErrMessageNotFound
+		}
+		var after models.Message
+		if err := collection.FindOne(ctx, bson.M{"_id": afterObjectID, "room": roomID}).Decode(&after); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return models.Message{}, nil, false, ErrMessageNotFound
+			}
+			return models.Message{}, nil, false, err
+		}
+		filter["$or"] = []bson.M{
+			{"timestamp": bson.M{"$gt": after.Timestamp}},
+			{"timestamp": after.Timestamp, "_id": bson.M{"$gt": afterObjectID}},
+		}
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit + 1))
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return models.Message{}, nil, false, err
+	}
+	defer cursor.Close(ctx)
+
+	var replies []models.Message
+	if err := cursor.All(ctx, &replies); err != nil {
+		return models.Message{}, nil, false, err
+	}
+
+	hasMore := len(replies) > limit
+	if hasMore {
+		replies = replies[:limit]
+	}
+	return root, replies, hasMore, nil
+}
+
+func truncateRunes(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max]) + "…"
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordTombstone 記錄被永久刪除的消息或未使用的序號；重複寫入同一條消息時保留最早的記錄
+func (s *ChatService) recordTombstone(ctx context.Context, messageID primitive.ObjectID, roomID string, seq int64, reason string) error {
+	_, err := s.store.Collection("message_tombstones").UpdateOne(ctx,
+		bson.M{"_id": messageID},
+		bson.M{"$setOnInsert": models.MessageTombstone{
+			ID:        messageID,
+			Room:      roomID,
+			Seq:       seq,
+			Reason:    reason,
+			RemovedAt: time.Now(),
+		}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// SeqTombstones 返回聊天室在序號區間內沒有消息的序號及原因，客戶端補齊缺失的序號時不必再次請求
+func (s *ChatService) SeqTombstones(ctx context.Context, roomID string, seqRange bson.M) ([]map[string]interface{}, error) {
+	cursor, err := s.store.Collection("message_tombstones").Find(ctx,
+		bson.M{"room": roomID, "seq": seqRange},
+		options.Find().SetSort(bson.M{"seq": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var tombstones []models.MessageTombstone
+	if err := cursor.All(ctx, &tombstones); err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]interface{}, 0, len(tombstones))
+	for _, tombstone := range tombstones {
+		results = append(results, map[string]interface{}{
+			"seq":    tombstone.Seq,
+			"reason": tombstone.Reason,
+		})
+	}
+	return results, nil
+}
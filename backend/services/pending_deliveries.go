@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	pendingDrainBatch  = 100                 // 每次推送的消息數
+	maxPendingDrain    = 1000                // 每次連線最多補發的消息數，超出的部分由客戶端以 sync 或 REST 補齊
+	pendingDeliveryTTL = 30 * 24 * time.Hour // 超過此時間仍未確認的記錄不再補發
+)
+
+func pendingDeliveryID(messageID, userID string) string {
+	return messageID + ":" + userID
+}
+
+// enqueuePendingDeliveries 為沒有連線在聊天室中的成員記錄待送達的消息
+// 在本實例上有連線但未加入該聊天室的成員立即推送到其私有頻道，記錄同樣保留到確認為止
+func (s *ChatService) enqueuePendingDeliveries(ctx context.Context, message models.Message, members []string) {
+	seen := map[string]bool{message.SenderID: true}
+	var docs []interface{}
+	var connected []string
+	now := time.Now()
+	for _, userID := range members {
+		if userID == "" || seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		if s.HasSocketInRoom(message.Room, userID) {
+			continue
+		}
+		docs = append(docs, models.PendingDelivery{
+			ID:        pendingDeliveryID(message.ID.Hex(), userID),
+			UserID:    userID,
+			RoomID:    message.Room,
+			MessageID: message.ID.Hex(),
+			Seq:       message.Seq,
+			CreatedAt: now,
+		})
+		if s.IsUserConnected(userID) {
+			connected = append(connected, userID)
+		}
+	}
+	if len(docs) == 0 {
+		return
+	}
+
+	_, err := s.store.Collection("pending_deliveries").InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		log.Printf("Failed to queue message %s for offline delivery: %v", message.ID.Hex(), err)
+		return
+	}
+
+	if len(connected) == 0 {
+		return
+	}
+	payloads := s.FormatMessages(ctx, []models.Message{message})
+	for _, userID := range connected {
+		s.EmitToUser(userID, "pending_messages", map[string]interface{}{"messages": payloads})
+	}
+}
+
+// DrainPendingDeliveries 按消息先後補發用戶尚未確認的消息，每批調用一次 emit，返回補發數與是否還有剩餘
+// 記錄在客戶端確認前保留，重新連線時會再次補發；已刪除的消息或已離開的聊天室的記錄直接移除
+func (s *ChatService) DrainPendingDeliveries(ctx context.Context, userID string, emit func(payload map[string]interface{})) (int, bool, error) {
+	collection := s.store.Collection("pending_deliveries")
+	if _, err := collection.DeleteMany(ctx, bson.M{
+		"user_id":    userID,
+		"created_at": bson.M{"$lt": time.Now().Add(-pendingDeliveryTTL)},
+	}); err != nil {
+		return 0, false, err
+	}
+
+	roomIDs, err := s.GetUserRoomIDs(ctx, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	memberOf := make(map[string]bool, len(roomIDs))
+	for _, roomID := range roomIDs {
+		memberOf[roomID] = true
+	}
+
+	// _id 以消息 ID 開頭，按 _id 排序即按消息先後
+	delivered := 0
+	lastID := ""
+	for delivered < maxPendingDrain {
+		cursor, err := collection.Find(ctx,
+			bson.M{"user_id": userID, "_id": bson.M{"$gt": lastID}},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(pendingDrainBatch))
+		if err != nil {
+			return delivered, false, err
+		}
+		var entries []models.PendingDelivery
+		if err := cursor.All(ctx, &entries); err != nil {
+			return delivered, false, err
+		}
+		if len(entries) == 0 {
+			return delivered, false, nil
+		}
+		lastID = entries[len(entries)-1].ID
+
+		messages, stale, err := s.loadPendingMessages(ctx, entries, memberOf)
+		if err != nil {
+			return delivered, false, err
+		}
+		if len(stale) > 0 {
+			if _, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": stale}}); err != nil {
+				log.Printf("Failed to remove stale pending deliveries of user %s: %v", userID, err)
+			}
+		}
+		if len(messages) > 0 {
+			emit(map[string]interface{}{"messages": s.FormatMessages(ctx, messages)})
+			delivered += len(messages)
+		}
+		if len(entries) < pendingDrainBatch {
+			return delivered, false, nil
+		}
+	}
+
+	more, err := collection.CountDocuments(ctx, bson.M{"user_id": userID, "_id": bson.M{"$gt": lastID}},
+		options.Count().SetLimit(1))
+	return delivered, more > 0, err
+}
+
+// loadPendingMessages 載入待送達記錄對應的消息，並返回應直接移除的記錄
+func (s *ChatService) loadPendingMessages(ctx context.Context, entries []models.PendingDelivery, memberOf map[string]bool) ([]models.Message, []string, error) {
+	var stale, queried []string
+	objectIDs := make([]primitive.ObjectID, 0, len(entries))
+	for _, entry := range entries {
+		objectID, err := primitive.ObjectIDFromHex(entry.MessageID)
+		if err != nil || !memberOf[entry.RoomID] {
+			stale = append(stale, entry.ID)
+			continue
+		}
+		objectIDs = append(objectIDs, objectID)
+		queried = append(queried, entry.MessageID)
+	}
+	if len(objectIDs) == 0 {
+		return nil, stale, nil
+	}
+
+	cursor, err := s.store.Collection("messages").Find(ctx, bson.M{
+		"_id":        bson.M{"$in": objectIDs},
+		"is_deleted": bson.M{"$ne": true},
+	}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, nil, err
+	}
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[string]bool, len(messages))
+	for _, message := range messages {
+		found[message.ID.Hex()] = true
+	}
+	for _, messageID := range queried {
+		if !found[messageID] {
+			stale = append(stale, pendingDeliveryID(messageID, entries[0].UserID))
+		}
+	}
+	return messages, stale, nil
+}
+
+// AckPendingDeliveries 客戶端確認收到消息後刪除其待送達記錄
+func (s *ChatService) AckPendingDeliveries(ctx context.Context, userID string, messageIDs []string) error {
+	ids := make([]string, 0, len(messageIDs))
+	for _, messageID := range messageIDs {
+		ids = append(ids, pendingDeliveryID(messageID, userID))
+	}
+	_, err := s.store.Collection("pending_deliveries").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
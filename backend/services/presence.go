@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	presenceLease         = 90 * time.Second // 連線記錄的租期，持有實例停止續期後視為斷線
+	presenceRenewInterval = 30 * time.Second // 實例為本地連線續期並清理過期記錄的間隔
+	MaxPresenceLookup     = 200              // 單次查詢在線狀態的最多用戶數
+)
+
+// PresenceConnect 記錄新的連線並更新用戶的在線狀態
+func (s *ChatService) PresenceConnect(ctx context.Context, socketID, userID string) error {
+	now := time.Now()
+	_, err := s.store.Collection("presence_connections").UpdateOne(ctx,
+		bson.M{"_id": socketID},
+		bson.M{"$set": bson.M{
+			"user_id":      userID,
+			"idle":         false,
+			"connected_at": now,
+			"expires_at":   now.Add(presenceLease),
+		}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	return s.refreshPresence(ctx, userID)
+}
+
+// PresenceHeartbeat 續期連線並更新閒置狀態；idle 為 nil 時只續期
+// 記錄已被當作過期清理時重新建立
+func (s *ChatService) PresenceHeartbeat(ctx context.Context, socketID, userID string, idle *bool) error {
+	now := time.Now()
+	set := bson.M{"user_id": userID, "expires_at": now.Add(presenceLease)}
+	setOnInsert := bson.M{"connected_at": now}
+	if idle != nil {
+		set["idle"] = *idle
+	} else {
+		setOnInsert["idle"] = false
+	}
+	result, err := s.store.Collection("presence_connections").UpdateOne(ctx,
+		bson.M{"_id": socketID},
+		bson.M{"$set": set, "$setOnInsert": setOnInsert},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	if idle == nil && result.UpsertedCount == 0 {
+		return nil
+	}
+	return s.refreshPresence(ctx, userID)
+}
+
+// PresenceDisconnect 移除斷開的連線；用戶的最後一個連線斷開時記錄 last_seen
+func (s *ChatService) PresenceDisconnect(ctx context.Context, socketID, userID string) error {
+	if _, err := s.store.Collection("presence_connections").DeleteOne(ctx, bson.M{"_id": socketID}); err != nil {
+		return err
+	}
+	return s.refreshPresence(ctx, userID)
+}
+
+// refreshPresence 根據用戶所有未過期的連線計算在線狀態，狀態改變時保存並通知
+// 以「狀態不同」作為更新條件，多個實例同時計算時只有實際改變狀態的一方會發出通知
+func (s *ChatService) refreshPresence(ctx context.Context, userID string) error {
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil
+	}
+
+	collection := s.store.Collection("presence_connections")
+	live := bson.M{"user_id": userID, "expires_at": bson.M{"$gt": time.Now()}}
+	total, err := collection.CountDocuments(ctx, live)
+	if err != nil {
+		return err
+	}
+	status := models.PresenceOffline
+	if total > 0 {
+		live["idle"] = bson.M{"$ne": true}
+		active, err := collection.CountDocuments(ctx, live)
+		if err != nil {
+			return err
+		}
+		status = models.PresenceAway
+		if active > 0 {
+			status = models.PresenceOnline
+		}
+	}
+
+	now := time.Now()
+	set := bson.M{
+		"presence":  status,
+		"is_online": status != models.PresenceOffline,
+	}
+	if status == models.PresenceOffline {
+		set["last_seen"] = now
+	}
+	result, err := s.store.Collection("users").UpdateOne(ctx,
+		bson.M{"_id": userObjectID, "presence": bson.M{"$ne": status}},
+		bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		var lastSeen *time.Time
+		if status == models.PresenceOffline {
+			lastSeen = &now
+		}
+		s.notifyPresenceChanged(ctx, userID, status, lastSeen)
+	}
+	return nil
+}
+
+// notifyPresenceChanged 向與該用戶同在任一聊天室的用戶推送 "presence_changed"
+func (s *ChatService) notifyPresenceChanged(ctx context.Context, userID, status string, lastSeen *time.Time) {
+	rooms := s.store.Collection("chat_rooms")
+	filter := bson.M{"$or": []bson.M{{"participants": userID}, {"created_by": userID}}}
+	participants, err := rooms.Distinct(ctx, "participants", filter)
+	if err != nil {
+		log.Printf("Failed to find contacts of user %s: %v", userID, err)
+		return
+	}
+	creators, err := rooms.Distinct(ctx, "created_by", filter)
+	if err != nil {
+		log.Printf("Failed to find contacts of user %s: %v", userID, err)
+		return
+	}
+
+	payload := PresencePayload(userID, status, lastSeen)
+	notified := map[string]bool{}
+	for _, value := range append(participants, creators...) {
+		contactID, ok := value.(string)
+		if !ok || contactID == "" || notified[contactID] {
+			continue
+		}
+		notified[contactID] = true
+		s.EmitToUser(contactID, "presence_changed", payload)
+	}
+}
+
+// PresencePayload 構建返回給客戶端的在線狀態
+func PresencePayload(userID, status string, lastSeen *time.Time) map[string]interface{} {
+	payload := map[string]interface{}{
+		"user_id": userID,
+		"status":  status,
+	}
+	if lastSeen != nil {
+		payload["last_seen"] = lastSeen.Format(time.RFC3339)
+	}
+	return payload
+}
+
+// GetPresence 批量查詢用戶的在線狀態；從未建立過連線的用戶視為離線
+func (s *ChatService) GetPresence(ctx context.Context, userIDs []string) ([]map[string]interface{}, error) {
+	objectIDs := make([]primitive.ObjectID, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if objectID, err := primitive.ObjectIDFromHex(userID); err == nil {
+			objectIDs = append(objectIDs, objectID)
+		}
+	}
+	if len(objectIDs) == 0 {
+		return []map[string]interface{}{}, nil
+	}
+
+	cursor, err := s.store.Collection("users").Find(ctx,
+		bson.M{"_id": bson.M{"$in": objectIDs}},
+		options.Find().SetProjection(bson.M{"presence": 1, "last_seen": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]interface{}, 0, len(users))
+	for _, user := range users {
+		status := user.Presence
+		if status == "" {
+			status = models.PresenceOffline
+		}
+		results = append(results, PresencePayload(user.ID.Hex(), status, user.LastSeen))
+	}
+	return results, nil
+}
+
+// RunPresenceWorker 定期為本實例的連線續期，並清理其他實例崩潰後留下的過期連線，直到 ctx 被取消
+func (s *ChatService) RunPresenceWorker(ctx context.Context) {
+	ticker := time.NewTicker(presenceRenewInterval)
+	defer ticker.Stop()
+
+	log.Printf("Presence worker started (interval %s)", presenceRenewInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Presence worker stopped")
+			return
+		case <-ticker.C:
+		}
+
+		workCtx, cancel := context.WithTimeout(ctx, presenceRenewInterval)
+		if err := s.renewLocalPresence(workCtx); err != nil {
+			log.Printf("Failed to renew presence connections: %v", err)
+		}
+		if err := s.sweepExpiredPresence(workCtx); err != nil {
+			log.Printf("Failed to sweep expired presence connections: %v", err)
+		}
+		cancel()
+	}
+}
+
+func (s *ChatService) renewLocalPresence(ctx context.Context) error {
+	sockets := s.localSockets()
+	if len(sockets) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	writes := make([]mongo.WriteModel, 0, len(sockets))
+	for socketID, userID := range sockets {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": socketID}).
+			SetUpdate(bson.M{
+				"$set":         bson.M{"user_id": userID, "expires_at": now.Add(presenceLease)},
+				"$setOnInsert": bson.M{"idle": false, "connected_at": now},
+			}).
+			SetUpsert(true))
+	}
+	_, err := s.store.Collection("presence_connections").BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// sweepExpiredPresence 刪除過期的連線記錄，並重新計算受影響用戶的狀態
+func (s *ChatService) sweepExpiredPresence(ctx context.Context) error {
+	collection := s.store.Collection("presence_connections")
+	expired := bson.M{"expires_at": bson.M{"$lte": time.Now()}}
+	userIDs, err := collection.Distinct(ctx, "user_id", expired)
+	if err != nil || len(userIDs) == 0 {
+		return err
+	}
+	if _, err := collection.DeleteMany(ctx, expired); err != nil {
+		return err
+	}
+	for _, value := range userIDs {
+		if userID, ok := value.(string); ok {
+			if err := s.refreshPresence(ctx, userID); err != nil {
+				log.Printf("Failed to refresh presence of user %s: %v", userID, err)
+			}
+		}
+	}
+	return nil
+}
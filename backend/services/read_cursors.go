@@ -0,0 +1,293 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidReadPosition = errors.New("無效的已讀位置")
+
+const (
+	recountMaxAttempts = 5                     // 重新計算未讀數時因計數同時變動而重試的次數上限
+	recountSettleDelay = 20 * time.Millisecond // 等待已分配序號的消息寫入的間隔
+)
+
+// ReadPosition 客戶端指定的已讀位置；MessageID 優先於 Seq，兩者皆空時表示讀到最新一條
+type ReadPosition struct {
+	MessageID string
+	Seq       int64
+}
+
+func readCursorID(roomID, userID string) string {
+	return roomID + ":" + userID
+}
+
+// MarkRoomRead 將用戶在聊天室中的已讀位置移動到指定消息
+// 已讀位置只會前進；返回當前的已讀位置，以及本次是否有前進
+func (s *ChatService) MarkRoomRead(ctx context.Context, roomID, userID string, position ReadPosition) (models.ReadCursor, bool, error) {
+	target, err := s.resolveReadPosition(ctx, roomID, position)
+	if err != nil {
+		return models.ReadCursor{}, false, err
+	}
+	if target.ID.IsZero() {
+		return models.ReadCursor{RoomID: roomID, UserID: userID}, false, nil
+	}
+
+	// 以「目前位置較舊」作為條件移動位置；位置已經更新時條件不成立，upsert 會因 _id 重複而失敗
+	// 計數不在這裡覆蓋，避免蓋掉同時到達的新消息所遞增的計數
+	id := readCursorID(roomID, userID)
+	filter := bson.M{
+		"_id": id,
+		"$or": []bson.M{
+			{"last_read_seq": bson.M{"$lt": target.Seq}},
+			{"last_read_seq": target.Seq, "last_read_at": bson.M{"$lt": target.Timestamp}},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"room_id":              roomID,
+		"user_id":              userID,
+		"last_read_message_id": target.ID.Hex(),
+		"last_read_seq":        target.Seq,
+		"last_read_at":         target.Timestamp,
+		"updated_at":           time.Now(),
+	}}
+	collection := s.store.Collection("read_cursors")
+	_, err = collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		var current models.ReadCursor
+		if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&current); err != nil {
+			return models.ReadCursor{}, false, err
+		}
+		return current, false, nil
+	}
+	if err != nil {
+		return models.ReadCursor{}, false, err
+	}
+
+	// 未讀計數在移動位置後重新計算，修正刪除或過期消息造成的偏差
+	cursor, err := s.recountUnread(ctx, roomID, userID)
+	if err != nil {
+		return models.ReadCursor{}, false, err
+	}
+	s.EmitToUser(userID, "unread_updated", RoomUnread{
+		RoomID:       roomID,
+		UnreadCount:  cursor.UnreadCount,
+		MentionCount: cursor.MentionCount,
+	})
+	return cursor, true, nil
+}
+
+// recountUnread 按目前的已讀位置重新計算並保存未讀計數
+// 消息先寫入、之後才遞增計數，因此只計算不超過當前序號的消息並把該序號記為 counts_seq，
+// 這些消息之後到達的遞增會被跳過，不會重複計入；更新的消息由遞增計入。
+// 同時以計數版本作為條件寫入：計算期間有遞增時重新計算，不會蓋掉遞增的結果
+func (s *ChatService) recountUnread(ctx context.Context, roomID, userID string) (models.ReadCursor, error) {
+	collection := s.store.Collection("read_cursors")
+	id := readCursorID(roomID, userID)
+	for attempt := 0; ; attempt++ {
+		var cursor models.ReadCursor
+		if err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&cursor); err != nil {
+			return models.ReadCursor{}, err
+		}
+		countedSeq, err := s.roomMessageSeq(ctx, roomID)
+		if err != nil {
+			return models.ReadCursor{}, err
+		}
+		// 已分配但尚未寫入的消息不會被計入，其遞增也會被跳過；稍等它們寫入後再計算
+		settled, err := s.seqsSettled(ctx, roomID, cursor.LastReadSeq, countedSeq)
+		if err != nil {
+			return models.ReadCursor{}, err
+		}
+		if !settled && attempt < recountMaxAttempts {
+			time.Sleep(recountSettleDelay)
+			continue
+		}
+
+		unread, mentions, err := s.countUnread(ctx, roomID, userID, &cursor, countedSeq)
+		if err != nil {
+			return models.ReadCursor{}, err
+		}
+
+		version := bson.M{"$exists": false}
+		if cursor.CountsVersion != 0 {
+			version = bson.M{"$eq": cursor.CountsVersion}
+		}
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": id, "counts_version": version},
+			bson.M{
+				"$set": bson.M{"unread_count": unread, "mention_count": mentions, "counts_seq": countedSeq},
+				"$inc": bson.M{"counts_version": 1},
+			})
+		if err != nil {
+			return models.ReadCursor{}, err
+		}
+		if result.MatchedCount > 0 {
+			cursor.UnreadCount, cursor.MentionCount, cursor.CountsSeq = unread, mentions, countedSeq
+			return cursor, nil
+		}
+		if attempt >= recountMaxAttempts {
+			// 計數一直在變動，保留遞增的結果，下次移動已讀位置時再修正
+			log.Printf("Gave up recounting unread of user %s in room %s", userID, roomID)
+			return cursor, nil
+		}
+	}
+}
+
+// roomMessageSeq 返回聊天室目前已分配的最大消息序號
+func (s *ChatService) roomMessageSeq(ctx context.Context, roomID string) (int64, error) {
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return 0, ErrRoomNotFound
+	}
+	var counter roomMessageCounter
+	err = s.store.Collection("chat_rooms").FindOne(ctx, bson.M{"_id": roomObjectID},
+		options.FindOne().SetProjection(bson.M{"message_seq": 1})).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrRoomNotFound
+	}
+	return counter.MessageSeq, err
+}
+
+// seqsSettled 檢查 (afterSeq, toSeq] 區間內的序號是否都已寫入消息或記錄了墓碑
+func (s *ChatService) seqsSettled(ctx context.Context, roomID string, afterSeq, toSeq int64) (bool, error) {
+	if toSeq <= afterSeq {
+		return true, nil
+	}
+	filter := bson.M{"room": roomID, "seq": bson.M{"$gt": afterSeq, "$lte": toSeq}}
+	messages, err := s.store.Collection("messages").CountDocuments(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	if messages >= toSeq-afterSeq {
+		return true, nil
+	}
+	tombstones, err := s.store.Collection("message_tombstones").CountDocuments(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	// 過期的消息在刪除前先寫入墓碑，兩者可能同時存在
+	return messages+tombstones >= toSeq-afterSeq, nil
+}
+
+// resolveReadPosition 找到已讀位置對應的消息；指定的序號已被刪除時使用其之前最近的一條
+func (s *ChatService) resolveReadPosition(ctx context.Context, roomID string, position ReadPosition) (models.Message, error) {
+	collection := s.store.Collection("messages")
+	projection := bson.M{"_id": 1, "seq": 1, "timestamp": 1}
+
+	var message models.Message
+	var err error
+	switch {
+	case position.MessageID != "":
+		messageObjectID, parseErr := primitive.ObjectIDFromHex(position.MessageID)
+		if parseErr != nil {
+			return models.Message{}, ErrInvalidReadPosition
+		}
+		err = collection.FindOne(ctx, bson.M{"_id": messageObjectID, "room": roomID},
+			options.FindOne().SetProjection(projection)).Decode(&message)
+	case position.Seq > 0:
+		err = collection.FindOne(ctx, bson.M{"room": roomID, "seq": bson.M{"$lte": position.Seq}},
+			options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}}).SetProjection(projection)).Decode(&message)
+	default:
+		err = collection.FindOne(ctx, bson.M{"room": roomID},
+			options.FindOne().SetSort(bson.D{{Key: "seq", Value: -1}, {Key: "timestamp", Value: -1}}).SetProjection(projection)).Decode(&message)
+		if err == mongo.ErrNoDocuments {
+			return models.Message{}, nil // 聊天室還沒有消息
+		}
+	}
+	if err == mongo.ErrNoDocuments {
+		return models.Message{}, ErrInvalidReadPosition
+	}
+	return message, err
+}
+
+// GetReadCursor 獲取用戶在聊天室中的已讀位置，沒有記錄時返回 nil
+func (s *ChatService) GetReadCursor(ctx context.Context, roomID, userID string) (*models.ReadCursor, error) {
+	var cursor models.ReadCursor
+	err := s.store.Collection("read_cursors").FindOne(ctx, bson.M{"_id": readCursorID(roomID, userID)}).Decode(&cursor)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// GetRoomReadCursors 獲取聊天室中所有成員的已讀位置；since 不為空時只返回之後有變化的
+func (s *ChatService) GetRoomReadCursors(ctx context.Context, roomID string, since *time.Time) ([]models.ReadCursor, error) {
+	filter := bson.M{"room_id": roomID}
+	if since != nil {
+		filter["updated_at"] = bson.M{"$gt": *since}
+	}
+	cursor, err := s.store.Collection("read_cursors").Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var cursors []models.ReadCursor
+	if err := cursor.All(ctx, &cursors); err != nil {
+		return nil, err
+	}
+	return cursors, nil
+}
+
+// HasRead 判斷已讀位置是否已經涵蓋某條消息；沒有序號的舊消息按發送時間比較
+func HasRead(cursor models.ReadCursor, message models.Message) bool {
+	if message.Seq > 0 && cursor.LastReadSeq > 0 {
+		return message.Seq <= cursor.LastReadSeq
+	}
+	return !cursor.LastReadAt.IsZero() && !message.Timestamp.After(cursor.LastReadAt)
+}
+
+// ApplyReadCursors 根據各聊天室的已讀位置填充消息的 ReadBy，保留舊版本直接寫入的已讀記錄
+func (s *ChatService) ApplyReadCursors(ctx context.Context, messages []models.Message) error {
+	cursorsByRoom := map[string][]models.ReadCursor{}
+	for i := range messages {
+		msg := &messages[i]
+		cursors, loaded := cursorsByRoom[msg.Room]
+		if !loaded {
+			var err error
+			cursors, err = s.GetRoomReadCursors(ctx, msg.Room, nil)
+			if err != nil {
+				return err
+			}
+			cursorsByRoom[msg.Room] = cursors
+		}
+
+		readers := map[string]bool{}
+		for _, readerID := range msg.ReadBy {
+			readers[readerID] = true
+		}
+		for _, cursor := range cursors {
+			if cursor.UserID != msg.SenderID && !readers[cursor.UserID] && HasRead(cursor, *msg) {
+				readers[cursor.UserID] = true
+				msg.ReadBy = append(msg.ReadBy, cursor.UserID)
+			}
+		}
+		if msg.ReadBy == nil {
+			msg.ReadBy = []string{}
+		}
+	}
+	return nil
+}
+
+// ReadCursorPayload 構建 "message_read" 廣播事件的內容
+func ReadCursorPayload(cursor models.ReadCursor) map[string]interface{} {
+	return map[string]interface{}{
+		"room":                 cursor.RoomID,
+		"user_id":              cursor.UserID,
+		"last_read_message_id": cursor.LastReadMessageID,
+		"last_read_seq":        cursor.LastReadSeq,
+		"timestamp":            cursor.UpdatedAt.Format(time.RFC3339),
+	}
+}
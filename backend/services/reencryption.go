@@ -0,0 +1,467 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+	"chatwme/backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	reencryptionBatchSize     = 200
+	reencryptionBatchPause    = 100 * time.Millisecond // 每批之間的間隔，避免佔滿資料庫
+	reencryptionLease         = 2 * time.Minute        // 持有任務的實例超過此時間未更新進度，其他實例可接手
+	reencryptionRetryInterval = time.Minute
+
+	// reencryptionVersion 遷移內容有變化時遞增，使已完成的任務以新的規則重新執行一次
+	// 2：聊天室內容改用各聊天室的資料密鑰
+	// 3：為建立搜尋索引之前保存的文字消息補建索引
+	reencryptionVersion = 3
+)
+
+// reencryptionTarget 需要重新加密的集合與欄位，按順序處理
+// 聊天室內容遷移到各聊天室的資料密鑰；聊天室密鑰本身以當前主密鑰重新包裝
+type reencryptionTarget struct {
+	Collection  string
+	Field       string
+	RoomField   string // 記錄所屬聊天室 ID 的欄位，為空表示以主密鑰加密
+	History     bool   // 同時處理消息的編輯歷史
+	Plaintext   bool   // 無法解密時視為加密前保存的明文，例如舊的聊天室預覽
+	SearchIndex bool   // 為缺少搜尋索引的文字消息補建索引
+	Filter      bson.M // 額外的篩選條件
+}
+
+var reencryptionTargets = []reencryptionTarget{
+	{Collection: "room_keys", Field: "wrapped_key"},
+	{Collection: "messages", Field: "content", RoomField: "room", History: true, SearchIndex: true,
+		Filter: bson.M{"type": bson.M{"$ne": models.MessageTypeE2E}}}, // 端到端加密消息由客戶端加密
+	{Collection: "scheduled_messages", Field: "content", RoomField: "room_id"},
+	{Collection: "chat_rooms", Field: "last_message", RoomField: "_id", Plaintext: true},
+}
+
+// RunReencryptionWorker 將既有的密文遷移到當前密鑰，完成後退出
+// 進度保存在資料庫中，重啟或由其他實例接手時從中斷處繼續；所有實例需使用相同的 ENCRYPTION_KEY_ID
+func (s *ChatService) RunReencryptionWorker(ctx context.Context) {
+	workerID := primitive.NewObjectID().Hex()
+	ticker := time.NewTicker(reencryptionRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		finished, err := s.runReencryption(ctx, workerID)
+		if err != nil {
+			log.Printf("Re-encryption to key %s interrupted: %v", s.keyring.ActiveKeyID(), err)
+		}
+		if finished {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runReencryption 取得任務並逐批處理；返回 true 表示任務已完成，不需要再嘗試
+func (s *ChatService) runReencryption(ctx context.Context, workerID string) (bool, error) {
+	job, err := s.acquireReencryptionJob(ctx, workerID)
+	if err != nil || job == nil {
+		return false, err
+	}
+	if job.Status == models.ReencryptionStatusCompleted {
+		return true, nil
+	}
+	defer s.releaseReencryptionJob(job.ID, workerID)
+
+	if job.Total == 0 && job.Processed == 0 {
+		if job.Total, err = s.countReencryptionTotal(ctx); err != nil {
+			return false, err
+		}
+	}
+	log.Printf("Re-encryption worker %s running job %s from %s after %s (%d/%d)",
+		workerID, job.ID, job.Collection, job.LastID.Hex(), job.Processed, job.Total)
+
+	for ctx.Err() == nil {
+		index := reencryptionTargetIndex(job.Collection)
+		if index < 0 {
+			return false, fmt.Errorf("unknown collection %q in re-encryption job", job.Collection)
+		}
+		target := reencryptionTargets[index]
+
+		count, lastID, migrated, indexed, failed, err := s.reencryptBatch(ctx, target, job.LastID)
+		if err != nil {
+			return false, err
+		}
+		job.Processed += int64(count)
+		job.Migrated += int64(migrated)
+		job.Indexed += int64(indexed)
+		job.Failed += int64(failed)
+		job.LastID = lastID
+		if count < reencryptionBatchSize {
+			// 目前集合已處理完，轉到下一個集合
+			if index+1 < len(reencryptionTargets) {
+				job.Collection = reencryptionTargets[index+1].Collection
+				job.LastID = primitive.NilObjectID
+			} else {
+				job.Status = models.ReencryptionStatusCompleted
+			}
+		}
+
+		saved, err := s.saveReencryptionProgress(ctx, job, workerID)
+		if err != nil {
+			return false, err
+		}
+		if !saved {
+			log.Printf("Re-encryption worker %s lost its lease on job %s", workerID, job.ID)
+			return false, nil
+		}
+		if job.Status == models.ReencryptionStatusCompleted {
+			log.Printf("Re-encryption job %s completed: %d processed, %d migrated, %d indexed, %d failed",
+				job.ID, job.Processed, job.Migrated, job.Indexed, job.Failed)
+			return true, nil
+		}
+		if count > 0 {
+			log.Printf("Re-encryption job %s: %s %d/%d", job.ID, job.Collection, job.Processed, job.Total)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(reencryptionBatchPause):
+		}
+	}
+	return false, ctx.Err()
+}
+
+// acquireReencryptionJob 取得當前密鑰的遷移任務並續租；任務已完成時原樣返回，由其他實例持有時返回 nil
+func (s *ChatService) acquireReencryptionJob(ctx context.Context, workerID string) (*models.ReencryptionJob, error) {
+	collection := s.store.Collection("reencryption_jobs")
+	keyID := s.keyring.ActiveKeyID()
+	jobID := fmt.Sprintf("%s@%d", keyID, reencryptionVersion)
+	if s.SearchEnabled() {
+		// 停用搜尋時完成的任務沒有建立索引，之後啟用搜尋需要再執行一次
+		jobID += "+search"
+	}
+	now := time.Now()
+
+	filter := bson.M{
+		"_id":    jobID,
+		"status": models.ReencryptionStatusRunning,
+		"$or": []bson.M{
+			{"locked_until": bson.M{"$lt": now}},
+			{"locked_by": workerID},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"locked_by":    workerID,
+			"locked_until": now.Add(reencryptionLease),
+			"updated_at":   now,
+		},
+		"$setOnInsert": bson.M{
+			"key_id":     keyID,
+			"status":     models.ReencryptionStatusRunning,
+			"collection": reencryptionTargets[0].Collection,
+			"last_id":    primitive.NilObjectID,
+			"total":      int64(0),
+			"processed":  int64(0),
+			"migrated":   int64(0),
+			"indexed":    int64(0),
+			"failed":     int64(0),
+			"started_at": now,
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var job models.ReencryptionJob
+	err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == nil {
+		return &job, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	// 條件不成立而插入失敗：任務已完成或由其他實例持有
+	if err := collection.FindOne(ctx, bson.M{"_id": jobID}).Decode(&job); err != nil {
+		return nil, err
+	}
+	if job.Status == models.ReencryptionStatusCompleted {
+		return &job, nil
+	}
+	return nil, nil
+}
+
+// saveReencryptionProgress 保存進度並續租，只在仍由本實例持有時生效
+func (s *ChatService) saveReencryptionProgress(ctx context.Context, job *models.ReencryptionJob, workerID string) (bool, error) {
+	now := time.Now()
+	set := bson.M{
+		"status":       job.Status,
+		"collection":   job.Collection,
+		"last_id":      job.LastID,
+		"total":        job.Total,
+		"processed":    job.Processed,
+		"migrated":     job.Migrated,
+		"indexed":      job.Indexed,
+		"failed":       job.Failed,
+		"locked_until": now.Add(reencryptionLease),
+		"updated_at":   now,
+	}
+	if job.Status == models.ReencryptionStatusCompleted {
+		set["completed_at"] = now
+	}
+	result, err := s.store.Collection("reencryption_jobs").UpdateOne(ctx,
+		bson.M{"_id": job.ID, "locked_by": workerID},
+		bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+// releaseReencryptionJob 停止時釋放租約，讓其他實例可以立即接手
+func (s *ChatService) releaseReencryptionJob(keyID, workerID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.store.Collection("reencryption_jobs").UpdateOne(ctx,
+		bson.M{"_id": keyID, "locked_by": workerID},
+		bson.M{"$set": bson.M{"locked_until": time.Time{}}, "$unset": bson.M{"locked_by": ""}})
+	if err != nil {
+		log.Printf("Failed to release re-encryption job %s: %v", keyID, err)
+	}
+}
+
+func (s *ChatService) countReencryptionTotal(ctx context.Context) (int64, error) {
+	var total int64
+	for _, target := range reencryptionTargets {
+		count, err := s.store.Collection(target.Collection).EstimatedDocumentCount(ctx)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+func reencryptionTargetIndex(collection string) int {
+	for i, target := range reencryptionTargets {
+		if target.Collection == collection {
+			return i
+		}
+	}
+	return -1
+}
+
+// reencryptBatch 處理 afterID 之後的一批記錄，返回處理數、最後一條記錄的 ID、重新加密數、補建索引數與失敗數
+func (s *ChatService) reencryptBatch(ctx context.Context, target reencryptionTarget, afterID primitive.ObjectID) (int, primitive.ObjectID, int, int, int, error) {
+	projection := bson.M{target.Field: 1}
+	if target.RoomField != "" {
+		projection[target.RoomField] = 1
+	}
+	if target.History {
+		projection["edit_history"] = 1
+	}
+	indexSearch := target.SearchIndex && s.SearchEnabled()
+	if indexSearch {
+		projection["type"] = 1
+		projection["search_tokens"] = 1
+	}
+	filter := bson.M{"_id": bson.M{"$gt": afterID}}
+	for key, value := range target.Filter {
+		filter[key] = value
+	}
+	collection := s.store.Collection(target.Collection)
+	cursor, err := collection.Find(ctx, filter,
+		options.Find().
+			SetSort(bson.D{{Key: "_id", Value: 1}}).
+			SetLimit(reencryptionBatchSize).
+			SetProjection(projection))
+	if err != nil {
+		return 0, afterID, 0, 0, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	count, migrated, indexed, failed := 0, 0, 0, 0
+	lastID := afterID
+	for cursor.Next(ctx) {
+		var record struct {
+			ID          primitive.ObjectID   `bson:"_id"`
+			Type        string               `bson:"type"`
+			EditHistory []models.MessageEdit `bson:"edit_history"`
+		}
+		if err := cursor.Decode(&record); err != nil {
+			return count, lastID, migrated, indexed, failed, err
+		}
+		count++
+		lastID = record.ID
+
+		value, _ := cursor.Current.Lookup(target.Field).StringValueOK()
+		roomID := ""
+		if target.RoomField == "_id" {
+			roomID = record.ID.Hex()
+		} else if target.RoomField != "" {
+			roomID, _ = cursor.Current.Lookup(target.RoomField).StringValueOK()
+		}
+		filter := bson.M{"_id": record.ID}
+		set := bson.M{}
+		recordFailed := false
+
+		fields := map[string]string{target.Field: value}
+		if target.History {
+			for i, edit := range record.EditHistory {
+				fields[fmt.Sprintf("edit_history.%d.content", i)] = edit.Content
+			}
+		}
+		for field, ciphertext := range fields {
+			reencrypted, changed, err := s.reencryptValue(ctx, target, roomID, ciphertext)
+			if err != nil {
+				recordFailed = true
+				continue
+			}
+			if changed {
+				// 以舊密文作為條件，期間被編輯的記錄已由新寫入使用當前密鑰
+				filter[field] = ciphertext
+				set[field] = reencrypted
+			}
+		}
+
+		// 建立搜尋索引之前保存的文字消息沒有詞元；以原內容作為條件，期間被編輯的消息已由編輯寫入新的詞元
+		indexing := false
+		if indexSearch && record.Type == models.MessageTypeText && value != "" {
+			if _, err := cursor.Current.LookupErr("search_tokens"); err != nil {
+				if plaintext, err := s.DecryptContent(ctx, roomID, value); err != nil {
+					recordFailed = true
+				} else {
+					filter[target.Field] = value
+					filter["search_tokens"] = bson.M{"$exists": false}
+					set["search_tokens"] = s.SearchTokens(plaintext)
+					indexing = true
+				}
+			}
+		}
+
+		if recordFailed {
+			failed++
+			log.Printf("Re-encryption skipped undecryptable data in %s %s", target.Collection, record.ID.Hex())
+		}
+		if len(set) == 0 {
+			continue
+		}
+
+		result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+		if err != nil {
+			return count, lastID, migrated, indexed, failed, err
+		}
+		if result.ModifiedCount > 0 {
+			if indexing {
+				indexed++
+			}
+			if len(set) > 1 || !indexing {
+				migrated++
+			}
+		}
+	}
+	return count, lastID, migrated, indexed, failed, cursor.Err()
+}
+
+// reencryptValue 重新加密一個密文；已使用目標密鑰或為空時不變
+func (s *ChatService) reencryptValue(ctx context.Context, target reencryptionTarget, roomID, ciphertext string) (string, bool, error) {
+	if ciphertext == "" {
+		return ciphertext, false, nil
+	}
+	if target.RoomField == "" {
+		if s.keyring.IsCurrent(ciphertext) {
+			return ciphertext, false, nil
+		}
+		plaintext, err := s.keyring.Decrypt(ciphertext)
+		if err != nil {
+			return "", false, err
+		}
+		reencrypted, err := s.keyring.Encrypt(plaintext)
+		return reencrypted, err == nil, err
+	}
+
+	if utils.IsDataKeyCiphertext(ciphertext) {
+		return ciphertext, false, nil
+	}
+	plaintext, err := s.keyring.Decrypt(ciphertext)
+	if err != nil {
+		if !target.Plaintext {
+			return "", false, err
+		}
+		plaintext = ciphertext
+	}
+	reencrypted, err := s.EncryptContent(ctx, roomID, plaintext)
+	if err != nil {
+		return "", false, err
+	}
+	return reencrypted, true, nil
+}
+
+// GetReencryptionJobs 列出所有重新加密任務及其進度，最新的在前
+func (s *ChatService) GetReencryptionJobs(ctx context.Context) ([]map[string]interface{}, error) {
+	cursor, err := s.store.Collection("reencryption_jobs").Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "started_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var jobs []models.ReencryptionJob
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]interface{}, 0, len(jobs))
+	for _, job := range jobs {
+		results = append(results, ReencryptionJobPayload(job))
+	}
+	return results, nil
+}
+
+// ReencryptionJobPayload 構建返回給客戶端的任務進度
+func ReencryptionJobPayload(job models.ReencryptionJob) map[string]interface{} {
+	progress := 0.0
+	switch {
+	case job.Status == models.ReencryptionStatusCompleted:
+		progress = 100
+	case job.Total > 0:
+		// 開始後新增的記錄會使處理數超過估計總數
+		progress = float64(job.Processed) * 100 / float64(job.Total)
+		if progress > 99 {
+			progress = 99
+		}
+	}
+
+	payload := map[string]interface{}{
+		"id":         job.ID,
+		"key_id":     job.KeyID,
+		"status":     job.Status,
+		"collection": job.Collection,
+		"total":      job.Total,
+		"processed":  job.Processed,
+		"migrated":   job.Migrated,
+		"indexed":    job.Indexed,
+		"failed":     job.Failed,
+		"progress":   progress,
+		"started_at": job.StartedAt.Format(time.RFC3339),
+		"updated_at": job.UpdatedAt.Format(time.RFC3339),
+	}
+	if job.CompletedAt != nil {
+		payload["completed_at"] = job.CompletedAt.Format(time.RFC3339)
+	}
+	return payload
+}
+
+// ActiveKeyID 返回新寫入使用的密鑰 ID
+func (s *ChatService) ActiveKeyID() string {
+	return s.keyring.ActiveKeyID()
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"chatwme/backend/models"
+	"chatwme/backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// roomKeyCacheTTL 解包後的聊天室密鑰在記憶體中保留的時間
+// 其他實例銷毀密鑰後，本實例最多在這段時間內仍能解密
+const roomKeyCacheTTL = 5 * time.Minute
+
+var ErrRoomKeyShredded = errors.New("聊天室的加密密鑰已銷毀")
+
+type cachedRoomKey struct {
+	key      []byte
+	loadedAt time.Time
+}
+
+// roomKeyCache 緩存解包後的聊天室密鑰，避免每次加解密都查詢資料庫
+type roomKeyCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedRoomKey
+}
+
+func (c *roomKeyCache) get(roomID string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[roomID]
+	if !ok || time.Since(entry.loadedAt) > roomKeyCacheTTL {
+		return nil, false
+	}
+	return entry.key, true
+}
+
+func (c *roomKeyCache) put(roomID string, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedRoomKey)
+	}
+	c.entries[roomID] = cachedRoomKey{key: key, loadedAt: time.Now()}
+}
+
+func (c *roomKeyCache) evict(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, roomID)
+}
+
+// EncryptContent 使用聊天室的資料密鑰加密內容，聊天室還沒有密鑰時建立一把
+func (s *ChatService) EncryptContent(ctx context.Context, roomID, plaintext string) (string, error) {
+	key, err := s.roomDataKey(ctx, roomID, true)
+	if err != nil {
+		return "", err
+	}
+	return utils.EncryptWithDataKey(plaintext, key)
+}
+
+// DecryptContent 解密聊天室中的內容
+// 以聊天室密鑰加密的內容在密鑰銷毀後返回 ErrRoomKeyShredded；引入聊天室密鑰之前的內容使用主密鑰環解密
+func (s *ChatService) DecryptContent(ctx context.Context, roomID, ciphertext string) (string, error) {
+	if !utils.IsDataKeyCiphertext(ciphertext) {
+		return s.keyring.Decrypt(ciphertext)
+	}
+	key, err := s.roomDataKey(ctx, roomID, false)
+	if err != nil {
+		return "", err
+	}
+	return utils.DecryptWithDataKey(ciphertext, key)
+}
+
+// roomDataKey 獲取聊天室的資料密鑰；create 為 true 且尚未建立時產生新密鑰並以主密鑰包裝保存
+func (s *ChatService) roomDataKey(ctx context.Context, roomID string, create bool) ([]byte, error) {
+	if key, ok := s.roomKeys.get(roomID); ok {
+		return key, nil
+	}
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return nil, ErrRoomNotFound
+	}
+
+	collection := s.store.Collection("room_keys")
+	var record models.RoomKey
+	err = collection.FindOne(ctx, bson.M{"_id": roomObjectID}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		if !create {
+			return nil, ErrRoomKeyShredded
+		}
+		return s.createRoomDataKey(ctx, roomObjectID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.unwrapRoomKey(record)
+}
+
+// createRoomDataKey 建立聊天室密鑰；多個實例同時建立時以先寫入的為準
+func (s *ChatService) createRoomDataKey(ctx context.Context, roomID primitive.ObjectID) ([]byte, error) {
+	key, err := utils.GenerateDataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := s.keyring.Encrypt(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return nil, err
+	}
+
+	collection := s.store.Collection("room_keys")
+	record := models.RoomKey{ID: roomID, WrappedKey: wrapped, CreatedAt: time.Now()}
+	_, err = collection.InsertOne(ctx, record)
+	if err == nil {
+		s.roomKeys.put(roomID.Hex(), key)
+		return key, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	if err := collection.FindOne(ctx, bson.M{"_id": roomID}).Decode(&record); err != nil {
+		return nil, err
+	}
+	return s.unwrapRoomKey(record)
+}
+
+func (s *ChatService) unwrapRoomKey(record models.RoomKey) ([]byte, error) {
+	encoded, err := s.keyring.Decrypt(record.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	s.roomKeys.put(record.ID.Hex(), key)
+	return key, nil
+}
+
+// preloadRoomKeys 一次載入多個聊天室的密鑰，用於解密聊天室列表
+func (s *ChatService) preloadRoomKeys(ctx context.Context, roomIDs []primitive.ObjectID) {
+	missing := make([]primitive.ObjectID, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if _, ok := s.roomKeys.get(roomID.Hex()); !ok {
+			missing = append(missing, roomID)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	cursor, err := s.store.Collection("room_keys").Find(ctx, bson.M{"_id": bson.M{"$in": missing}})
+	if err != nil {
+		log.Printf("Failed to load room keys: %v", err)
+		return
+	}
+	var records []models.RoomKey
+	if err := cursor.All(ctx, &records); err != nil {
+		log.Printf("Failed to load room keys: %v", err)
+		return
+	}
+	for _, record := range records {
+		if _, err := s.unwrapRoomKey(record); err != nil {
+			log.Printf("Failed to unwrap key of room %s: %v", record.ID.Hex(), err)
+		}
+	}
+}
+
+// ShredRoomKey 刪除聊天室密鑰，之後該聊天室的所有歷史內容（包括備份中的）都無法再解密
+func (s *ChatService) ShredRoomKey(ctx context.Context, roomID primitive.ObjectID) error {
+	if _, err := s.store.Collection("room_keys").DeleteOne(ctx, bson.M{"_id": roomID}); err != nil {
+		return err
+	}
+	s.roomKeys.evict(roomID.Hex())
+	return nil
+}
+
+// PurgeRoom 銷毀聊天室密鑰並刪除聊天室及其所有消息，用於解散群組或清除私聊
+// 密鑰最先刪除：即使之後的步驟失敗，或資料仍留在備份中，內容也已無法解密
+func (s *ChatService) PurgeRoom(ctx context.Context, roomID primitive.ObjectID) error {
+	if err := s.ShredRoomKey(ctx, roomID); err != nil {
+		return err
+	}
+
+	roomHex := roomID.Hex()
+	cleanups := []struct {
+		collection string
+		filter     bson.M
+	}{
+		{"messages", bson.M{"room": roomHex}},
+		{"scheduled_messages", bson.M{"room_id": roomHex}},
+		{"read_cursors", bson.M{"room_id": roomHex}},
+		{"pending_deliveries", bson.M{"room_id": roomHex}},
+		{"group_invitations", bson.M{"group_id": roomID}},
+	}
+	for _, cleanup := range cleanups {
+		if _, err := s.store.Collection(cleanup.collection).DeleteMany(ctx, cleanup.filter); err != nil {
+			log.Printf("Failed to purge %s of room %s: %v", cleanup.collection, roomHex, err)
+		}
+	}
+	if err := GetStorageService().DeleteDirectory(roomMediaDir(roomHex)); err != nil {
+		log.Printf("Failed to delete media of room %s: %v", roomHex, err)
+	}
+	if _, err := s.store.Collection("chat_rooms").DeleteOne(ctx, bson.M{"_id": roomID}); err != nil {
+		return err
+	}
+
+	s.BroadcastToRoom(roomHex, "room_deleted", map[string]interface{}{"room": roomHex})
+	s.EvictFromRoom(ctx, roomHex, "")
+	return nil
+}
+
+// PurgeUserDirectChats 清除用戶參與的所有私聊，用於刪除帳號
+func (s *ChatService) PurgeUserDirectChats(ctx context.Context, userID string) error {
+	cursor, err := s.store.Collection("chat_rooms").Find(ctx, bson.M{
+		"is_group":     bson.M{"$ne": true},
+		"participants": userID,
+	}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var rooms []models.ChatRoom
+	if err := cursor.All(ctx, &rooms); err != nil {
+		return err
+	}
+
+	for _, room := range rooms {
+		if err := s.PurgeRoom(ctx, room.ID); err != nil {
+			return err
+		}
+	}
+	if len(rooms) > 0 {
+		log.Printf("Purged %d direct chats of user %s", len(rooms), userID)
+	}
+	return nil
+}
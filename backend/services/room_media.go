@@ -0,0 +1,197 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"chatwme/backend/models"
+	"chatwme/backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// roomMediaRoot 聊天室加密媒體在存儲中的目錄，每個聊天室一個子目錄
+const roomMediaRoot = "rooms"
+
+var ErrMediaNotFound = errors.New("媒體文件不存在")
+
+func roomMediaDir(roomID string) string {
+	return path.Join(roomMediaRoot, roomID)
+}
+
+// RoomMediaURL 聊天室加密媒體的下載地址，需要登入並且是聊天室成員才能下載
+func RoomMediaURL(roomID, name string) string {
+	return fmt.Sprintf("/api/v1/rooms/%s/media/%s", roomID, name)
+}
+
+// parseRoomMediaURL 從媒體地址中取出聊天室 ID 與文件名；不是聊天室媒體地址時 ok 為 false
+func parseRoomMediaURL(fileURL string) (roomID, name string, ok bool) {
+	_, rest, found := strings.Cut(fileURL, "/api/v1/rooms/")
+	if !found {
+		return "", "", false
+	}
+	roomID, name, found = strings.Cut(rest, "/media/")
+	if !found || roomID == "" || !validMediaName(name) {
+		return "", "", false
+	}
+	return roomID, name, true
+}
+
+// roomMediaFilePath 返回聊天室媒體在存儲中的相對路徑，不是聊天室媒體時返回空字串
+func roomMediaFilePath(fileURL string) string {
+	roomID, name, ok := parseRoomMediaURL(fileURL)
+	if !ok {
+		return ""
+	}
+	return path.Join(roomMediaDir(roomID), name)
+}
+
+func validMediaName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}
+
+// StoreRoomMedia 以聊天室密鑰分段加密並保存上傳的媒體文件，返回下載地址與原始大小
+// 以串流方式處理，記憶體中只保留一兩段，不需要載入整個文件
+func (s *ChatService) StoreRoomMedia(ctx context.Context, roomID, ext string, r io.Reader) (string, int64, error) {
+	key, err := s.roomDataKey(ctx, roomID, true)
+	if err != nil {
+		return "", 0, err
+	}
+
+	storage := GetStorageService()
+	name := primitive.NewObjectID().Hex() + strings.ToLower(ext)
+	filePath := path.Join(roomMediaDir(roomID), name)
+	file, err := storage.CreateFile(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := utils.EncryptStream(file, r, key)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		storage.DeleteFile(filePath)
+		return "", 0, err
+	}
+	return RoomMediaURL(roomID, name), size, nil
+}
+
+// roomMediaFile 解密中的媒體文件，關閉時一併關閉底層文件
+type roomMediaFile struct {
+	*utils.DecryptingReader
+	file *os.File
+}
+
+func (f *roomMediaFile) Close() error {
+	return f.file.Close()
+}
+
+// legacyMediaFile 整體加密的舊媒體文件，已在記憶體中解密
+type legacyMediaFile struct {
+	*bytes.Reader
+}
+
+func (legacyMediaFile) Close() error {
+	return nil
+}
+
+// OpenRoomMedia 打開聊天室的媒體文件，返回可隨機讀取的明文，讀取時只解密需要的段；調用者需要關閉
+// 密鑰已銷毀時返回 ErrRoomKeyShredded
+func (s *ChatService) OpenRoomMedia(ctx context.Context, roomID, name string) (io.ReadSeekCloser, error) {
+	if !validMediaName(name) {
+		return nil, ErrMediaNotFound
+	}
+	file, err := GetStorageService().OpenFile(path.Join(roomMediaDir(roomID), name))
+	if os.IsNotExist(err) {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	key, err := s.roomDataKey(ctx, roomID, false)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader, err := utils.NewDecryptingReader(file, info.Size(), key)
+	if errors.Is(err, utils.ErrNotEncryptedStream) {
+		// 分段加密之前上傳的文件以 EncryptBytes 整體加密，只能完整解密
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := utils.DecryptBytes(data, key)
+		if err != nil {
+			return nil, err
+		}
+		return legacyMediaFile{bytes.NewReader(plaintext)}, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &roomMediaFile{DecryptingReader: reader, file: file}, nil
+}
+
+// copyRoomMedia 將消息所在聊天室的媒體複製到另一個聊天室，並以目標聊天室的密鑰重新加密
+// 轉發後的副本因此不受來源聊天室銷毀的影響；不是該聊天室的媒體時原樣返回，避免借轉發讀取其他聊天室的文件
+func (s *ChatService) copyRoomMedia(ctx context.Context, message models.Message, fileURL, targetRoomID string) (string, error) {
+	sourceRoomID, name, ok := parseRoomMediaURL(fileURL)
+	if !ok || sourceRoomID != message.Room || sourceRoomID == targetRoomID {
+		return fileURL, nil
+	}
+	source, err := s.OpenRoomMedia(ctx, sourceRoomID, name)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	copiedURL, _, err := s.StoreRoomMedia(ctx, targetRoomID, path.Ext(name), source)
+	return copiedURL, err
+}
+
+// mediaFileURL 返回媒體消息的文件地址；部分消息只在加密內容的 JSON 中保存了地址
+func mediaFileURL(message models.Message, content string) string {
+	switch message.Type {
+	case models.MessageTypeVoice, models.MessageTypeImage, "video":
+	default:
+		return ""
+	}
+	if message.FileURL != "" {
+		return message.FileURL
+	}
+	var info struct {
+		FileURL string `json:"file_url"`
+	}
+	if err := json.Unmarshal([]byte(content), &info); err == nil {
+		return info.FileURL
+	}
+	return ""
+}
+
+// replaceFileURL 替換媒體消息內容 JSON 中的 file_url
+func replaceFileURL(content, fileURL string) string {
+	var info map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &info); err != nil {
+		return content
+	}
+	info["file_url"] = fileURL
+	updated, err := json.Marshal(info)
+	if err != nil {
+		return content
+	}
+	return string(updated)
+}
@@ -0,0 +1,292 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrRoomNotFound     = errors.New("聊天室不存在")
+	ErrPinNotAllowed    = errors.New("沒有置頂消息的權限")
+	ErrPinLimitReached  = errors.New("置頂消息已達上限")
+	ErrMessageNotPinned = errors.New("消息未被置頂")
+)
+
+// CanManageRoom 群組中只有建立者與管理員可以管理聊天室設定，私聊中任一參與者都可以
+func CanManageRoom(room models.ChatRoom, userID string) bool {
+	if !room.IsGroup {
+		if room.CreatedBy == userID {
+			return true
+		}
+		for _, participantID := range room.Participants {
+			if participantID == userID {
+				return true
+			}
+		}
+		return false
+	}
+
+	if room.CreatedBy == userID {
+		return true
+	}
+	for _, adminID := range room.Admins {
+		if adminID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// CanPinMessages 群組中只有管理員可以置頂，私聊中任一參與者都可以
+func CanPinMessages(room models.ChatRoom, userID string) bool {
+	return CanManageRoom(room, userID)
+}
+
+// PinMessage 置頂消息；已置頂的消息直接返回當前列表
+func (s *ChatService) PinMessage(ctx context.Context, roomID, messageID, userID string, maxPins int) ([]models.PinnedMessage, error) {
+	room, err := s.loadPinnableRoom(ctx, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	messageObjectID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+	err = s.store.Collection("messages").FindOne(ctx, bson.M{
+		"_id":        messageObjectID,
+		"room":       roomID,
+		"is_deleted": bson.M{"$ne": true},
+	}).Err()
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pin := range room.PinnedMessages {
+		if pin.MessageID == messageID {
+			return room.PinnedMessages, nil
+		}
+	}
+
+	// 以「第 maxPins 個元素不存在」作為條件，讓上限檢查與寫入在同一次原子操作中完成
+	filter := bson.M{
+		"_id":                        room.ID,
+		"pinned_messages.message_id": bson.M{"$ne": messageID},
+		fmt.Sprintf("pinned_messages.%d", maxPins-1): bson.M{"$exists": false},
+	}
+	update := bson.M{
+		"$push": bson.M{
+			"pinned_messages": bson.M{
+				"$each": []models.PinnedMessage{{
+					MessageID: messageID,
+					PinnedBy:  userID,
+					PinnedAt:  time.Now(),
+				}},
+				"$position": 0,
+			},
+		},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.ChatRoom
+	err = s.store.Collection("chat_rooms").FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments && s.pruneStalePins(ctx, room) {
+		// 已刪除的消息仍佔用名額，移除後再試一次
+		err = s.store.Collection("chat_rooms").FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
+	}
+	if err == mongo.ErrNoDocuments {
+		// 條件不成立：可能是同時被其他人置頂，也可能是已達上限
+		current, err := s.loadPinnableRoom(ctx, roomID, userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, pin := range current.PinnedMessages {
+			if pin.MessageID == messageID {
+				return current.PinnedMessages, nil
+			}
+		}
+		return nil, ErrPinLimitReached
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updated.PinnedMessages, nil
+}
+
+// pruneStalePins 移除指向已刪除或不存在消息的置頂記錄，例如刪除帳號時被匿名化的消息；返回是否有移除
+func (s *ChatService) pruneStalePins(ctx context.Context, room models.ChatRoom) bool {
+	if len(room.PinnedMessages) == 0 {
+		return false
+	}
+	messageIDs := make([]primitive.ObjectID, 0, len(room.PinnedMessages))
+	for _, pin := range room.PinnedMessages {
+		if objectID, err := primitive.ObjectIDFromHex(pin.MessageID); err == nil {
+			messageIDs = append(messageIDs, objectID)
+		}
+	}
+	visible, err := s.store.Collection("messages").Distinct(ctx, "_id", bson.M{
+		"_id":        bson.M{"$in": messageIDs},
+		"room":       room.ID.Hex(),
+		"is_deleted": bson.M{"$ne": true},
+	})
+	if err != nil {
+		log.Printf("Failed to check pinned messages of room %s: %v", room.ID.Hex(), err)
+		return false
+	}
+	keep := make(map[string]bool, len(visible))
+	for _, value := range visible {
+		if objectID, ok := value.(primitive.ObjectID); ok {
+			keep[objectID.Hex()] = true
+		}
+	}
+	var stale []string
+	for _, pin := range room.PinnedMessages {
+		if !keep[pin.MessageID] {
+			stale = append(stale, pin.MessageID)
+		}
+	}
+	if len(stale) == 0 {
+		return false
+	}
+
+	_, err = s.store.Collection("chat_rooms").UpdateOne(ctx,
+		bson.M{"_id": room.ID},
+		bson.M{"$pull": bson.M{"pinned_messages": bson.M{"message_id": bson.M{"$in": stale}}}})
+	if err != nil {
+		log.Printf("Failed to remove stale pins of room %s: %v", room.ID.Hex(), err)
+		return false
+	}
+	return true
+}
+
+// UnpinMessage 取消置頂消息
+func (s *ChatService) UnpinMessage(ctx context.Context, roomID, messageID, userID string) ([]models.PinnedMessage, error) {
+	room, err := s.loadPinnableRoom(ctx, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var updated models.ChatRoom
+	err = s.store.Collection("chat_rooms").FindOneAndUpdate(ctx,
+		bson.M{"_id": room.ID, "pinned_messages.message_id": messageID},
+		bson.M{"$pull": bson.M{"pinned_messages": bson.M{"message_id": messageID}}},
+		opts,
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrMessageNotPinned
+	}
+	if err != nil {
+		return nil, err
+	}
+	return updated.PinnedMessages, nil
+}
+
+// GetPinnedMessages 獲取聊天室置頂的消息（已解密），按置頂時間由新到舊排列
+func (s *ChatService) GetPinnedMessages(ctx context.Context, roomID string) ([]map[string]interface{}, error) {
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return nil, ErrRoomNotFound
+	}
+
+	var room models.ChatRoom
+	err = s.store.Collection("chat_rooms").FindOne(ctx, bson.M{"_id": roomObjectID}).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := []map[string]interface{}{}
+	if len(room.PinnedMessages) == 0 {
+		return pinned, nil
+	}
+
+	messageIDs := make([]primitive.ObjectID, 0, len(room.PinnedMessages))
+	for _, pin := range room.PinnedMessages {
+		if objectID, err := primitive.ObjectIDFromHex(pin.MessageID); err == nil {
+			messageIDs = append(messageIDs, objectID)
+		}
+	}
+
+	cursor, err := s.store.Collection("messages").Find(ctx, bson.M{
+		"_id":        bson.M{"$in": messageIDs},
+		"room":       roomID,
+		"is_deleted": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	formatted := map[string]map[string]interface{}{}
+	for _, messageObj := range s.FormatMessages(ctx, messages) {
+		formatted[messageObj["id"].(string)] = messageObj
+	}
+
+	// 按置頂順序輸出，已刪除的消息不再顯示
+	for _, pin := range room.PinnedMessages {
+		messageObj, exists := formatted[pin.MessageID]
+		if !exists {
+			continue
+		}
+		messageObj["pinned_by"] = pin.PinnedBy
+		messageObj["pinned_at"] = pin.PinnedAt.Format(time.RFC3339)
+		pinned = append(pinned, messageObj)
+	}
+	return pinned, nil
+}
+
+// PinsUpdatedPayload 構建 "pins_updated" 廣播事件的內容
+func PinsUpdatedPayload(roomID, messageID, userID, action string, pins []models.PinnedMessage) map[string]interface{} {
+	if pins == nil {
+		pins = []models.PinnedMessage{}
+	}
+	return map[string]interface{}{
+		"room":       roomID,
+		"message_id": messageID,
+		"user_id":    userID,
+		"action":     action,
+		"pins":       pins,
+	}
+}
+
+func (s *ChatService) loadPinnableRoom(ctx context.Context, roomID, userID string) (models.ChatRoom, error) {
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return models.ChatRoom{}, ErrRoomNotFound
+	}
+
+	var room models.ChatRoom
+	err = s.store.Collection("chat_rooms").FindOne(ctx, bson.M{"_id": roomObjectID}).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return models.ChatRoom{}, ErrRoomNotFound
+	}
+	if err != nil {
+		return models.ChatRoom{}, err
+	}
+
+	if !CanPinMessages(room, userID) {
+		return models.ChatRoom{}, ErrPinNotAllowed
+	}
+	return room, nil
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"chatwme/backend/models"
+	"chatwme/backend/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxPreviewRunes 聊天室列表中文字預覽的最大長度
+const maxPreviewRunes = 100
+
+// MessagePreview 返回聊天室列表中顯示的最後消息文字，所有預覽都應經過這裡生成
+// content 為解密後的內容；語音與視頻消息附帶時長，例如「[语音消息] 0:12」
+func MessagePreview(message models.Message, content string) string {
+	switch message.Type {
+	case models.MessageTypeVoice:
+		return withDuration("[语音消息]", mediaDuration(message, content))
+	case models.MessageTypeImage:
+		return "[图片]"
+	case "video":
+		return withDuration("[视频]", mediaDuration(message, content))
+	case models.MessageTypeE2E:
+		return "[加密消息]" // 伺服器無法讀取端到端加密的內容
+	default:
+		return truncateRunes(content, maxPreviewRunes)
+	}
+}
+
+// mediaDuration 讀取語音或視頻的時長（秒）；舊消息只在加密內容的 JSON 中保存了時長
+func mediaDuration(message models.Message, content string) int {
+	if message.Duration > 0 {
+		return message.Duration
+	}
+	var info struct {
+		Duration float64 `json:"duration"`
+	}
+	if err := json.Unmarshal([]byte(content), &info); err == nil && info.Duration > 0 {
+		return int(info.Duration)
+	}
+	return 0
+}
+
+func withDuration(label string, seconds int) string {
+	if seconds <= 0 {
+		return label
+	}
+	return fmt.Sprintf("%s %d:%02d", label, seconds/60, seconds%60)
+}
+
+// UpdateRoomPreview 以消息生成預覽並更新聊天室的最後消息
+func (s *ChatService) UpdateRoomPreview(ctx context.Context, roomID primitive.ObjectID, message models.Message, content string) error {
+	return s.UpdateRoomLastMessage(ctx, roomID, MessagePreview(message, content), message.Timestamp)
+}
+
+// RefreshRoomLastMessage 以聊天室中最新一條可見的消息重新計算預覽，用於最後一條消息被刪除、編輯或過期時
+func (s *ChatService) RefreshRoomLastMessage(ctx context.Context, roomID primitive.ObjectID) error {
+	var latest models.Message
+	err := s.store.Collection("messages").FindOne(ctx,
+		bson.M{"room": roomID.Hex(), "is_deleted": bson.M{"$ne": true}},
+		options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}),
+	).Decode(&latest)
+	if err == mongo.ErrNoDocuments {
+		_, err = s.store.Collection("chat_rooms").UpdateOne(ctx, bson.M{"_id": roomID}, bson.M{
+			"$set": bson.M{"last_message": "", "updated_at": time.Now()},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	content, err := s.DecryptMessage(ctx, latest)
+	if err != nil {
+		content = ""
+	}
+	return s.UpdateRoomPreview(ctx, roomID, latest, content)
+}
+
+// DecryptRoomPreview 解密聊天室的最後消息預覽
+// 加密前保存的舊預覽是明文，無法解密時原樣返回
+func (s *ChatService) DecryptRoomPreview(ctx context.Context, roomID, stored string) string {
+	if stored == "" {
+		return ""
+	}
+	preview, err := s.DecryptContent(ctx, roomID, stored)
+	if err != nil {
+		if utils.IsDataKeyCiphertext(stored) {
+			return "" // 聊天室密鑰已銷毀
+		}
+		return stored
+	}
+	return preview
+}
+
+// DecryptRoomPreviews 解密一組聊天室的最後消息預覽，用於返回給客戶端之前
+func (s *ChatService) DecryptRoomPreviews(ctx context.Context, rooms []models.ChatRoom) {
+	roomIDs := make([]primitive.ObjectID, 0, len(rooms))
+	for _, room := range rooms {
+		roomIDs = append(roomIDs, room.ID)
+	}
+	s.preloadRoomKeys(ctx, roomIDs)
+
+	for i := range rooms {
+		rooms[i].LastMessage = s.DecryptRoomPreview(ctx, rooms[i].ID.Hex(), rooms[i].LastMessage)
+	}
+}
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	scheduledClaimLease   = 2 * time.Minute  // 認領後未完成的任務超過此時間可被其他實例重新認領
+	scheduledMaxAttempts  = 5                // 暫時性錯誤的最多重試次數
+	scheduledRetryBackoff = 30 * time.Second // 第一次重試前的等待時間，之後每次加倍
+	scheduledBatchPerTick = 50               // 每輪最多處理的任務數
+)
+
+var (
+	ErrScheduledNotFound    = errors.New("定時消息不存在")
+	ErrScheduledNotEditable = errors.New("定時消息已發送或已取消")
+	ErrScheduleInPast       = errors.New("發送時間必須晚於現在")
+)
+
+// CreateScheduledMessage 建立定時文字消息，內容與普通消息一樣加密保存
+func (s *ChatService) CreateScheduledMessage(ctx context.Context, roomID, senderID, senderName, content string, sendAt time.Time) (models.ScheduledMessage, error) {
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return models.ScheduledMessage{}, ErrRoomNotFound
+	}
+	if !sendAt.After(time.Now()) {
+		return models.ScheduledMessage{}, ErrScheduleInPast
+	}
+	if err := s.CheckSendPermission(ctx, roomObjectID, senderID); err != nil {
+		return models.ScheduledMessage{}, err
+	}
+
+	encryptedContent, err := s.EncryptContent(ctx, roomID, content)
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+
+	now := time.Now()
+	job := models.ScheduledMessage{
+		ID:         primitive.NewObjectID(),
+		RoomID:     roomID,
+		SenderID:   senderID,
+		SenderName: senderName,
+		Content:    encryptedContent,
+		MessageID:  primitive.NewObjectID(),
+		SendAt:     sendAt,
+		Status:     models.ScheduledStatusPending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if _, err := s.store.Collection("scheduled_messages").InsertOne(ctx, job); err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	return job, nil
+}
+
+// ListScheduledMessages 列出用戶在聊天室中尚未發送的定時消息，按發送時間排列
+func (s *ChatService) ListScheduledMessages(ctx context.Context, roomID, senderID string) ([]map[string]interface{}, error) {
+	cursor, err := s.store.Collection("scheduled_messages").Find(ctx, bson.M{
+		"room_id":   roomID,
+		"sender_id": senderID,
+		"status":    bson.M{"$in": []string{models.ScheduledStatusPending, models.ScheduledStatusProcessing, models.ScheduledStatusFailed}},
+	}, options.Find().SetSort(bson.D{{Key: "send_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var jobs []models.ScheduledMessage
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+
+	results := make([]map[string]interface{}, 0, len(jobs))
+	for _, job := range jobs {
+		results = append(results, s.ScheduledMessagePayload(ctx, job))
+	}
+	return results, nil
+}
+
+// UpdateScheduledMessage 修改尚未發送的定時消息，content 與 sendAt 為 nil 時保持不變
+func (s *ChatService) UpdateScheduledMessage(ctx context.Context, roomID, scheduledID, senderID string, content *string, sendAt *time.Time) (models.ScheduledMessage, error) {
+	set := bson.M{"updated_at": time.Now()}
+	if content != nil {
+		encryptedContent, err := s.EncryptContent(ctx, roomID, *content)
+		if err != nil {
+			return models.ScheduledMessage{}, err
+		}
+		set["content"] = encryptedContent
+	}
+	if sendAt != nil {
+		if !sendAt.After(time.Now()) {
+			return models.ScheduledMessage{}, ErrScheduleInPast
+		}
+		set["send_at"] = *sendAt
+	}
+	return s.updatePendingScheduled(ctx, roomID, scheduledID, senderID, bson.M{"$set": set})
+}
+
+// CancelScheduledMessage 取消尚未發送的定時消息
+func (s *ChatService) CancelScheduledMessage(ctx context.Context, roomID, scheduledID, senderID string) (models.ScheduledMessage, error) {
+	return s.updatePendingScheduled(ctx, roomID, scheduledID, senderID, bson.M{"$set": bson.M{
+		"status":     models.ScheduledStatusCancelled,
+		"updated_at": time.Now(),
+	}})
+}
+
+// updatePendingScheduled 只修改仍處於 pending 的任務，已被認領的任務不能再變更
+func (s *ChatService) updatePendingScheduled(ctx context.Context, roomID, scheduledID, senderID string, update bson.M) (models.ScheduledMessage, error) {
+	scheduledObjectID, err := primitive.ObjectIDFromHex(scheduledID)
+	if err != nil {
+		return models.ScheduledMessage{}, ErrScheduledNotFound
+	}
+
+	collection := s.store.Collection("scheduled_messages")
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var job models.ScheduledMessage
+	err = collection.FindOneAndUpdate(ctx, bson.M{
+		"_id":       scheduledObjectID,
+		"room_id":   roomID,
+		"sender_id": senderID,
+		"status":    models.ScheduledStatusPending,
+	}, update, opts).Decode(&job)
+	if err == nil {
+		return job, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return models.ScheduledMessage{}, err
+	}
+
+	// 區分不存在與已經發送/取消
+	count, err := collection.CountDocuments(ctx, bson.M{
+		"_id":       scheduledObjectID,
+		"room_id":   roomID,
+		"sender_id": senderID,
+	})
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	if count == 0 {
+		return models.ScheduledMessage{}, ErrScheduledNotFound
+	}
+	return models.ScheduledMessage{}, ErrScheduledNotEditable
+}
+
+// ScheduledMessagePayload 構建返回給客戶端的定時消息內容
+func (s *ChatService) ScheduledMessagePayload(ctx context.Context, job models.ScheduledMessage) map[string]interface{} {
+	content, err := s.DecryptContent(ctx, job.RoomID, job.Content)
+	if err != nil {
+		log.Printf("Failed to decrypt scheduled message %s: %v", job.ID.Hex(), err)
+		content = "[無法解密的消息]"
+	}
+
+	payload := map[string]interface{}{
+		"id":         job.ID.Hex(),
+		"room":       job.RoomID,
+		"sender_id":  job.SenderID,
+		"content":    content,
+		"send_at":    job.SendAt.Format(time.RFC3339),
+		"status":     job.Status,
+		"message_id": job.MessageID.Hex(),
+		"created_at": job.CreatedAt.Format(time.RFC3339),
+		"updated_at": job.UpdatedAt.Format(time.RFC3339),
+	}
+	if job.Error != "" {
+		payload["error"] = job.Error
+	}
+	return payload
+}
+
+// ClaimDueScheduledMessage 以原子操作認領一條到期的任務，多個實例同時運行時每條任務只會被一個實例取得
+// 認領後超過租期仍未完成的任務（例如實例崩潰）可被重新認領
+func (s *ChatService) ClaimDueScheduledMessage(ctx context.Context, workerID string) (*models.ScheduledMessage, error) {
+	now := time.Now()
+	filter := bson.M{
+		"$or": []bson.M{
+			{"status": models.ScheduledStatusPending, "send_at": bson.M{"$lte": now}},
+			{"status": models.ScheduledStatusProcessing, "claimed_at": bson.M{"$lt": now.Add(-scheduledClaimLease)}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":     models.ScheduledStatusProcessing,
+			"claimed_by": workerID,
+			"claimed_at": now,
+			"updated_at": now,
+		},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "send_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var job models.ScheduledMessage
+	err := s.store.Collection("scheduled_messages").FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// DispatchScheduledMessage 發送已認領的任務，與用戶即時發送的流程一致
+func (s *ChatService) DispatchScheduledMessage(ctx context.Context, job models.ScheduledMessage) error {
+	content, err := s.DecryptContent(ctx, job.RoomID, job.Content)
+	if err != nil {
+		return s.finishScheduled(ctx, job, models.ScheduledStatusFailed, "decrypt_failed")
+	}
+
+	roomObjectID, err := primitive.ObjectIDFromHex(job.RoomID)
+	if err != nil {
+		return s.finishScheduled(ctx, job, models.ScheduledStatusFailed, "invalid_room")
+	}
+	// 排程之後用戶可能已離開聊天室或被封鎖，發送時再檢查一次
+	if err := s.CheckSendPermission(ctx, roomObjectID, job.SenderID); err != nil {
+		switch {
+		case errors.Is(err, ErrNotRoomMember):
+			return s.finishScheduled(ctx, job, models.ScheduledStatusFailed, "not_in_room")
+		case errors.Is(err, ErrSenderBlocked):
+			return s.finishScheduled(ctx, job, models.ScheduledStatusFailed, "blocked")
+		}
+		return s.retryScheduled(ctx, job, err)
+	}
+
+	mentions, mentionAll, err := s.ResolveMentions(ctx, roomObjectID, job.SenderID, content)
+	if err != nil {
+		log.Printf("Failed to resolve mentions for scheduled message %s: %v", job.ID.Hex(), err)
+		mentions, mentionAll = nil, false
+	}
+
+	// 使用預先分配的消息 ID，重新認領的任務不會重複寫入消息
+	saved, created, err := s.SaveMessageWithID(ctx, job.MessageID.Hex(), job.SenderID, job.SenderName, job.RoomID,
+		content, models.MessageTypeText, "", 0, 0, WithMentions(mentions, mentionAll))
+	if err != nil {
+		return s.retryScheduled(ctx, job, err)
+	}
+
+	// 消息已存在時也要廣播：上次認領的實例可能在寫入後、廣播前崩潰，客戶端以消息 ID 去重
+	if !created {
+		log.Printf("Scheduled message %s was already saved as %s, broadcasting again", job.ID.Hex(), saved.ID.Hex())
+	}
+	s.BroadcastToRoom(job.RoomID, "chat_message", BuildMessagePayload(saved, job.SenderName, content))
+	s.NotifyMentions(saved, content)
+
+	if err := s.UpdateRoomPreview(ctx, roomObjectID, saved, content); err != nil {
+		log.Printf("Failed to update room last message: %v", err)
+	}
+
+	log.Printf("Scheduled message %s sent to room %s as %s", job.ID.Hex(), job.RoomID, saved.ID.Hex())
+	return s.finishScheduled(ctx, job, models.ScheduledStatusSent, "")
+}
+
+// finishScheduled 將任務標記為最終狀態，只在仍由本實例持有時生效
+func (s *ChatService) finishScheduled(ctx context.Context, job models.ScheduledMessage, status, reason string) error {
+	now := time.Now()
+	set := bson.M{"status": status, "updated_at": now}
+	if status == models.ScheduledStatusSent {
+		set["sent_at"] = now
+	}
+	if reason != "" {
+		set["error"] = reason
+	}
+	return s.releaseScheduled(ctx, job, set)
+}
+
+// releaseScheduled 更新任務並釋放認領，只在仍由本實例持有時生效
+func (s *ChatService) releaseScheduled(ctx context.Context, job models.ScheduledMessage, set bson.M) error {
+	_, err := s.store.Collection("scheduled_messages").UpdateOne(ctx, bson.M{
+		"_id":        job.ID,
+		"status":     models.ScheduledStatusProcessing,
+		"claimed_by": job.ClaimedBy,
+	}, bson.M{"$set": set, "$unset": bson.M{"claimed_by": "", "claimed_at": ""}})
+	return err
+}
+
+// retryScheduled 暫時性錯誤時放回待發送狀態，並將發送時間延後，超過重試次數則標記失敗
+// 不延後的話同一輪就會立即重新認領，在錯誤恢復前用完所有重試次數
+func (s *ChatService) retryScheduled(ctx context.Context, job models.ScheduledMessage, cause error) error {
+	log.Printf("Failed to dispatch scheduled message %s (attempt %d): %v", job.ID.Hex(), job.Attempts, cause)
+	if job.Attempts >= scheduledMaxAttempts {
+		return s.finishScheduled(ctx, job, models.ScheduledStatusFailed, "send_failed")
+	}
+	now := time.Now()
+	backoff := scheduledRetryBackoff << max(job.Attempts-1, 0)
+	return s.releaseScheduled(ctx, job, bson.M{
+		"status":     models.ScheduledStatusPending,
+		"send_at":    now.Add(backoff),
+		"updated_at": now,
+	})
+}
+
+// RunScheduledMessageWorker 定期認領並發送到期的定時消息，直到 ctx 被取消
+func (s *ChatService) RunScheduledMessageWorker(ctx context.Context, interval time.Duration) {
+	workerID := primitive.NewObjectID().Hex()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Scheduled message worker %s started (interval %s)", workerID, interval)
+	for {
+		s.dispatchDueScheduledMessages(ctx, workerID)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Scheduled message worker %s stopped", workerID)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ChatService) dispatchDueScheduledMessages(ctx context.Context, workerID string) {
+	for i := 0; i < scheduledBatchPerTick && ctx.Err() == nil; i++ {
+		claimCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		job, err := s.ClaimDueScheduledMessage(claimCtx, workerID)
+		if err != nil {
+			cancel()
+			log.Printf("Failed to claim scheduled message: %v", err)
+			return
+		}
+		if job == nil {
+			cancel()
+			return
+		}
+		if err := s.DispatchScheduledMessage(claimCtx, *job); err != nil {
+			log.Printf("Failed to update scheduled message %s: %v", job.ID.Hex(), err)
+		}
+		cancel()
+	}
+}
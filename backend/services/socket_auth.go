@@ -0,0 +1,47 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrSessionRevoked     = errors.New("登入會話已終止")
+	ErrAccountUnavailable = errors.New("帳號已刪除或停用")
+)
+
+// AuthorizeSocket 檢查連線使用的帳號與登入會話是否仍然有效
+// 舊版 token 沒有會話 ID，只檢查帳號
+func (s *ChatService) AuthorizeSocket(ctx context.Context, userID, sessionID string) error {
+	userObjectID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrAccountUnavailable
+	}
+	// 舊數據可能沒有 is_active 字段，只排除明確停用的帳號
+	err = s.store.Collection("users").FindOne(ctx, bson.M{
+		"_id":        userObjectID,
+		"is_deleted": bson.M{"$ne": true},
+		"is_active":  bson.M{"$ne": false},
+	}).Err()
+	if err == mongo.ErrNoDocuments {
+		return ErrAccountUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	if sessionID == "" {
+		return nil
+	}
+	if _, err := s.activeDeviceSession(ctx, userID, sessionID); err != nil {
+		if errors.Is(err, ErrDeviceNotFound) {
+			return ErrSessionRevoked
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	socketCommandPollInterval = 2 * time.Second  // 其他實例輪詢命令的間隔
+	socketCommandClockSkew    = 10 * time.Second // 容許各實例時鐘的偏差，此範圍內的命令會重新查詢
+	socketCommandTTL          = 5 * time.Minute  // 命令保留的時間
+)
+
+// SocketController 對本實例上的連線執行操作，由 websockets 套件實現
+type SocketController interface {
+	// EvictFromRoom 將用戶在本實例上的連線移出聊天室，userID 為空時移出所有連線
+	EvictFromRoom(roomID, userID string)
+	// DisconnectSockets 通知客戶端原因後斷開本實例上的連線
+	DisconnectSockets(socketIDs []string, reason string)
+	// RateLimitStats 返回本實例 Socket 事件限流的計數
+	RateLimitStats() map[string]interface{}
+}
+
+// SetSocketController 設置連線控制器；未設置時只記錄命令，不對本地連線操作
+func (s *ChatService) SetSocketController(controller SocketController) {
+	s.socketController = controller
+}
+
+// SocketRateLimitStats 返回本實例 Socket 事件限流的計數，Socket 服務尚未建立時返回 nil
+func (s *ChatService) SocketRateLimitStats() map[string]interface{} {
+	if s.socketController == nil {
+		return nil
+	}
+	return s.socketController.RateLimitStats()
+}
+
+// EvictFromRoom 將用戶在所有實例上的連線移出聊天室，用於離開聊天室或聊天室被刪除後停止接收廣播
+// userID 為空時移出聊天室中的所有連線
+func (s *ChatService) EvictFromRoom(ctx context.Context, roomID, userID string) {
+	s.dispatchSocketCommand(ctx, models.SocketCommand{
+		Type:   models.SocketCommandLeaveRoom,
+		RoomID: roomID,
+		UserID: userID,
+	})
+}
+
+// DisconnectUser 強制斷開用戶在所有實例上的連線，sessionID 不為空時只斷開該登入會話的連線
+func (s *ChatService) DisconnectUser(ctx context.Context, userID, sessionID, reason string) {
+	s.dispatchSocketCommand(ctx, models.SocketCommand{
+		Type:      models.SocketCommandDisconnect,
+		UserID:    userID,
+		SessionID: sessionID,
+		Reason:    reason,
+	})
+}
+
+// dispatchSocketCommand 在本地執行命令，並記錄命令供其他實例執行
+func (s *ChatService) dispatchSocketCommand(ctx context.Context, command models.SocketCommand) {
+	s.applySocketCommand(command)
+
+	command.ID = primitive.NewObjectID()
+	command.Origin = s.instanceID
+	command.CreatedAt = time.Now()
+	if _, err := s.store.Collection("socket_commands").InsertOne(ctx, command); err != nil {
+		log.Printf("Failed to dispatch socket command %s: %v", command.Type, err)
+	}
+}
+
+func (s *ChatService) applySocketCommand(command models.SocketCommand) {
+	if s.socketController == nil {
+		return
+	}
+	switch command.Type {
+	case models.SocketCommandLeaveRoom:
+		s.socketController.EvictFromRoom(command.RoomID, command.UserID)
+	case models.SocketCommandDisconnect:
+		if socketIDs := s.userSockets(command.UserID, command.SessionID); len(socketIDs) > 0 {
+			s.socketController.DisconnectSockets(socketIDs, command.Reason)
+		}
+	default:
+		log.Printf("Unknown socket command type: %s", command.Type)
+	}
+}
+
+// RunSocketCommandWorker 輪詢其他實例發出的命令並對本地連線執行，斷開 token 已過期的本地連線，
+// 同時清理過期的命令，直到 ctx 被取消
+func (s *ChatService) RunSocketCommandWorker(ctx context.Context) {
+	ticker := time.NewTicker(socketCommandPollInterval)
+	defer ticker.Stop()
+
+	// 各實例的時鐘可能有偏差，每次查詢都回看一段時間，以已執行的命令 ID 去重
+	since := time.Now()
+	applied := map[primitive.ObjectID]time.Time{}
+
+	log.Printf("Socket command worker started (interval %s)", socketCommandPollInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Socket command worker stopped")
+			return
+		case <-ticker.C:
+		}
+
+		pollStart := time.Now()
+		if expired := s.expiredSockets(pollStart); len(expired) > 0 && s.socketController != nil {
+			s.socketController.DisconnectSockets(expired, models.DisconnectReasonTokenExpired)
+		}
+
+		workCtx, cancel := context.WithTimeout(ctx, socketCommandPollInterval*5)
+		commands, err := s.pendingSocketCommands(workCtx, since.Add(-socketCommandClockSkew))
+		if err != nil {
+			log.Printf("Failed to poll socket commands: %v", err)
+			cancel()
+			continue
+		}
+		for _, command := range commands {
+			if _, done := applied[command.ID]; done {
+				continue
+			}
+			applied[command.ID] = command.ID.Timestamp()
+			s.applySocketCommand(command)
+		}
+		since = pollStart
+
+		for id, createdAt := range applied {
+			if createdAt.Before(since.Add(-2 * socketCommandClockSkew)) {
+				delete(applied, id)
+			}
+		}
+		if _, err := s.store.Collection("socket_commands").DeleteMany(workCtx, bson.M{
+			"created_at": bson.M{"$lt": time.Now().Add(-socketCommandTTL)},
+		}); err != nil {
+			log.Printf("Failed to remove expired socket commands: %v", err)
+		}
+		cancel()
+	}
+}
+
+func (s *ChatService) pendingSocketCommands(ctx context.Context, since time.Time) ([]models.SocketCommand, error) {
+	cursor, err := s.store.Collection("socket_commands").Find(ctx, bson.M{
+		"_id":    bson.M{"$gte": primitive.NewObjectIDFromTimestamp(since)},
+		"origin": bson.M{"$ne": s.instanceID},
+	}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var commands []models.SocketCommand
+	if err := cursor.All(ctx, &commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
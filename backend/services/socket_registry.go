@@ -0,0 +1,172 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// socketRegistry 記錄本實例上每個連線所屬的用戶、登入會話與加入的聊天室
+// 只反映本實例的連線；多實例部署時其他實例上的連線不在其中
+type socketRegistry struct {
+	mu      sync.RWMutex
+	sockets map[string]*socketEntry               // socket ID -> 連線
+	users   map[string]map[string]bool            // 用戶 ID -> socket ID
+	rooms   map[string]map[string]map[string]bool // 聊天室 ID -> 用戶 ID -> socket ID
+}
+
+type socketEntry struct {
+	userID    string
+	sessionID string    // 舊版 token 沒有會話 ID 時為空
+	expiresAt time.Time // 連線使用的 token 的過期時間
+	rooms     map[string]bool
+}
+
+// RegisterSocket 記錄用戶的新連線
+func (s *ChatService) RegisterSocket(socketID, userID, sessionID string, expiresAt time.Time) {
+	r := &s.sockets
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sockets == nil {
+		r.sockets = make(map[string]*socketEntry)
+		r.users = make(map[string]map[string]bool)
+		r.rooms = make(map[string]map[string]map[string]bool)
+	}
+	r.sockets[socketID] = &socketEntry{
+		userID:    userID,
+		sessionID: sessionID,
+		expiresAt: expiresAt,
+		rooms:     map[string]bool{},
+	}
+	if r.users[userID] == nil {
+		r.users[userID] = map[string]bool{}
+	}
+	r.users[userID][socketID] = true
+}
+
+// UnregisterSocket 連線斷開時移除其所有記錄
+func (s *ChatService) UnregisterSocket(socketID string) {
+	r := &s.sockets
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.sockets[socketID]
+	if !ok {
+		return
+	}
+	for roomID := range entry.rooms {
+		r.removeFromRoom(roomID, entry.userID, socketID)
+	}
+	delete(r.users[entry.userID], socketID)
+	if len(r.users[entry.userID]) == 0 {
+		delete(r.users, entry.userID)
+	}
+	delete(r.sockets, socketID)
+}
+
+// RenewSocket 連線以新的 token 重新驗證後更新其會話與過期時間
+func (s *ChatService) RenewSocket(socketID, sessionID string, expiresAt time.Time) {
+	r := &s.sockets
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.sockets[socketID]; ok {
+		entry.sessionID = sessionID
+		entry.expiresAt = expiresAt
+	}
+}
+
+// TrackRoomJoin 記錄連線加入了聊天室
+func (s *ChatService) TrackRoomJoin(socketID, roomID string) {
+	r := &s.sockets
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.sockets[socketID]
+	if !ok {
+		return
+	}
+	entry.rooms[roomID] = true
+	if r.rooms[roomID] == nil {
+		r.rooms[roomID] = map[string]map[string]bool{}
+	}
+	if r.rooms[roomID][entry.userID] == nil {
+		r.rooms[roomID][entry.userID] = map[string]bool{}
+	}
+	r.rooms[roomID][entry.userID][socketID] = true
+}
+
+// TrackRoomLeave 記錄連線離開了聊天室
+func (s *ChatService) TrackRoomLeave(socketID, roomID string) {
+	r := &s.sockets
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.sockets[socketID]
+	if !ok {
+		return
+	}
+	delete(entry.rooms, roomID)
+	r.removeFromRoom(roomID, entry.userID, socketID)
+}
+
+func (r *socketRegistry) removeFromRoom(roomID, userID, socketID string) {
+	delete(r.rooms[roomID][userID], socketID)
+	if len(r.rooms[roomID][userID]) == 0 {
+		delete(r.rooms[roomID], userID)
+	}
+	if len(r.rooms[roomID]) == 0 {
+		delete(r.rooms, roomID)
+	}
+}
+
+// HasSocketInRoom 用戶是否有連線在聊天室中，能即時收到廣播
+func (s *ChatService) HasSocketInRoom(roomID, userID string) bool {
+	r := &s.sockets
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.rooms[roomID][userID]) > 0
+}
+
+// localSockets 返回本實例上所有連線及其所屬用戶
+func (s *ChatService) localSockets() map[string]string {
+	r := &s.sockets
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sockets := make(map[string]string, len(r.sockets))
+	for socketID, entry := range r.sockets {
+		sockets[socketID] = entry.userID
+	}
+	return sockets
+}
+
+// userSockets 返回用戶在本實例上的連線，sessionID 不為空時只返回該會話的連線
+func (s *ChatService) userSockets(userID, sessionID string) []string {
+	r := &s.sockets
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var socketIDs []string
+	for socketID := range r.users[userID] {
+		if sessionID == "" || r.sockets[socketID].sessionID == sessionID {
+			socketIDs = append(socketIDs, socketID)
+		}
+	}
+	return socketIDs
+}
+
+// expiredSockets 返回本實例上 token 已過期的連線
+func (s *ChatService) expiredSockets(now time.Time) []string {
+	r := &s.sockets
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var socketIDs []string
+	for socketID, entry := range r.sockets {
+		if !entry.expiresAt.IsZero() && now.After(entry.expiresAt) {
+			socketIDs = append(socketIDs, socketID)
+		}
+	}
+	return socketIDs
+}
+
+// IsUserConnected 用戶在本實例上是否有連線
+func (s *ChatService) IsUserConnected(userID string) bool {
+	r := &s.sockets
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.users[userID]) > 0
+}
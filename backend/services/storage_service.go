@@ -230,3 +230,22 @@ func (s *LocalStorageService) UploadAvatar(file multipart.File, header *multipar
 func (s *LocalStorageService) GetAvatarURL(filePath string) string {
 	return s.GetPublicURL(filePath)
 }
+
+// CreateFile 在存儲中的相對路徑創建文件並以串流寫入，用於服務端生成的文件（例如加密後的媒體）
+func (s *LocalStorageService) CreateFile(filePath string) (*os.File, error) {
+	fullPath := filepath.Join(s.UploadPath, filePath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+	return os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// OpenFile 打開存儲中的文件用於讀取
+func (s *LocalStorageService) OpenFile(filePath string) (*os.File, error) {
+	return os.Open(filepath.Join(s.UploadPath, filePath))
+}
+
+// DeleteDirectory 刪除目錄及其中所有文件，目錄不存在時不視為錯誤
+func (s *LocalStorageService) DeleteDirectory(dirPath string) error {
+	return os.RemoveAll(filepath.Join(s.UploadPath, dirPath))
+}
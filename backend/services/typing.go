@@ -0,0 +1,344 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	typingTimeout           = 8 * time.Second        // 沒有再收到輸入事件時自動結束
+	typingRefreshInterval   = 3 * time.Second        // 同一用戶在同一聊天室續期狀態的最短間隔，期間重複的事件直接忽略
+	typingBroadcastInterval = 500 * time.Millisecond // 同一聊天室推送正在輸入列表的最短間隔
+	typingSweepInterval     = 2 * time.Second        // 清理過期輸入狀態的間隔
+	maxTypingUsers          = 20                     // 正在輸入列表最多包含的用戶數
+)
+
+// typingThrottle 記錄本實例上的輸入狀態續期與推送時間，用於節流
+type typingThrottle struct {
+	mu         sync.Mutex
+	refreshed  map[string]time.Time        // 輸入狀態 ID -> 上次寫入時間
+	sockets    map[string]map[string]bool  // socket ID -> 正在輸入的狀態 ID
+	broadcasts map[string]*typingBroadcast // 聊天室 ID -> 推送記錄
+}
+
+type typingBroadcast struct {
+	last    time.Time
+	pending bool // 已安排延後推送
+}
+
+func typingStateID(roomID, userID string) string {
+	return roomID + ":" + userID
+}
+
+// SetTyping 更新用戶在聊天室中的輸入狀態，狀態改變時通知聊天室的其他成員
+// 持續輸入時客戶端應每隔幾秒重送，超過 typingTimeout 沒有收到即自動結束
+func (s *ChatService) SetTyping(ctx context.Context, socketID, roomID, userID, username string, isTyping bool) error {
+	if !isTyping {
+		return s.stopTyping(ctx, socketID, roomID, userID, username)
+	}
+
+	id := typingStateID(roomID, userID)
+	now := time.Now()
+	t := &s.typing
+	t.mu.Lock()
+	if t.refreshed == nil {
+		t.refreshed = map[string]time.Time{}
+		t.sockets = map[string]map[string]bool{}
+		t.broadcasts = map[string]*typingBroadcast{}
+	}
+	if now.Sub(t.refreshed[id]) < typingRefreshInterval {
+		t.mu.Unlock()
+		return nil
+	}
+	t.refreshed[id] = now
+	if t.sockets[socketID] == nil {
+		t.sockets[socketID] = map[string]bool{}
+	}
+	t.sockets[socketID][id] = true
+	t.mu.Unlock()
+
+	collection := s.store.Collection("typing_states")
+	expiresAt := now.Add(typingTimeout)
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": id, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"expires_at": expiresAt}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	// 之前沒有在輸入（或狀態已過期），這是一次開始輸入
+	_, err = collection.UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{
+			"room_id":    roomID,
+			"user_id":    userID,
+			"username":   username,
+			"expires_at": expiresAt,
+		}},
+		options.Update().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	s.notifyTypingChanged(roomID, userID, username, true)
+	return nil
+}
+
+func (s *ChatService) stopTyping(ctx context.Context, socketID, roomID, userID, username string) error {
+	id := typingStateID(roomID, userID)
+	t := &s.typing
+	t.mu.Lock()
+	delete(t.refreshed, id)
+	delete(t.sockets[socketID], id)
+	t.mu.Unlock()
+
+	result, err := s.store.Collection("typing_states").DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount > 0 {
+		s.notifyTypingChanged(roomID, userID, username, false)
+	}
+	return nil
+}
+
+// StopSocketTyping 連線斷開時結束其所有輸入狀態
+func (s *ChatService) StopSocketTyping(ctx context.Context, socketID string) {
+	t := &s.typing
+	t.mu.Lock()
+	ids := t.sockets[socketID]
+	delete(t.sockets, socketID)
+	for id := range ids {
+		delete(t.refreshed, id)
+	}
+	t.mu.Unlock()
+
+	for id := range ids {
+		var state models.TypingState
+		err := s.store.Collection("typing_states").FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&state)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to clear typing state %s: %v", id, err)
+			continue
+		}
+		s.notifyTypingChanged(state.RoomID, state.UserID, state.Username, false)
+	}
+}
+
+// notifyTypingChanged 向聊天室的其他成員發送舊版的單一用戶輸入事件，並安排推送正在輸入列表
+func (s *ChatService) notifyTypingChanged(roomID, userID, username string, isTyping bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	members, err := s.roomMemberIDs(ctx, roomID)
+	if err != nil {
+		log.Printf("Failed to load members of room %s: %v", roomID, err)
+	}
+
+	// 舊版客戶端監聽的事件，保留原有的欄位格式
+	legacyEvent := "typing_end"
+	if isTyping {
+		legacyEvent = "typing_start"
+	}
+	for _, memberID := range members {
+		if memberID == userID {
+			continue
+		}
+		s.EmitToUser(memberID, "typing", map[string]interface{}{
+			"user_id":   userID,
+			"username":  username,
+			"room":      roomID,
+			"is_typing": isTyping,
+		})
+		s.EmitToUser(memberID, legacyEvent, map[string]interface{}{
+			"room":        roomID,
+			"sender_id":   userID,
+			"sender_name": username,
+			"is_typing":   isTyping,
+		})
+	}
+
+	s.scheduleTypingBroadcast(roomID)
+}
+
+// scheduleTypingBroadcast 推送聊天室的正在輸入列表；距上次推送太近時延後合併為一次
+func (s *ChatService) scheduleTypingBroadcast(roomID string) {
+	t := &s.typing
+	t.mu.Lock()
+	if t.broadcasts == nil {
+		t.broadcasts = map[string]*typingBroadcast{}
+	}
+	record := t.broadcasts[roomID]
+	if record == nil {
+		record = &typingBroadcast{}
+		t.broadcasts[roomID] = record
+	}
+	if record.pending {
+		t.mu.Unlock()
+		return
+	}
+	wait := typingBroadcastInterval - time.Since(record.last)
+	record.pending = true
+	t.mu.Unlock()
+
+	if wait < 0 {
+		wait = 0
+	}
+	time.AfterFunc(wait, func() {
+		t.mu.Lock()
+		record.pending = false
+		record.last = time.Now()
+		t.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.broadcastTypingUsers(ctx, roomID); err != nil {
+			log.Printf("Failed to broadcast typing users of room %s: %v", roomID, err)
+		}
+	})
+}
+
+// broadcastTypingUsers 向聊天室每位成員推送 "typing_users"，列表中不包含成員自己
+func (s *ChatService) broadcastTypingUsers(ctx context.Context, roomID string) error {
+	typers, err := s.GetTypingUsers(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	members, err := s.roomMemberIDs(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	for _, memberID := range members {
+		users := make([]models.TypingUser, 0, len(typers))
+		for _, typer := range typers {
+			if typer.UserID != memberID {
+				users = append(users, typer)
+			}
+		}
+		s.EmitToUser(memberID, "typing_users", map[string]interface{}{
+			"room":  roomID,
+			"users": users,
+		})
+	}
+	return nil
+}
+
+// GetTypingUsers 返回聊天室中正在輸入的用戶
+func (s *ChatService) GetTypingUsers(ctx context.Context, roomID string) ([]models.TypingUser, error) {
+	cursor, err := s.store.Collection("typing_states").Find(ctx,
+		bson.M{"room_id": roomID, "expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(maxTypingUsers))
+	if err != nil {
+		return nil, err
+	}
+	var states []models.TypingState
+	if err := cursor.All(ctx, &states); err != nil {
+		return nil, err
+	}
+
+	users := make([]models.TypingUser, 0, len(states))
+	for _, state := range states {
+		users = append(users, models.TypingUser{UserID: state.UserID, Username: state.Username})
+	}
+	return users, nil
+}
+
+// roomMemberIDs 返回聊天室的所有成員，包括創建者
+func (s *ChatService) roomMemberIDs(ctx context.Context, roomID string) ([]string, error) {
+	roomObjectID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return nil, nil
+	}
+	var room models.ChatRoom
+	err = s.store.Collection("chat_rooms").FindOne(ctx, bson.M{"_id": roomObjectID},
+		options.FindOne().SetProjection(bson.M{"participants": 1, "created_by": 1})).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	members := room.Participants
+	if room.CreatedBy != "" {
+		members = append(members, room.CreatedBy)
+	}
+	seen := make(map[string]bool, len(members))
+	unique := members[:0]
+	for _, memberID := range members {
+		if memberID != "" && !seen[memberID] {
+			seen[memberID] = true
+			unique = append(unique, memberID)
+		}
+	}
+	return unique, nil
+}
+
+// RunTypingSweeper 定期結束超時的輸入狀態並通知聊天室，避免客戶端崩潰後輸入提示一直存在，直到 ctx 被取消
+// 多個實例同時清理時，每條狀態只由刪除它的實例通知
+func (s *ChatService) RunTypingSweeper(ctx context.Context) {
+	ticker := time.NewTicker(typingSweepInterval)
+	defer ticker.Stop()
+
+	log.Printf("Typing sweeper started (interval %s)", typingSweepInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Typing sweeper stopped")
+			return
+		case <-ticker.C:
+		}
+
+		workCtx, cancel := context.WithTimeout(ctx, typingSweepInterval*5)
+		if err := s.sweepExpiredTyping(workCtx); err != nil {
+			log.Printf("Failed to sweep expired typing states: %v", err)
+		}
+		cancel()
+		s.pruneTypingBroadcasts()
+	}
+}
+
+func (s *ChatService) sweepExpiredTyping(ctx context.Context) error {
+	collection := s.store.Collection("typing_states")
+	for {
+		var state models.TypingState
+		err := collection.FindOneAndDelete(ctx, bson.M{"expires_at": bson.M{"$lte": time.Now()}}).Decode(&state)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		t := &s.typing
+		t.mu.Lock()
+		delete(t.refreshed, state.ID)
+		t.mu.Unlock()
+		s.notifyTypingChanged(state.RoomID, state.UserID, state.Username, false)
+	}
+}
+
+// pruneTypingBroadcasts 移除一段時間沒有推送的聊天室記錄
+func (s *ChatService) pruneTypingBroadcasts() {
+	t := &s.typing
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for roomID, record := range t.broadcasts {
+		if !record.pending && time.Since(record.last) > time.Minute {
+			delete(t.broadcasts, roomID)
+		}
+	}
+}
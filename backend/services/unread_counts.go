@@ -0,0 +1,326 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chatwme/backend/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RoomUnread 用戶在單個聊天室的未讀消息數與未讀提及數
+type RoomUnread struct {
+	RoomID       string `json:"room"`
+	UnreadCount  int    `json:"unread_count"`
+	MentionCount int    `json:"mention_count"`
+}
+
+// incrementUnreadCounts 新消息寫入後遞增其他成員的未讀計數，並推送 "unread_updated"
+// 計數保存在各成員的已讀位置上；只遞增已有的記錄，尚未有記錄的成員由 GetUnreadCounts 以實際的未讀消息數建立，
+// 否則新記錄會從 1 開始，之前未讀的舊消息不再被計入
+func (s *ChatService) incrementUnreadCounts(ctx context.Context, message models.Message, members []string) {
+	if message.Type == models.MessageTypeSystem {
+		return
+	}
+
+	mentioned := make(map[string]bool, len(message.Mentions))
+	for _, userID := range message.Mentions {
+		mentioned[userID] = true
+	}
+
+	seen := map[string]bool{message.SenderID: true}
+	var recipients []string
+	var writes []mongo.WriteModel
+	for _, userID := range members {
+		if userID == "" || seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		recipients = append(recipients, userID)
+
+		inc := bson.M{"unread_count": 1, "counts_version": 1}
+		if mentioned[userID] {
+			inc["mention_count"] = 1
+		}
+		filter := bson.M{"_id": readCursorID(message.Room, userID)}
+		if message.Seq > 0 {
+			// 重新計算時已計入這條消息的記錄不再遞增
+			filter["$nor"] = []bson.M{{"counts_seq": bson.M{"$gte": message.Seq}}}
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(bson.M{"$inc": inc}))
+	}
+	if len(writes) == 0 {
+		return
+	}
+
+	collection := s.store.Collection("read_cursors")
+	if _, err := collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+		log.Printf("Failed to update unread counts for room %s: %v", message.Room, err)
+		return
+	}
+	s.emitUnreadUpdates(ctx, message.Room, recipients)
+}
+
+// adjustUnreadCounts 消息被刪除（delta 為 -1）或恢復（delta 為 1）後，調整已讀位置在這些消息之前的成員的計數，並推送 "unread_updated"
+// 已被刪除的消息不會再次扣減；寫入時以已讀位置沒有移動為條件，位置移動時計數已經重新計算過
+func (s *ChatService) adjustUnreadCounts(ctx context.Context, roomID string, messages []models.Message, delta int) {
+	// 刪除時只扣減原本可見的消息，恢復時只加回原本已刪除的消息
+	wasDeleted := delta > 0
+	var counted []models.Message
+	for _, msg := range messages {
+		if msg.Type != models.MessageTypeSystem && msg.IsDeleted == wasDeleted {
+			counted = append(counted, msg)
+		}
+	}
+	if len(counted) == 0 {
+		return
+	}
+
+	cursor, err := s.store.Collection("read_cursors").Find(ctx, bson.M{"room_id": roomID})
+	if err != nil {
+		log.Printf("Failed to load read cursors of room %s: %v", roomID, err)
+		return
+	}
+	var cursors []models.ReadCursor
+	if err := cursor.All(ctx, &cursors); err != nil {
+		log.Printf("Failed to load read cursors of room %s: %v", roomID, err)
+		return
+	}
+
+	var userIDs []string
+	var writes []mongo.WriteModel
+	for _, readCursor := range cursors {
+		unread, mentions := 0, 0
+		for _, msg := range counted {
+			if msg.SenderID == readCursor.UserID || !unreadFor(&readCursor, msg) {
+				continue
+			}
+			unread++
+			for _, userID := range msg.Mentions {
+				if userID == readCursor.UserID {
+					mentions++
+					break
+				}
+			}
+		}
+		if unread == 0 {
+			continue
+		}
+
+		userIDs = append(userIDs, readCursor.UserID)
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{
+				"_id":           readCursor.ID,
+				"last_read_seq": readCursor.LastReadSeq,
+				"last_read_at":  readCursor.LastReadAt,
+			}).
+			SetUpdate(bson.A{bson.M{"$set": bson.M{
+				"unread_count":   bson.M{"$max": bson.A{0, bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$unread_count", 0}}, unread * delta}}}},
+				"mention_count":  bson.M{"$max": bson.A{0, bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$mention_count", 0}}, mentions * delta}}}},
+				"counts_version": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$counts_version", 0}}, 1}},
+			}}}))
+	}
+	if len(writes) == 0 {
+		return
+	}
+
+	if _, err := s.store.Collection("read_cursors").BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+		log.Printf("Failed to adjust unread counts for room %s: %v", roomID, err)
+		return
+	}
+	s.emitUnreadUpdates(ctx, roomID, userIDs)
+}
+
+// unreadFor 判斷消息是否在已讀位置之後，與 unreadFilter 的條件一致
+func unreadFor(cursor *models.ReadCursor, msg models.Message) bool {
+	switch {
+	case cursor.LastReadSeq > 0:
+		return msg.Seq > cursor.LastReadSeq
+	case !cursor.LastReadAt.IsZero():
+		return msg.Seq > 0 || msg.Timestamp.After(cursor.LastReadAt)
+	default:
+		return true
+	}
+}
+
+// emitUnreadUpdates 向用戶推送其在聊天室中的最新未讀計數
+func (s *ChatService) emitUnreadUpdates(ctx context.Context, roomID string, userIDs []string) {
+	if s.broadcaster == nil || len(userIDs) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		ids = append(ids, readCursorID(roomID, userID))
+	}
+	cursor, err := s.store.Collection("read_cursors").Find(ctx, bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"user_id": 1, "unread_count": 1, "mention_count": 1}))
+	if err != nil {
+		log.Printf("Failed to load unread counts for room %s: %v", roomID, err)
+		return
+	}
+	var cursors []models.ReadCursor
+	if err := cursor.All(ctx, &cursors); err != nil {
+		log.Printf("Failed to load unread counts for room %s: %v", roomID, err)
+		return
+	}
+
+	found := make(map[string]bool, len(cursors))
+	for _, readCursor := range cursors {
+		found[readCursor.UserID] = true
+		s.EmitToUser(readCursor.UserID, "unread_updated", RoomUnread{
+			RoomID:       roomID,
+			UnreadCount:  readCursor.UnreadCount,
+			MentionCount: readCursor.MentionCount,
+		})
+	}
+
+	// 尚未有計數記錄的成員：計算實際的未讀數並建立記錄
+	for _, userID := range userIDs {
+		if found[userID] {
+			continue
+		}
+		counts, err := s.GetUnreadCounts(ctx, userID, []string{roomID})
+		if err != nil {
+			log.Printf("Failed to count unread messages of %s in room %s: %v", userID, roomID, err)
+			continue
+		}
+		s.EmitToUser(userID, "unread_updated", counts[roomID])
+	}
+}
+
+// unreadFilter 構建用戶在已讀位置之後未讀消息的查詢條件；沒有已讀位置時以舊版的 read_by 判斷
+func unreadFilter(roomID, userID string, cursor *models.ReadCursor) bson.M {
+	filter := bson.M{
+		"room":       roomID,
+		"sender_id":  bson.M{"$ne": userID},
+		"type":       bson.M{"$ne": models.MessageTypeSystem},
+		"is_deleted": bson.M{"$ne": true},
+	}
+	switch {
+	case cursor == nil:
+		filter["read_by"] = bson.M{"$ne": userID}
+	case cursor.LastReadSeq > 0:
+		filter["seq"] = bson.M{"$gt": cursor.LastReadSeq}
+	case !cursor.LastReadAt.IsZero():
+		filter["$or"] = []bson.M{
+			{"seq": bson.M{"$gt": 0}},
+			{"timestamp": bson.M{"$gt": cursor.LastReadAt}},
+		}
+	}
+	return filter
+}
+
+// countUnread 重新計算用戶在已讀位置之後的未讀消息數與提及數；maxSeq 大於 0 時只計算序號不超過它的消息
+func (s *ChatService) countUnread(ctx context.Context, roomID, userID string, cursor *models.ReadCursor, maxSeq int64) (int, int, error) {
+	collection := s.store.Collection("messages")
+	filter := unreadFilter(roomID, userID, cursor)
+	if maxSeq > 0 {
+		// 沒有序號的舊消息仍然計入
+		filter["$nor"] = []bson.M{{"seq": bson.M{"$gt": maxSeq}}}
+	}
+	unread, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	if unread == 0 {
+		return 0, 0, nil
+	}
+	filter["mentions"] = userID
+	mentions, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(unread), int(mentions), nil
+}
+
+// GetUnreadCounts 獲取用戶在多個聊天室的未讀計數
+// 升級前沒有計數記錄的聊天室會計算一次並保存，之後由發送消息時遞增
+func (s *ChatService) GetUnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]RoomUnread, error) {
+	counts := make(map[string]RoomUnread, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return counts, nil
+	}
+
+	ids := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		ids = append(ids, readCursorID(roomID, userID))
+	}
+	collection := s.store.Collection("read_cursors")
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var cursors []models.ReadCursor
+	if err := cursor.All(ctx, &cursors); err != nil {
+		return nil, err
+	}
+	for _, readCursor := range cursors {
+		counts[readCursor.RoomID] = RoomUnread{
+			RoomID:       readCursor.RoomID,
+			UnreadCount:  readCursor.UnreadCount,
+			MentionCount: readCursor.MentionCount,
+		}
+	}
+
+	for _, roomID := range roomIDs {
+		if _, exists := counts[roomID]; exists {
+			continue
+		}
+		countedSeq, err := s.roomMessageSeq(ctx, roomID)
+		if err != nil && err != ErrRoomNotFound {
+			return nil, err
+		}
+		unread, mentions, err := s.countUnread(ctx, roomID, userID, nil, countedSeq)
+		if err != nil {
+			return nil, err
+		}
+		counts[roomID] = RoomUnread{RoomID: roomID, UnreadCount: unread, MentionCount: mentions}
+
+		// 只在記錄仍不存在時保存，避免覆蓋同時到達的新消息所遞增的計數
+		_, err = collection.UpdateOne(ctx, bson.M{"_id": readCursorID(roomID, userID)}, bson.M{
+			"$setOnInsert": bson.M{
+				"room_id":       roomID,
+				"user_id":       userID,
+				"last_read_seq": int64(0),
+				"last_read_at":  time.Time{},
+				"unread_count":  unread,
+				"mention_count": mentions,
+				"counts_seq":    countedSeq,
+			},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			log.Printf("Failed to save unread counts for room %s: %v", roomID, err)
+		}
+	}
+	return counts, nil
+}
+
+// GetTotalUnread 獲取用戶在所有聊天室的未讀計數與總數，用於應用圖標上的角標
+func (s *ChatService) GetTotalUnread(ctx context.Context, userID string) ([]RoomUnread, int, int, error) {
+	roomIDs, err := s.GetUserRoomIDs(ctx, userID)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	counts, err := s.GetUnreadCounts(ctx, userID, roomIDs)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	rooms := []RoomUnread{}
+	totalUnread, totalMentions := 0, 0
+	for _, roomID := range roomIDs {
+		count := counts[roomID]
+		if count.UnreadCount == 0 && count.MentionCount == 0 {
+			continue
+		}
+		rooms = append(rooms, count)
+		totalUnread += count.UnreadCount
+		totalMentions += count.MentionCount
+	}
+	return rooms, totalUnread, totalMentions, nil
+}
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// blindIndexSize 截斷後的索引長度（位元組），足以避免碰撞同時節省儲存空間
+const blindIndexSize = 16
+
+// BlindIndex 以 HMAC-SHA256 計算詞元的盲索引，相同詞元在同一密鑰下總是得到相同結果
+func BlindIndex(token string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil)[:blindIndexSize])
+}
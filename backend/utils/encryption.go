@@ -4,70 +4,218 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+
+	"chatwme/backend/config"
 )
 
 // Encrypt 使用 AES-GCM 加密純文字
 func Encrypt(plaintext string, key []byte) (string, error) {
-	block, err := aes.NewCipher(key)
+	ciphertextBytes, err := EncryptBytes([]byte(plaintext), key)
 	if err != nil {
 		return "", err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	// 使用 Base64 編碼，以便安全地儲存或傳輸
+	return base64.StdEncoding.EncodeToString(ciphertextBytes), nil
+}
+
+// Decrypt 使用 AES-GCM 解密密文
+func Decrypt(ciphertext string, key []byte) (string, error) {
+	// 先將 Base64 編碼的字串解碼回 byte 陣列
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	plaintextBytes, err := DecryptBytes(data, key)
 	if err != nil {
 		return "", err
 	}
+	return string(plaintextBytes), nil
+}
+
+// EncryptBytes 使用 AES-GCM 加密二進位資料，例如媒體文件
+func EncryptBytes(plaintext []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
 
 	// Nonce (Number used once) 是一個不重複的隨機數，對於 GCM 模式至關重要
 	// 我們將它放在加密後密文的前面，解密時需要用到
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Seal 函式會處理加密，並將 nonce 作為第一個參數
 	// 結果會是 nonce + ciphertext + authentication tag
-	ciphertextBytes := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-
-	// 使用 Base64 編碼，以便安全地儲存或傳輸
-	return base64.StdEncoding.EncodeToString(ciphertextBytes), nil
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
 }
 
-// Decrypt 使用 AES-GCM 解密密文
-func Decrypt(ciphertext string, key []byte) (string, error) {
-	// 先將 Base64 編碼的字串解碼回 byte 陣列
-	data, err := base64.StdEncoding.DecodeString(ciphertext)
-	if err != nil {
-		return "", err
-	}
-
+// DecryptBytes 使用 AES-GCM 解密 EncryptBytes 的結果
+func DecryptBytes(data []byte, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	nonceSize := gcm.NonceSize()
 	if len(data) < nonceSize {
-		return "", fmt.Errorf("ciphertext too short")
+		return nil, fmt.Errorf("ciphertext too short")
 	}
 
 	// 從資料中分離 nonce 和實際的密文
 	nonce, ciphertextBytes := data[:nonceSize], data[nonceSize:]
 
-	// Open 函式會處理解密和驗證
-	plaintextBytes, err := gcm.Open(nil, nonce, ciphertextBytes, nil)
+	// Open 函式會處理解密和驗證；金鑰錯誤或資料被竄改時會回傳錯誤
+	return gcm.Open(nil, nonce, ciphertextBytes, nil)
+}
+
+// GenerateDataKey 產生隨機的 AES-256 資料密鑰
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DataKeyPrefix 以資料密鑰（例如聊天室密鑰）加密的密文前綴；密鑰環不允許使用此 ID
+const DataKeyPrefix = "dk"
+
+// EncryptWithDataKey 使用資料密鑰加密，密文以 "dk:" 開頭
+func EncryptWithDataKey(plaintext string, key []byte) (string, error) {
+	ciphertext, err := Encrypt(plaintext, key)
 	if err != nil {
-		// 如果解密失敗（例如金鑰錯誤或資料被竄改），會回傳錯誤
 		return "", err
 	}
+	return DataKeyPrefix + keyIDSeparator + ciphertext, nil
+}
 
-	return string(plaintextBytes), nil
+// DecryptWithDataKey 解密 EncryptWithDataKey 的結果
+func DecryptWithDataKey(ciphertext string, key []byte) (string, error) {
+	body, ok := strings.CutPrefix(ciphertext, DataKeyPrefix+keyIDSeparator)
+	if !ok {
+		return "", ErrUnknownKeyID
+	}
+	return Decrypt(body, key)
+}
+
+// IsDataKeyCiphertext 判斷密文是否以資料密鑰加密
+func IsDataKeyCiphertext(ciphertext string) bool {
+	return strings.HasPrefix(ciphertext, DataKeyPrefix+keyIDSeparator)
+}
+
+// keyIDSeparator 分隔密文前綴中的密鑰 ID；Base64 字元集不包含冒號，因此不會與密文本身混淆
+const keyIDSeparator = ":"
+
+var ErrUnknownKeyID = errors.New("unknown encryption key id")
+
+// Keyring 保存所有可用的加密密鑰
+// 新寫入的密文使用當前密鑰並以 "<密鑰 ID>:" 開頭，舊密鑰仍可用於解密；
+// 沒有前綴的舊密文依序嘗試 legacyKeys
+type Keyring struct {
+	activeID   string
+	keys       map[string][]byte
+	legacyKeys [][]byte
+}
+
+// NewKeyring 建立密鑰環，activeID 必須是 keys 中的一把密鑰
+func NewKeyring(activeID string, keys map[string][]byte, legacyKeys ...[]byte) (*Keyring, error) {
+	if _, ok := keys[activeID]; !ok {
+		return nil, fmt.Errorf("active key %q not found in keyring", activeID)
+	}
+	copied := make(map[string][]byte, len(keys))
+	for id, key := range keys {
+		if id == "" || id == DataKeyPrefix || strings.Contains(id, keyIDSeparator) {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		copied[id] = key
+	}
+	return &Keyring{activeID: activeID, keys: copied, legacyKeys: legacyKeys}, nil
+}
+
+// DeriveKey 將任意長度的密鑰字串轉換為 AES-256 密鑰
+func DeriveKey(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// LoadKeyring 根據設定建立密鑰環
+// 未設置 ENCRYPTION_KEYS 時以 ENCRYPTION_SECRET 作為唯一的密鑰；
+// 沒有密鑰 ID 的舊密文曾分別以 sha256(ENCRYPTION_SECRET)（Socket）與原始 ENCRYPTION_SECRET（REST）加密，兩者都保留用於解密
+func LoadKeyring(cfg config.AppConfig) (*Keyring, error) {
+	keys := make(map[string][]byte, len(cfg.EncryptionKeys))
+	for id, secret := range cfg.EncryptionKeys {
+		keys[id] = DeriveKey(secret)
+	}
+	return NewKeyring(cfg.EncryptionKeyID, keys, DeriveKey(cfg.EncryptionSecret), []byte(cfg.EncryptionSecret))
+}
+
+// ActiveKeyID 返回新寫入使用的密鑰 ID
+func (k *Keyring) ActiveKeyID() string {
+	return k.activeID
+}
+
+// Encrypt 使用當前密鑰加密，密文帶有密鑰 ID 前綴
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	ciphertext, err := Encrypt(plaintext, k.keys[k.activeID])
+	if err != nil {
+		return "", err
+	}
+	return k.activeID + keyIDSeparator + ciphertext, nil
+}
+
+// Decrypt 根據密文前綴選擇密鑰解密；沒有前綴的舊密文依序嘗試舊密鑰
+func (k *Keyring) Decrypt(ciphertext string) (string, error) {
+	if id, body, ok := strings.Cut(ciphertext, keyIDSeparator); ok {
+		key, exists := k.keys[id]
+		if !exists {
+			return "", ErrUnknownKeyID
+		}
+		return Decrypt(body, key)
+	}
+
+	err := ErrUnknownKeyID
+	for _, key := range k.legacyKeys {
+		var plaintext string
+		if plaintext, err = Decrypt(ciphertext, key); err == nil {
+			return plaintext, nil
+		}
+	}
+	return "", err
+}
+
+// IsCurrent 判斷密文是否已使用當前密鑰加密
+func (k *Keyring) IsCurrent(ciphertext string) bool {
+	return KeyID(ciphertext) == k.activeID
+}
+
+// KeyID 返回密文使用的密鑰 ID，沒有前綴的舊密文返回空字串
+func KeyID(ciphertext string) string {
+	id, _, ok := strings.Cut(ciphertext, keyIDSeparator)
+	if !ok {
+		return ""
+	}
+	return id
 }
@@ -11,13 +11,14 @@ import (
 
 // Claims 定義了 JWT 的聲明 (payload)
 type Claims struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"` // 登入會話 ID，刷新 token 時沿用，用於撤銷會話
 	jwt.RegisteredClaims
 }
 
-// GenerateJWT 根據使用者 ID 和用戶名稱生成一個 JWT
-func GenerateJWT(userID, username string) (string, error) {
+// GenerateJWT 根據使用者 ID、用戶名稱和登入會話 ID 生成一個 JWT
+func GenerateJWT(userID, username, sessionID string) (string, error) {
 	cfg := config.LoadConfig()
 	jwtSecret := []byte(cfg.JwtSecret)
 
@@ -26,8 +27,9 @@ func GenerateJWT(userID, username string) (string, error) {
 
 	// 建立聲明
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -74,7 +76,7 @@ func VerifyJWT(tokenString string) (*Claims, error) {
 }
 
 // GenerateRefreshToken 生成 Refresh Token (有效期 7 天)
-func GenerateRefreshToken(userID, username string) (string, error) {
+func GenerateRefreshToken(userID, username, sessionID string) (string, error) {
 	cfg := config.LoadConfig()
 	jwtSecret := []byte(cfg.JwtSecret)
 
@@ -83,8 +85,9 @@ func GenerateRefreshToken(userID, username string) (string, error) {
 
 	// 建立聲明
 	claims := &Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 分段加密的媒體文件格式：
+// 文件頭為 "CWMS"、版本號與 7 字節隨機前綴，之後是每段 MediaChunkSize 字節明文的 AES-GCM 密文
+// 每段的 nonce 由前綴、段序號與是否為最後一段組成，並以文件頭作為附加資料，段被調換、截斷或替換時都無法解密
+// 讀取時只需解密請求範圍所在的段，HTTP Range 請求不必解密整個文件
+const (
+	MediaChunkSize = 64 << 10
+
+	mediaStreamMagic   = "CWMS"
+	mediaStreamVersion = 1
+	mediaPrefixSize    = 7
+	mediaHeaderSize    = len(mediaStreamMagic) + 1 + mediaPrefixSize
+	mediaTagSize       = 16
+)
+
+// ErrNotEncryptedStream 文件不是分段加密格式，例如以 EncryptBytes 整體加密的舊文件
+var ErrNotEncryptedStream = errors.New("not a chunked encrypted media file")
+
+func newMediaGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func mediaChunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, mediaPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// EncryptStream 分段加密 src 並寫入 dst，每次只在記憶體中保留兩段，返回明文的總長度
+func EncryptStream(dst io.Writer, src io.Reader, key []byte) (int64, error) {
+	gcm, err := newMediaGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, mediaHeaderSize)
+	copy(header, mediaStreamMagic)
+	header[len(mediaStreamMagic)] = mediaStreamVersion
+	prefix := header[len(mediaStreamMagic)+1:]
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return 0, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+
+	current := make([]byte, MediaChunkSize)
+	next := make([]byte, MediaChunkSize)
+	sealed := make([]byte, 0, MediaChunkSize+mediaTagSize)
+	var total int64
+
+	n, readErr := io.ReadFull(src, current)
+	for index := uint32(0); ; index++ {
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return total, readErr
+		}
+		// 讀滿一段時需要預讀下一段，才能知道目前這段是否為最後一段
+		last := readErr != nil
+		var m int
+		var nextErr error
+		if !last {
+			m, nextErr = io.ReadFull(src, next)
+			last = m == 0 && nextErr == io.EOF
+		}
+
+		sealed = gcm.Seal(sealed[:0], mediaChunkNonce(prefix, index, last), current[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return total, err
+		}
+		total += int64(n)
+		if last {
+			return total, nil
+		}
+		current, next = next, current
+		n, readErr = m, nextErr
+	}
+}
+
+// DecryptingReader 按需解密分段加密的文件，支援隨機讀取，可直接交給 http.ServeContent
+type DecryptingReader struct {
+	src    io.ReaderAt
+	gcm    cipher.AEAD
+	header []byte
+	size   int64 // 明文長度
+	chunks int64
+	offset int64
+
+	cached int64 // 目前緩存的段序號，-1 表示沒有
+	plain  []byte
+	buf    []byte
+}
+
+// NewDecryptingReader 讀取文件頭並計算明文長度；不是分段加密格式時返回 ErrNotEncryptedStream
+func NewDecryptingReader(src io.ReaderAt, encryptedSize int64, key []byte) (*DecryptingReader, error) {
+	header := make([]byte, mediaHeaderSize)
+	if encryptedSize < int64(mediaHeaderSize) {
+		return nil, ErrNotEncryptedStream
+	}
+	if _, err := src.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(mediaStreamMagic)], []byte(mediaStreamMagic)) || header[len(mediaStreamMagic)] != mediaStreamVersion {
+		return nil, ErrNotEncryptedStream
+	}
+
+	gcm, err := newMediaGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body := encryptedSize - int64(mediaHeaderSize)
+	sealedChunk := int64(MediaChunkSize + mediaTagSize)
+	chunks, rest := body/sealedChunk, body%sealedChunk
+	size := chunks * MediaChunkSize
+	if rest > 0 {
+		if rest < mediaTagSize {
+			return nil, fmt.Errorf("truncated media file")
+		}
+		chunks++
+		size += rest - mediaTagSize
+	}
+	if chunks == 0 {
+		return nil, fmt.Errorf("truncated media file")
+	}
+
+	return &DecryptingReader{
+		src:    src,
+		gcm:    gcm,
+		header: header,
+		size:   size,
+		chunks: chunks,
+		cached: -1,
+		buf:    make([]byte, sealedChunk),
+	}, nil
+}
+
+// Size 返回明文長度
+func (r *DecryptingReader) Size() int64 {
+	return r.size
+}
+
+func (r *DecryptingReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := r.offset / MediaChunkSize
+	if index != r.cached {
+		if err := r.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.offset-index*MediaChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *DecryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *DecryptingReader) loadChunk(index int64) error {
+	sealedChunk := int64(MediaChunkSize + mediaTagSize)
+	start := int64(mediaHeaderSize) + index*sealedChunk
+	length := sealedChunk
+	last := index == r.chunks-1
+	if last {
+		length = r.size - index*MediaChunkSize + mediaTagSize
+	}
+
+	sealed := r.buf[:length]
+	if _, err := r.src.ReadAt(sealed, start); err != nil && err != io.EOF {
+		return err
+	}
+	prefix := r.header[len(mediaStreamMagic)+1:]
+	plain, err := r.gcm.Open(r.plain[:0], mediaChunkNonce(prefix, uint32(index), last), sealed, r.header)
+	if err != nil {
+		r.cached = -1
+		return err
+	}
+	r.plain = plain
+	r.cached = index
+	return nil
+}
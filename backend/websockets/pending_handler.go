@@ -0,0 +1,34 @@
+package websockets
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chatwme/backend/services"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// drainPendingDeliveries 連線後向該連線補發離線期間未確認的消息
+// 每批以 "pending_messages" 推送，結束後推送 "pending_drained"；has_more 為 true 時客戶端需以 sync 補齊其餘消息
+func drainPendingDeliveries(chatService *services.ChatService, s socketio.Conn, user *AuthenticatedUser) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	delivered, hasMore, err := chatService.DrainPendingDeliveries(ctx, user.ID, func(payload map[string]interface{}) {
+		s.Emit("pending_messages", payload)
+	})
+	if err != nil {
+		log.Printf("Failed to drain pending deliveries for %s: %v", user.Username, err)
+	}
+	if delivered > 0 {
+		log.Printf("Delivered %d pending messages to %s (Socket %s)", delivered, user.Username, s.ID())
+	}
+
+	s.Emit("pending_drained", map[string]interface{}{
+		"delivered": delivered,
+		"has_more":  hasMore,
+		"ok":        err == nil,
+	})
+}
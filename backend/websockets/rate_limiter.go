@@ -0,0 +1,268 @@
+package websockets
+
+import (
+	"log"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"chatwme/backend/config"
+	"chatwme/backend/models"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	floodWindow   = time.Minute      // 統計被限流次數的時間窗口
+	offenderDecay = 10 * time.Minute // 禁言記錄保留的時間，超過後重新計算
+)
+
+// 不受速率限制的事件：心跳與重新驗證的開銷很小，限流反而會讓正常連線斷開
+var rateLimitExempt = map[string]bool{
+	"ping":      true,
+	"heartbeat": true,
+	"reauth":    true,
+}
+
+// eventLimiter 以令牌桶限制每個用戶每種事件的頻率；只統計本實例上的連線
+type eventLimiter struct {
+	mu        sync.Mutex
+	limits    map[string]config.EventRateLimit
+	buckets   map[string]*tokenBucket // 用戶 ID + 事件 -> 令牌桶
+	offenders map[string]*offender    // 用戶 ID -> 違規記錄
+
+	floodThreshold  int
+	muteDuration    time.Duration
+	disconnectAfter int
+	allowed         map[string]int64 // 事件 -> 放行次數
+	limited         map[string]int64 // 事件 -> 限流次數
+	mutes           int64
+	disconnects     int64
+	startedAt       time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type offender struct {
+	violations  int       // 當前窗口內被限流的次數
+	windowStart time.Time // 當前窗口的開始時間
+	mutedUntil  time.Time
+	mutes       int // 最近一段時間內被禁言的次數
+	lastMute    time.Time
+}
+
+// limitDecision 限流判斷的結果
+type limitDecision struct {
+	allowed    bool
+	reason     string        // "rate_limited" 或 "muted"
+	retryAfter time.Duration // 客戶端應等待多久再重試
+	muted      bool          // 本次違規觸發了禁言
+	disconnect bool          // 屢次違規，應斷開連線
+}
+
+func newEventLimiter(cfg config.AppConfig) *eventLimiter {
+	return &eventLimiter{
+		limits:          cfg.SocketRateLimits,
+		buckets:         map[string]*tokenBucket{},
+		offenders:       map[string]*offender{},
+		floodThreshold:  cfg.SocketFloodThreshold,
+		muteDuration:    cfg.SocketMuteDuration,
+		disconnectAfter: cfg.SocketDisconnectAfterMutes,
+		allowed:         map[string]int64{},
+		limited:         map[string]int64{},
+		startedAt:       time.Now(),
+	}
+}
+
+// allow 判斷用戶此時能否發送該事件，並記錄違規
+func (l *eventLimiter) allow(userID, event string) limitDecision {
+	if rateLimitExempt[event] {
+		return limitDecision{allowed: true}
+	}
+	limit, ok := l.limits[event]
+	if !ok {
+		if limit, ok = l.limits["*"]; !ok {
+			return limitDecision{allowed: true}
+		}
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record := l.offenders[userID]
+	if record != nil && now.Before(record.mutedUntil) {
+		l.limited[event]++
+		return l.violate(record, now, limitDecision{reason: "muted", retryAfter: record.mutedUntil.Sub(now)})
+	}
+
+	key := userID + "\x00" + event
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		l.allowed[event]++
+		return limitDecision{allowed: true}
+	}
+
+	l.limited[event]++
+	if record == nil {
+		record = &offender{windowStart: now}
+		l.offenders[userID] = record
+	}
+	retryAfter := time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	return l.violate(record, now, limitDecision{reason: "rate_limited", retryAfter: retryAfter})
+}
+
+// violate 記錄一次違規；窗口內違規過多時禁言，短時間內屢次被禁言時要求斷開連線
+func (l *eventLimiter) violate(record *offender, now time.Time, decision limitDecision) limitDecision {
+	if now.Sub(record.windowStart) > floodWindow {
+		record.violations = 0
+		record.windowStart = now
+	}
+	record.violations++
+	if record.violations < l.floodThreshold {
+		return decision
+	}
+
+	record.violations = 0
+	record.windowStart = now
+	if now.Sub(record.lastMute) > offenderDecay {
+		record.mutes = 0
+	}
+	record.mutes++
+	record.lastMute = now
+	record.mutedUntil = now.Add(l.muteDuration)
+	l.mutes++
+
+	decision.reason = "muted"
+	decision.retryAfter = l.muteDuration
+	decision.muted = true
+	if record.mutes >= l.disconnectAfter {
+		record.mutes = 0
+		decision.disconnect = true
+		l.disconnects++
+	}
+	return decision
+}
+
+// forget 用戶在本實例上沒有連線後釋放其令牌桶；仍在禁言或最近被禁言的記錄保留，避免以重新連線規避
+func (l *eventLimiter) forget(userID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prefix := userID + "\x00"
+	for key := range l.buckets {
+		if strings.HasPrefix(key, prefix) {
+			delete(l.buckets, key)
+		}
+	}
+	if record, ok := l.offenders[userID]; ok && time.Since(record.lastMute) > offenderDecay && time.Now().After(record.mutedUntil) {
+		delete(l.offenders, userID)
+	}
+}
+
+// stats 返回限流計數，用於監控
+func (l *eventLimiter) stats() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	allowed := make(map[string]int64, len(l.allowed))
+	for event, count := range l.allowed {
+		allowed[event] = count
+	}
+	limited := make(map[string]int64, len(l.limited))
+	for event, count := range l.limited {
+		limited[event] = count
+	}
+	muted := 0
+	now := time.Now()
+	for _, record := range l.offenders {
+		if now.Before(record.mutedUntil) {
+			muted++
+		}
+	}
+	return map[string]interface{}{
+		"allowed":       allowed,
+		"limited":       limited,
+		"mutes":         l.mutes,
+		"disconnects":   l.disconnects,
+		"muted_users":   muted,
+		"tracked_users": len(l.offenders),
+		"since":         l.startedAt.Format(time.RFC3339),
+	}
+}
+
+// limitEvent 包裝事件處理函式，超出限制的事件不執行處理函式：
+// 有返回值或 ack 回調參數的處理函式以 ack 返回 rate_limited，其他的向連線發送 "rate_limited" 事件
+func limitEvent(limiter *eventLimiter, control *socketController, event string, handler interface{}) interface{} {
+	handlerValue := reflect.ValueOf(handler)
+	handlerType := handlerValue.Type()
+
+	return reflect.MakeFunc(handlerType, func(args []reflect.Value) []reflect.Value {
+		conn, ok := args[0].Interface().(socketio.Conn)
+		if !ok {
+			return handlerValue.Call(args)
+		}
+		user, ok := conn.Context().(*AuthenticatedUser)
+		if !ok || user == nil {
+			return handlerValue.Call(args)
+		}
+
+		decision := limiter.allow(user.ID, event)
+		if decision.allowed {
+			return handlerValue.Call(args)
+		}
+
+		response := map[string]interface{}{
+			"ok":             false,
+			"error":          decision.reason,
+			"event":          event,
+			"retry_after_ms": decision.retryAfter.Milliseconds(),
+		}
+		if decision.disconnect {
+			log.Printf("User %s keeps flooding %s, disconnecting socket %s", user.ID, event, conn.ID())
+			control.DisconnectSockets([]string{conn.ID()}, models.DisconnectReasonRateLimited)
+		} else if decision.muted {
+			log.Printf("User %s muted for %s after flooding %s", user.ID, limiter.muteDuration, event)
+		}
+
+		if handlerType.NumOut() == 1 && handlerType.Out(0) == reflect.TypeOf(response) {
+			return []reflect.Value{reflect.ValueOf(response)}
+		}
+		if !callAck(args[1:], response) {
+			conn.Emit("rate_limited", response)
+		}
+		results := make([]reflect.Value, handlerType.NumOut())
+		for i := range results {
+			results[i] = reflect.Zero(handlerType.Out(i))
+		}
+		return results
+	}).Interface()
+}
+
+// callAck 找出處理函式參數中接受回應的 ack 回調並以 response 調用，沒有可用的回調時返回 false
+func callAck(args []reflect.Value, response map[string]interface{}) bool {
+	responseValue := reflect.ValueOf(response)
+	for _, arg := range args {
+		if arg.Kind() != reflect.Func || arg.IsNil() {
+			continue
+		}
+		ackType := arg.Type()
+		if ackType.NumIn() != 1 || !responseValue.Type().AssignableTo(ackType.In(0)) {
+			continue
+		}
+		arg.Call([]reflect.Value{responseValue})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package websockets
+
+import (
+	"log"
+	"time"
+
+	"chatwme/backend/services"
+	"chatwme/backend/utils"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// forceDisconnectDelay 發送斷開原因後等待多久再關閉連線
+const forceDisconnectDelay = time.Second
+
+// revokedUser 被強制斷開、等待關閉的連線的上下文
+// 事件處理器只接受 *AuthenticatedUser，因此已終止的會話在關閉前發出的事件都會被拒絕；斷線時仍可據此清理在線狀態
+type revokedUser struct {
+	user *AuthenticatedUser
+}
+
+// socketController 對本實例上的連線執行服務層發出的操作
+type socketController struct {
+	server      *socketio.Server
+	chatService *services.ChatService
+	limiter     *eventLimiter
+}
+
+// RateLimitStats 返回本實例 Socket 事件限流的計數
+func (c *socketController) RateLimitStats() map[string]interface{} {
+	return c.limiter.stats()
+}
+
+// EvictFromRoom 將用戶在本實例上的連線移出聊天室，userID 為空時移出所有連線
+func (c *socketController) EvictFromRoom(roomID, userID string) {
+	// ForEach 持有房間的讀鎖，先收集連線再離開
+	var conns []socketio.Conn
+	c.server.ForEach("/", roomID, func(conn socketio.Conn) {
+		user, ok := conn.Context().(*AuthenticatedUser)
+		if userID == "" || (ok && user != nil && user.ID == userID) {
+			conns = append(conns, conn)
+		}
+	})
+	for _, conn := range conns {
+		conn.Leave(roomID)
+		c.chatService.TrackRoomLeave(conn.ID(), roomID)
+	}
+}
+
+// DisconnectSockets 通知客戶端原因後斷開本實例上的連線
+func (c *socketController) DisconnectSockets(socketIDs []string, reason string) {
+	for _, socketID := range socketIDs {
+		// 每個連線都加入以自身 ID 命名的房間
+		var conns []socketio.Conn
+		c.server.ForEach("/", socketID, func(conn socketio.Conn) {
+			conns = append(conns, conn)
+		})
+		for _, conn := range conns {
+			// 立即停止接收廣播，並讓之後的消息改為離線補發
+			conn.LeaveAll()
+			c.chatService.UnregisterSocket(conn.ID())
+			if user, ok := conn.Context().(*AuthenticatedUser); ok && user != nil {
+				conn.SetContext(&revokedUser{user: user})
+			}
+			conn.Emit("force_disconnect", map[string]interface{}{"reason": reason})
+			log.Printf("Force disconnecting socket %s: %s", conn.ID(), reason)
+
+			// 稍後再關閉，讓客戶端先收到斷開原因
+			time.AfterFunc(forceDisconnectDelay, func() {
+				conn.Close()
+			})
+		}
+	}
+}
+
+// tokenExpiry 返回 token 的過期時間，沒有設置時為零值
+func tokenExpiry(claims *utils.Claims) time.Time {
+	if claims.ExpiresAt == nil {
+		return time.Time{}
+	}
+	return claims.ExpiresAt.Time
+}
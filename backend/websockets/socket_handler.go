@@ -3,11 +3,15 @@ package websockets
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
+	"strings"
 	"time"
 
+	"chatwme/backend/config"
+	"chatwme/backend/models"
 	"chatwme/backend/services"
 	"chatwme/backend/utils"
 
@@ -17,8 +21,14 @@ import (
 
 // AuthenticatedUser 用于储存从 token 解析出的使用者资讯
 type AuthenticatedUser struct {
-	ID       string
-	Username string
+	ID        string
+	Username  string
+	SessionID string // 登入會話 ID，舊版 token 沒有時為空
+}
+
+// ReauthPayload 客戶端在 token 過期前以刷新後的 token 重新驗證
+type ReauthPayload struct {
+	Token string `json:"token"`
 }
 
 // ChatMessagePayload 定义了从客户端接收到的聊天讯息结构
@@ -28,6 +38,12 @@ type ChatMessagePayload struct {
 	Content   string `json:"content"`
 	Type      string `json:"type"`
 	Timestamp string `json:"timestamp"`
+	ReplyTo   string `json:"reply_to"` // 被回覆的消息 ID（可選）
+}
+
+// HeartbeatPayload 客戶端定期發送的在線狀態心跳
+type HeartbeatPayload struct {
+	Idle bool `json:"idle"` // 客戶端是否處於閒置（例如切到背景或長時間無操作）
 }
 
 func toInt(value interface{}) int {
@@ -70,17 +86,81 @@ func toInt64(value interface{}) int64 {
 	return 0
 }
 
+func toStringSlice(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if str, ok := item.(string); ok && str != "" {
+			result = append(result, str)
+		}
+	}
+	return result
+}
+
+// editErrorCode 将编辑消息的错误转换为 ack 中的错误代码
+func editErrorCode(err error) string {
+	switch {
+	case errors.Is(err, services.ErrMessageNotFound):
+		return "message_not_found"
+	case errors.Is(err, services.ErrNotMessageSender):
+		return "not_sender"
+	case errors.Is(err, services.ErrMessageNotEditable):
+		return "not_editable"
+	case errors.Is(err, services.ErrEditWindowExpired):
+		return "edit_window_expired"
+	case errors.Is(err, services.ErrEditConflict):
+		return "edit_conflict"
+	default:
+		return "internal_error"
+	}
+}
+
+// resolveReplyOptions 验证客户端传来的 reply_to，返回保存消息用的选项以及广播时附带的引用字段
+func resolveReplyOptions(ctx context.Context, chatService *services.ChatService, room, replyTo string) ([]services.MessageOption, map[string]interface{}, error) {
+	if replyTo == "" {
+		return nil, nil, nil
+	}
+
+	parentID, threadRoot, err := chatService.ResolveReplyTarget(ctx, room, replyTo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replyFields := map[string]interface{}{
+		"reply_to":    parentID,
+		"thread_root": threadRoot,
+	}
+	if snippets, err := chatService.GetReplySnippets(ctx, []string{parentID}); err == nil {
+		if snippet, ok := snippets[parentID]; ok {
+			replyFields["reply_to_message"] = snippet
+		}
+	}
+	return []services.MessageOption{services.WithReply(parentID, threadRoot)}, replyFields, nil
+}
+
 // NewSocketIOServer 建立并配置一个新的 Socket.IO 伺服器
 func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio.RedisAdapterOptions) *socketio.Server {
+	cfg := config.LoadConfig()
 	server := socketio.NewServer(nil)
 	if redisOptions != nil {
 		if _, err := server.Adapter(redisOptions); err != nil {
 			log.Fatalf("Failed to set Redis adapter: %v", err)
 		}
 	}
+	// 所有事件都經過按用戶與事件類型的限流，避免單一連線大量寫入資料庫
+	limiter := newEventLimiter(cfg)
+	control := &socketController{server: server, chatService: chatService, limiter: limiter}
+	chatService.SetSocketController(control)
+
+	on := func(event string, handler interface{}) {
+		server.OnEvent("/", event, limitEvent(limiter, control, event, handler))
+	}
 
 	// 在現有的事件處理中添加語音消息支持
-	server.OnEvent("/", "voice_message", func(s socketio.Conn, payload map[string]interface{}) {
+	on("voice_message", func(s socketio.Conn, payload map[string]interface{}) {
 		user, ok := s.Context().(*AuthenticatedUser)
 		if !ok || user == nil {
 			log.Printf("Error: Could not get user from context for socket %s", s.ID())
@@ -130,6 +210,13 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			return
 		}
 
+		replyTo, _ := payload["reply_to"].(string)
+		replyOptions, replyFields, err := resolveReplyOptions(authCtx, chatService, room, replyTo)
+		if err != nil {
+			log.Printf("Invalid reply_to in voice message from %s: %v", user.Username, err)
+			return
+		}
+
 		messageCtx, messageCancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer messageCancel()
 
@@ -144,6 +231,7 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			fileURL,
 			duration,
 			fileSize,
+			replyOptions...,
 		)
 		if err != nil {
 			log.Printf("Failed to save voice message: %v", err)
@@ -168,23 +256,27 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			"file_size":   fileSize,
 			"timestamp":   broadcastTimestamp,
 			"type":        "voice",
+			"seq":         savedMessage.Seq,
+		}
+		for key, value := range replyFields {
+			voiceMessageData[key] = value
 		}
 
 		log.Printf("Broadcasting voice message from %s in room %s", user.Username, room)
 		server.BroadcastToRoom("/", room, "voice_message", voiceMessageData)
 		if inserted {
-			go func(ts time.Time) {
+			go func(message models.Message, content string) {
 				updateCtx, updateCancel := context.WithTimeout(context.Background(), 10*time.Second)
 				defer updateCancel()
-				if err := chatService.UpdateRoomLastMessage(updateCtx, roomObjectID, "[语音消息]", ts); err != nil {
+				if err := chatService.UpdateRoomPreview(updateCtx, roomObjectID, message, content); err != nil {
 					log.Printf("Failed to update room last message: %v", err)
 				}
-			}(savedMessage.Timestamp)
+			}(savedMessage, string(voiceContentBytes))
 		}
 	})
 
 	// 🔥 新增：支持图片消息广播
-	server.OnEvent("/", "image_message", func(s socketio.Conn, payload map[string]interface{}) {
+	on("image_message", func(s socketio.Conn, payload map[string]interface{}) {
 		user, ok := s.Context().(*AuthenticatedUser)
 		if !ok || user == nil {
 			log.Printf("Error: Could not get user from context for socket %s", s.ID())
@@ -230,6 +322,13 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			return
 		}
 
+		replyTo, _ := payload["reply_to"].(string)
+		replyOptions, replyFields, err := resolveReplyOptions(authCtx, chatService, room, replyTo)
+		if err != nil {
+			log.Printf("Invalid reply_to in image message from %s: %v", user.Username, err)
+			return
+		}
+
 		messageCtx, messageCancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer messageCancel()
 
@@ -244,6 +343,7 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			fileURL,
 			0,
 			0,
+			replyOptions...,
 		)
 		if err != nil {
 			log.Printf("Failed to save image message: %v", err)
@@ -266,23 +366,27 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			"file_url":    fileURL,
 			"timestamp":   broadcastTimestamp,
 			"type":        "image",
+			"seq":         savedMessage.Seq,
+		}
+		for key, value := range replyFields {
+			imageMessageData[key] = value
 		}
 
 		log.Printf("Broadcasting image message from %s in room %s", user.Username, room)
 		server.BroadcastToRoom("/", room, "image_message", imageMessageData)
 		if inserted {
-			go func(ts time.Time) {
+			go func(message models.Message, content string) {
 				updateCtx, updateCancel := context.WithTimeout(context.Background(), 10*time.Second)
 				defer updateCancel()
-				if err := chatService.UpdateRoomLastMessage(updateCtx, roomObjectID, "[图片]", ts); err != nil {
+				if err := chatService.UpdateRoomPreview(updateCtx, roomObjectID, message, content); err != nil {
 					log.Printf("Failed to update room last message: %v", err)
 				}
-			}(savedMessage.Timestamp)
+			}(savedMessage, string(imageContentBytes))
 		}
 	})
 
 	// 🔥 新增：支持视频消息广播
-	server.OnEvent("/", "video_message", func(s socketio.Conn, payload map[string]interface{}) {
+	on("video_message", func(s socketio.Conn, payload map[string]interface{}) {
 		user, ok := s.Context().(*AuthenticatedUser)
 		if !ok || user == nil {
 			log.Printf("Error: Could not get user from context for socket %s", s.ID())
@@ -368,110 +472,140 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			"file_url":    fileURL,
 			"timestamp":   broadcastTimestamp,
 			"type":        "video",
+			"seq":         savedMessage.Seq,
 		}
 
 		log.Printf("Broadcasting video message from %s in room %s", user.Username, room)
 		server.BroadcastToRoom("/", room, "video_message", videoMessageData)
 		if inserted {
-			go func(ts time.Time) {
+			go func(message models.Message, content string) {
 				updateCtx, updateCancel := context.WithTimeout(context.Background(), 10*time.Second)
 				defer updateCancel()
-				if err := chatService.UpdateRoomLastMessage(updateCtx, roomObjectID, "[视频]", ts); err != nil {
+				if err := chatService.UpdateRoomPreview(updateCtx, roomObjectID, message, content); err != nil {
 					log.Printf("Failed to update room last message: %v", err)
 				}
-			}(savedMessage.Timestamp)
+			}(savedMessage, string(videoContentBytes))
 		}
 	})
 
 	// 🔥 新增：处理 "mark_read" 事件
-	server.OnEvent("/", "mark_read", func(s socketio.Conn, payload map[string]interface{}) {
+	on("mark_read", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
 		user, ok := s.Context().(*AuthenticatedUser)
 		if !ok || user == nil {
 			log.Printf("Error: Could not get user from context for socket %s", s.ID())
-			return
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
 		}
 
 		room, ok := payload["room"].(string)
 		if !ok {
 			log.Printf("Invalid room in mark_read from %s", user.Username)
-			return
+			return map[string]interface{}{"ok": false, "error": "invalid_payload"}
 		}
 
-		// 更新数据库中的消息状态
-		// 注意：这里需要访问数据库，我们假设 chatService 有相应的方法，或者直接在這裡操作
-		// 为了简单起见，我们直接在这里调用 chatService 的方法 (需要新增)
+		// 已读位置：message_id 优先，其次 seq；都没有时表示读到最新一条
+		messageID, _ := payload["message_id"].(string)
+		position := services.ReadPosition{MessageID: messageID, Seq: toInt64(payload["seq"])}
+
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
 		roomObjectID, err := primitive.ObjectIDFromHex(room)
 		if err != nil {
 			log.Printf("Invalid room ID: %s", room)
-			return
+			return map[string]interface{}{"ok": false, "error": "invalid_room"}
 		}
 
-		if err := chatService.MarkMessagesAsRead(ctx, roomObjectID, user.ID); err != nil {
+		isMember, err := chatService.IsUserInRoom(ctx, roomObjectID, user.ID)
+		if err != nil {
+			log.Printf("Failed to validate room access for UserID %s in room %s: %v", user.ID, room, err)
+			return map[string]interface{}{"ok": false, "error": "room_access_check_failed"}
+		}
+		if !isMember {
+			return map[string]interface{}{"ok": false, "error": "not_in_room"}
+		}
+
+		cursor, advanced, err := chatService.MarkRoomRead(ctx, room, user.ID, position)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidReadPosition) {
+				return map[string]interface{}{"ok": false, "error": "invalid_position"}
+			}
 			log.Printf("Failed to mark messages as read: %v", err)
-			return
+			return map[string]interface{}{"ok": false, "error": "mark_read_failed"}
 		}
 
-		// 广播 "message_read" 事件给房间内所有用户
-		readData := map[string]interface{}{
-			"room":      room,
-			"user_id":   user.ID,
-			"timestamp": time.Now().Format(time.RFC3339),
+		// 已读位置前进时广播 "message_read" 事件给房间内所有用户
+		readData := services.ReadCursorPayload(cursor)
+		if advanced {
+			log.Printf("User %s marked messages as read in room %s up to seq %d", user.Username, room, cursor.LastReadSeq)
+			server.BroadcastToRoom("/", room, "message_read", readData)
 		}
 
-		log.Printf("User %s marked messages as read in room %s", user.Username, room)
-		server.BroadcastToRoom("/", room, "message_read", readData)
+		readData["ok"] = true
+		return readData
 	})
 
-	// 🔥 新增：处理 "typing_start" 事件
-	server.OnEvent("/", "typing_start", func(s socketio.Conn, payload map[string]interface{}) {
+	// 🔥 新增：客户端确认收到消息后记录送达，并通知各条消息的发送者
+	on("message_received", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
 		user, ok := s.Context().(*AuthenticatedUser)
 		if !ok || user == nil {
-			return
+			log.Printf("Error: Could not get user from context for socket %s", s.ID())
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
 		}
 
-		room, ok := payload["room"].(string)
-		if !ok {
-			return
+		room, _ := payload["room"].(string)
+		messageIDs := toStringSlice(payload["message_ids"])
+		if messageID, _ := payload["message_id"].(string); messageID != "" {
+			messageIDs = append(messageIDs, messageID)
+		}
+		if room == "" || len(messageIDs) == 0 {
+			return map[string]interface{}{"ok": false, "error": "invalid_payload"}
+		}
+		if len(messageIDs) > services.MaxDeliveryAckBatch {
+			return map[string]interface{}{"ok": false, "error": "too_many_messages"}
 		}
 
-		typingData := map[string]interface{}{
-			"room":        room,
-			"sender_id":   user.ID,
-			"sender_name": user.Username,
-			"is_typing":   true,
+		roomObjectID, err := primitive.ObjectIDFromHex(room)
+		if err != nil {
+			return map[string]interface{}{"ok": false, "error": "invalid_room"}
 		}
 
-		// 广播给房间内的其他人（除了自己）
-		// socket.io-go 的 BroadcastToRoom 默认会发给所有人包括自己吗？通常是的。
-		// 但在这里我们希望接收端过滤掉自己。或者我们可以尝试用 s.BroadcastTo 排除自己。
-		// server.BroadcastToRoom 确实是广播给房间里的所有 socket。
-		// 客户端需要自己过滤 sender_id == current_user_id。
-		server.BroadcastToRoom("/", room, "typing_start", typingData)
-	})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-	// 🔥 新增：处理 "typing_end" 事件
-	server.OnEvent("/", "typing_end", func(s socketio.Conn, payload map[string]interface{}) {
-		user, ok := s.Context().(*AuthenticatedUser)
-		if !ok || user == nil {
-			return
+		isMember, err := chatService.IsUserInRoom(ctx, roomObjectID, user.ID)
+		if err != nil {
+			log.Printf("Failed to validate room access for UserID %s in room %s: %v", user.ID, room, err)
+			return map[string]interface{}{"ok": false, "error": "room_access_check_failed"}
+		}
+		if !isMember {
+			return map[string]interface{}{"ok": false, "error": "not_in_room"}
 		}
 
-		room, ok := payload["room"].(string)
-		if !ok {
-			return
+		delivered, deliveredAt, err := chatService.MarkMessagesDelivered(ctx, room, user.ID, messageIDs)
+		if err != nil {
+			log.Printf("Failed to mark messages delivered for %s in room %s: %v", user.ID, room, err)
+		}
+		if ackErr := chatService.AckPendingDeliveries(ctx, user.ID, messageIDs); ackErr != nil {
+			log.Printf("Failed to clear pending deliveries for %s in room %s: %v", user.ID, room, ackErr)
 		}
 
-		typingData := map[string]interface{}{
-			"room":        room,
-			"sender_id":   user.ID,
-			"sender_name": user.Username,
-			"is_typing":   false,
+		count := 0
+		for senderID, ids := range delivered {
+			count += len(ids)
+			chatService.EmitToUser(senderID, "message_delivered", services.MessageDeliveredPayload(room, user.ID, ids, deliveredAt))
 		}
+		if err != nil {
+			return map[string]interface{}{"ok": false, "error": "delivery_update_failed", "delivered": count}
+		}
+		return map[string]interface{}{"ok": true, "delivered": count}
+	})
 
-		server.BroadcastToRoom("/", room, "typing_end", typingData)
+	// 舊版的開始／結束輸入事件，等同於 is_typing 為 true／false 的 "typing"
+	on("typing_start", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
+		return handleTyping(chatService, s, payload, true)
+	})
+	on("typing_end", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
+		return handleTyping(chatService, s, payload, false)
 	})
 
 	// 当有新的客户端连线时触发 - 进行 Token 验证
@@ -494,30 +628,80 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			return fmt.Errorf("authentication error: invalid token")
 		}
 
+		connectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		// 已終止的會話或已刪除、停用的帳號不能再連線
+		if err := chatService.AuthorizeSocket(connectCtx, claims.UserID, claims.SessionID); err != nil {
+			cancel()
+			log.Printf("Connection rejected: User %s (session %s) is not allowed for socket %s. Error: %v", claims.UserID, claims.SessionID, s.ID(), err)
+			return fmt.Errorf("authentication error: %v", err)
+		}
+
 		user := &AuthenticatedUser{
-			ID:       claims.UserID,
-			Username: claims.Username,
+			ID:        claims.UserID,
+			Username:  claims.Username,
+			SessionID: claims.SessionID,
 		}
 		s.SetContext(user)
 
+		// 加入用户的私有频道，用于提及等只发给本人的事件
+		s.Join(services.UserChannel(user.ID))
+		chatService.RegisterSocket(s.ID(), user.ID, user.SessionID, tokenExpiry(claims))
+
+		// 自動加入用戶所在的所有聊天室
+		roomIDs, err := chatService.GetUserRoomIDs(connectCtx, user.ID)
+		if err != nil {
+			log.Printf("Failed to load rooms of user %s: %v", user.ID, err)
+		}
+		for _, roomID := range roomIDs {
+			s.Join(roomID)
+			chatService.TrackRoomJoin(s.ID(), roomID)
+		}
+		if err := chatService.PresenceConnect(connectCtx, s.ID(), user.ID); err != nil {
+			log.Printf("Failed to update presence for user %s: %v", user.ID, err)
+		}
+		cancel()
+
 		log.Printf("Socket connected and authenticated: UserID=%s, Username=%s, SocketID=%s", user.ID, user.Username, s.ID())
+
+		// 补发离线期间未确认的消息
+		go drainPendingDeliveries(chatService, s, user)
 		return nil
 	})
 
 	// 处理自定义的 "join_room" 事件
-	server.OnEvent("/", "join_room", func(s socketio.Conn, room string) {
+	on("join_room", func(s socketio.Conn, room string) map[string]interface{} {
 		user, ok := s.Context().(*AuthenticatedUser)
 		if !ok || user == nil {
 			log.Printf("Error: Could not get user from context for socket %s", s.ID())
-			return
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
+		}
+
+		// 只能加入自己所在的聊天室；私有频道只能在连线时由服务器加入
+		roomObjectID, err := primitive.ObjectIDFromHex(room)
+		if err != nil {
+			log.Printf("User %s tried to join invalid room %s", user.Username, room)
+			return map[string]interface{}{"ok": false, "error": "invalid_room"}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		isMember, err := chatService.IsUserInRoom(ctx, roomObjectID, user.ID)
+		if err != nil {
+			log.Printf("Failed to check membership of user %s in room %s: %v", user.ID, room, err)
+			return map[string]interface{}{"ok": false, "error": "room_access_check_failed"}
+		}
+		if !isMember {
+			log.Printf("User %s tried to join room %s without membership", user.Username, room)
+			return map[string]interface{}{"ok": false, "error": "not_in_room"}
 		}
 
 		s.Join(room)
+		chatService.TrackRoomJoin(s.ID(), room)
 		log.Printf("User %s (Socket %s) joined room: %s", user.Username, s.ID(), room)
+		return map[string]interface{}{"ok": true, "room": room}
 	})
 
 	// 处理自定义的 "leave_room" 事件
-	server.OnEvent("/", "leave_room", func(s socketio.Conn, room string) {
+	on("leave_room", func(s socketio.Conn, room string) {
 		user, ok := s.Context().(*AuthenticatedUser)
 		if !ok || user == nil {
 			log.Printf("Error: Could not get user from context for socket %s", s.ID())
@@ -525,11 +709,12 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 		}
 
 		s.Leave(room)
+		chatService.TrackRoomLeave(s.ID(), room)
 		log.Printf("User %s (Socket %s) left room: %s", user.Username, s.ID(), room)
 	})
 
 	// [關鍵修正] 處理心跳檢測
-	server.OnEvent("/", "ping", func(s socketio.Conn) {
+	on("ping", func(s socketio.Conn) {
 		user, ok := s.Context().(*AuthenticatedUser)
 		userInfo := "unknown"
 		if ok && user != nil {
@@ -537,10 +722,85 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 		}
 		log.Printf("Received ping from %s (Socket %s)", userInfo, s.ID())
 		s.Emit("pong")
+
+		if ok && user != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := chatService.PresenceHeartbeat(ctx, s.ID(), user.ID, nil); err != nil {
+				log.Printf("Failed to renew presence for user %s: %v", user.ID, err)
+			}
+		}
+	})
+
+	// 處理在線狀態心跳，客戶端以 idle 回報是否閒置
+	on("heartbeat", func(s socketio.Conn, payload HeartbeatPayload) map[string]interface{} {
+		user, ok := s.Context().(*AuthenticatedUser)
+		if !ok || user == nil {
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := chatService.PresenceHeartbeat(ctx, s.ID(), user.ID, &payload.Idle); err != nil {
+			log.Printf("Failed to update presence for user %s: %v", user.ID, err)
+			return map[string]interface{}{"ok": false, "error": "heartbeat_failed"}
+		}
+
+		status := models.PresenceOnline
+		if payload.Idle {
+			status = models.PresenceAway
+		}
+		return map[string]interface{}{"ok": true, "status": status}
+	})
+
+	// 處理重新驗證：客戶端以刷新後的 token 延長連線，無需重新連線
+	on("reauth", func(s socketio.Conn, payload ReauthPayload) map[string]interface{} {
+		user, ok := s.Context().(*AuthenticatedUser)
+		if !ok || user == nil {
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
+		}
+
+		claims, err := utils.VerifyJWT(payload.Token)
+		if err != nil {
+			log.Printf("Reauth rejected: Invalid token for socket %s. Error: %v", s.ID(), err)
+			return map[string]interface{}{"ok": false, "error": "invalid_token"}
+		}
+		if claims.UserID != user.ID {
+			log.Printf("Reauth rejected: Token of user %s presented on socket %s of user %s", claims.UserID, s.ID(), user.ID)
+			return map[string]interface{}{"ok": false, "error": "user_mismatch"}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := chatService.AuthorizeSocket(ctx, claims.UserID, claims.SessionID); err != nil {
+			log.Printf("Reauth rejected: User %s (session %s) on socket %s. Error: %v", claims.UserID, claims.SessionID, s.ID(), err)
+			switch {
+			case errors.Is(err, services.ErrSessionRevoked):
+				return map[string]interface{}{"ok": false, "error": "session_revoked"}
+			case errors.Is(err, services.ErrAccountUnavailable):
+				return map[string]interface{}{"ok": false, "error": "account_unavailable"}
+			}
+			return map[string]interface{}{"ok": false, "error": "reauth_failed"}
+		}
+
+		expiresAt := tokenExpiry(claims)
+		s.SetContext(&AuthenticatedUser{
+			ID:        claims.UserID,
+			Username:  claims.Username,
+			SessionID: claims.SessionID,
+		})
+		chatService.RenewSocket(s.ID(), claims.SessionID, expiresAt)
+		log.Printf("Socket %s of user %s reauthenticated", s.ID(), user.ID)
+
+		response := map[string]interface{}{"ok": true}
+		if !expiresAt.IsZero() {
+			response["expires_at"] = expiresAt.Format(time.RFC3339)
+		}
+		return response
 	})
 
 	// 处理自定义的 "chat_message" 事件
-	server.OnEvent("/", "chat_message", func(s socketio.Conn, payload ChatMessagePayload, ack func(map[string]interface{})) {
+	on("chat_message", func(s socketio.Conn, payload ChatMessagePayload, ack func(map[string]interface{})) {
 		respondError := func(message string) {
 			if ack != nil {
 				ack(map[string]interface{}{
@@ -549,13 +809,14 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 				})
 			}
 		}
-		respondSuccess := func(messageID string, timestamp string) {
+		respondSuccess := func(messageID string, timestamp string, seq int64) {
 			if ack != nil {
 				ack(map[string]interface{}{
 					"ok":         true,
 					"message_id": messageID,
 					"timestamp":  timestamp,
 					"temp_id":    payload.ID, // 🔥 新增：返回客戶端臨時 ID
+					"seq":        seq,
 				})
 			}
 		}
@@ -579,53 +840,60 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 		authCtx, authCancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer authCancel()
 
-		isMember, err := chatService.IsUserInRoom(authCtx, roomObjectID, user.ID)
-		if err != nil {
-			log.Printf("Failed to validate room access for UserID %s in room %s: %v", user.ID, payload.Room, err)
-			respondError("room_access_check_failed")
+		if err := chatService.CheckSendPermission(authCtx, roomObjectID, user.ID); err != nil {
+			switch {
+			case errors.Is(err, services.ErrNotRoomMember):
+				log.Printf("Unauthorized message attempt by UserID %s in room %s", user.ID, payload.Room)
+				respondError("not_in_room")
+			case errors.Is(err, services.ErrSenderBlocked):
+				log.Printf("Message rejected: User %s is blocked by a participant", user.ID)
+				respondError("blocked")
+			default:
+				log.Printf("Failed to validate room access for UserID %s in room %s: %v", user.ID, payload.Room, err)
+				respondError("room_access_check_failed")
+			}
 			return
 		}
-		if !isMember {
-			log.Printf("Unauthorized message attempt by UserID %s in room %s", user.ID, payload.Room)
-			respondError("not_in_room")
-			return
+
+		// 設置消息類型預設值
+		messageType := payload.Type
+		if messageType == "" {
+			messageType = "text"
+		}
+		if messageType == models.MessageTypeE2E {
+			if err := chatService.CheckE2ERoom(authCtx, roomObjectID); err != nil {
+				log.Printf("Rejected e2e message from %s in room %s: %v", user.Username, payload.Room, err)
+				if errors.Is(err, services.ErrE2EDirectOnly) {
+					respondError("e2e_direct_only")
+				} else {
+					respondError("room_access_check_failed")
+				}
+				return
+			}
 		}
 
-		participants, err := chatService.GetRoomParticipants(authCtx, roomObjectID)
+		replyOptions, replyFields, err := resolveReplyOptions(authCtx, chatService, payload.Room, payload.ReplyTo)
 		if err != nil {
-			log.Printf("Failed to get room participants for block check: %v", err)
-			respondError("internal_error")
+			log.Printf("Invalid reply_to %s from %s: %v", payload.ReplyTo, user.Username, err)
+			respondError("invalid_reply")
 			return
 		}
 
-		blockerIDs := make([]string, 0, len(participants))
-		for _, participantID := range participants {
-			if participantID != user.ID {
-				blockerIDs = append(blockerIDs, participantID)
-			}
-		}
-
-		if len(blockerIDs) > 0 {
-			isBlocked, err := chatService.IsUserBlockedByAny(authCtx, blockerIDs, user.ID)
+		// 在加密前解析 @username 与 @all（端到端加密的密文无法解析）
+		var mentions []string
+		var mentionAll bool
+		if messageType != models.MessageTypeE2E {
+			mentions, mentionAll, err = chatService.ResolveMentions(authCtx, roomObjectID, user.ID, payload.Content)
 			if err != nil {
-				log.Printf("Error checking block status: %v", err)
-			} else if isBlocked {
-				log.Printf("Message rejected: User %s is blocked by a participant", user.ID)
-				respondError("blocked")
-				return
+				log.Printf("Failed to resolve mentions in room %s: %v", payload.Room, err)
 			}
 		}
-
-		// 設置消息類型預設值
-		messageType := payload.Type
-		if messageType == "" {
-			messageType = "text"
-		}
+		messageOptions := append(replyOptions, services.WithMentions(mentions, mentionAll))
 
 		messageCtx, messageCancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer messageCancel()
 
-		messageToSave, err := chatService.SaveMessage(messageCtx, user.ID, user.Username, payload.Room, payload.Content, messageType, "", 0, 0)
+		messageToSave, err := chatService.SaveMessage(messageCtx, user.ID, user.Username, payload.Room, payload.Content, messageType, "", 0, 0, messageOptions...)
 		if err != nil {
 			log.Printf("Failed to save message to database: %v", err)
 			respondError("message_save_failed")
@@ -633,7 +901,7 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 		}
 
 		log.Printf("Message saved to database with ID: %s", messageToSave.ID.Hex())
-		respondSuccess(messageToSave.ID.Hex(), messageToSave.Timestamp.Format(time.RFC3339))
+		respondSuccess(messageToSave.ID.Hex(), messageToSave.Timestamp.Format(time.RFC3339), messageToSave.Seq)
 
 		// 3. [關鍵修正] 建立要廣播給客戶端的訊息物件，確保格式與前端模型一致
 		messageToBroadcast := map[string]interface{}{
@@ -646,18 +914,32 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 			"timestamp":   messageToSave.Timestamp.Format(time.RFC3339),
 			"type":        messageType,
 			"read_by":     []string{}, // 🔥 新增：初始已读列表
+			"seq":         messageToSave.Seq,
+		}
+		for key, value := range replyFields {
+			messageToBroadcast[key] = value
+		}
+		if messageToSave.ExpiresAt != nil {
+			messageToBroadcast["expires_at"] = messageToSave.ExpiresAt.Format(time.RFC3339)
+		}
+		if len(mentions) > 0 || mentionAll {
+			messageToBroadcast["mentions"] = mentions
+			messageToBroadcast["mention_all"] = mentionAll
 		}
 
 		// 4. [關鍵修正] 廣播給房間內所有用戶，包括發送者自己
 		log.Printf("Broadcasting message to room %s from %s: %s", payload.Room, user.Username, payload.Content)
 		server.BroadcastToRoom("/", payload.Room, "chat_message", messageToBroadcast)
 
+		// 通知被提及的用户（发送到各自的私有频道）
+		chatService.NotifyMentions(messageToSave, payload.Content)
+
 		// 5. 同步更新聊天室資訊
 		go func() {
 			updateCtx, updateCancel := context.WithTimeout(context.Background(), 10*time.Second)
 			defer updateCancel()
 
-			if err := chatService.UpdateRoomLastMessage(updateCtx, roomObjectID, payload.Content, messageToSave.Timestamp); err != nil {
+			if err := chatService.UpdateRoomPreview(updateCtx, roomObjectID, messageToSave, payload.Content); err != nil {
 				log.Printf("Failed to update room last message: %v", err)
 			} else {
 				log.Printf("Room %s last message updated successfully", payload.Room)
@@ -665,36 +947,227 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 		}()
 	})
 
-	// 处理打字状態
-	server.OnEvent("/", "typing", func(s socketio.Conn, data map[string]interface{}) {
+	// 🔥 新增：处理 "edit_message" 事件，只有发送者可以在时限内编辑自己的文字消息
+	on("edit_message", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
 		user, ok := s.Context().(*AuthenticatedUser)
 		if !ok || user == nil {
 			log.Printf("Error: Could not get user from context for socket %s", s.ID())
-			return
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
 		}
 
-		room, ok := data["room"].(string)
-		if !ok {
-			log.Printf("Invalid room in typing event from %s", user.Username)
-			return
+		room, _ := payload["room"].(string)
+		messageID, _ := payload["message_id"].(string)
+		content, _ := payload["content"].(string)
+		if room == "" || messageID == "" || strings.TrimSpace(content) == "" {
+			return map[string]interface{}{"ok": false, "error": "invalid_payload"}
 		}
 
-		isTyping, ok := data["is_typing"].(bool)
+		roomObjectID, err := primitive.ObjectIDFromHex(room)
+		if err != nil {
+			return map[string]interface{}{"ok": false, "error": "invalid_room"}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		isMember, err := chatService.IsUserInRoom(ctx, roomObjectID, user.ID)
+		if err != nil {
+			log.Printf("Failed to validate room access for UserID %s in room %s: %v", user.ID, room, err)
+			return map[string]interface{}{"ok": false, "error": "room_access_check_failed"}
+		}
+		if !isMember {
+			return map[string]interface{}{"ok": false, "error": "not_in_room"}
+		}
+
+		message, err := chatService.EditMessage(ctx, room, messageID, user.ID, content, cfg.MessageEditWindow)
+		if err != nil {
+			log.Printf("Failed to edit message %s by %s: %v", messageID, user.Username, err)
+			return map[string]interface{}{"ok": false, "error": editErrorCode(err)}
+		}
+
+		editedData := services.MessageEditedPayload(message, content)
+		log.Printf("User %s edited message %s in room %s", user.Username, messageID, room)
+		server.BroadcastToRoom("/", room, "message_edited", editedData)
+
+		return map[string]interface{}{
+			"ok":         true,
+			"message_id": messageID,
+			"edited_at":  editedData["edited_at"],
+		}
+	})
+
+	// 🔥 新增：处理 "forward_messages" 事件，把消息复制到用户所在的其他聊天室
+	on("forward_messages", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
+		user, ok := s.Context().(*AuthenticatedUser)
+		if !ok || user == nil {
+			log.Printf("Error: Could not get user from context for socket %s", s.ID())
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
+		}
+
+		sourceRoom, _ := payload["source_room"].(string)
+		messageIDs := toStringSlice(payload["message_ids"])
+		targetRooms := toStringSlice(payload["target_rooms"])
+		if sourceRoom == "" || len(messageIDs) == 0 || len(targetRooms) == 0 {
+			return map[string]interface{}{"ok": false, "error": "invalid_payload"}
+		}
+		if len(messageIDs) > services.MaxForwardMessages || len(targetRooms) > services.MaxForwardTargets {
+			return map[string]interface{}{"ok": false, "error": "too_many"}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		results, err := chatService.ForwardMessages(ctx, user.ID, user.Username, sourceRoom, messageIDs, targetRooms)
+		if err != nil {
+			log.Printf("Failed to forward messages from room %s by %s: %v", sourceRoom, user.Username, err)
+			switch {
+			case errors.Is(err, services.ErrRoomNotFound), errors.Is(err, services.ErrNotRoomMember):
+				return map[string]interface{}{"ok": false, "error": "not_in_room"}
+			case errors.Is(err, services.ErrNothingToForward):
+				return map[string]interface{}{"ok": false, "error": "message_not_found"}
+			default:
+				return map[string]interface{}{"ok": false, "error": "internal_error"}
+			}
+		}
+
+		return map[string]interface{}{"ok": true, "results": results}
+	})
+
+	// 🔥 新增：处理表情回应，"add_reaction" 与 "remove_reaction" 共用同一流程
+	handleReaction := func(s socketio.Conn, payload map[string]interface{}, action string) map[string]interface{} {
+		user, ok := s.Context().(*AuthenticatedUser)
+		if !ok || user == nil {
+			log.Printf("Error: Could not get user from context for socket %s", s.ID())
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
+		}
+
+		room, _ := payload["room"].(string)
+		messageID, _ := payload["message_id"].(string)
+		emoji, _ := payload["emoji"].(string)
+		emoji = strings.TrimSpace(emoji)
+		if room == "" || messageID == "" {
+			return map[string]interface{}{"ok": false, "error": "invalid_payload"}
+		}
+
+		roomObjectID, err := primitive.ObjectIDFromHex(room)
+		if err != nil {
+			return map[string]interface{}{"ok": false, "error": "invalid_room"}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		isMember, err := chatService.IsUserInRoom(ctx, roomObjectID, user.ID)
+		if err != nil {
+			log.Printf("Failed to validate room access for UserID %s in room %s: %v", user.ID, room, err)
+			return map[string]interface{}{"ok": false, "error": "room_access_check_failed"}
+		}
+		if !isMember {
+			return map[string]interface{}{"ok": false, "error": "not_in_room"}
+		}
+
+		var message models.Message
+		if action == "add" {
+			message, err = chatService.AddReaction(ctx, room, messageID, user.ID, emoji)
+		} else {
+			message, err = chatService.RemoveReaction(ctx, room, messageID, user.ID, emoji)
+		}
+		if err != nil {
+			log.Printf("Failed to %s reaction on message %s by %s: %v", action, messageID, user.Username, err)
+			switch {
+			case errors.Is(err, services.ErrInvalidReaction):
+				return map[string]interface{}{"ok": false, "error": "invalid_emoji"}
+			case errors.Is(err, services.ErrReactionLimitReached):
+				return map[string]interface{}{"ok": false, "error": "reaction_limit_reached"}
+			case errors.Is(err, services.ErrMessageNotFound):
+				return map[string]interface{}{"ok": false, "error": "message_not_found"}
+			default:
+				return map[string]interface{}{"ok": false, "error": "internal_error"}
+			}
+		}
+
+		reactionData := services.ReactionUpdatedPayload(message, user.ID, emoji, action)
+		server.BroadcastToRoom("/", room, "reaction_updated", reactionData)
+
+		return map[string]interface{}{
+			"ok":         true,
+			"message_id": messageID,
+			"reactions":  reactionData["reactions"],
+		}
+	}
+
+	on("add_reaction", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
+		return handleReaction(s, payload, "add")
+	})
+
+	on("remove_reaction", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
+		return handleReaction(s, payload, "remove")
+	})
+
+	// 处理打字状態
+	// 處理輸入狀態：payload 為 { room, is_typing }，持續輸入時每隔幾秒重送
+	// 其他成員收到 "typing_users"（聊天室中正在輸入的用戶列表，不含自己），超時未重送即自動結束
+	on("typing", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
+		isTyping, ok := payload["is_typing"].(bool)
 		if !ok {
-			log.Printf("Invalid is_typing in typing event from %s", user.Username)
-			return
+			isTyping = true
+		}
+		return handleTyping(chatService, s, payload, isTyping)
+	})
+
+	// 🔥 新增：处理 "sync" 事件，客户端重连后补齐所有聊天室断线期间的变更
+	// payload: { since: RFC3339, rooms: { roomID: { last_seq, last_id } }, batch_size }
+	// 立即回传摘要作为 ack，之后以 "sync_batch" 分批推送，客户端 ack 后才发送下一批，最后发送 "sync_complete"
+	on("sync", func(s socketio.Conn, payload map[string]interface{}) map[string]interface{} {
+		user, ok := s.Context().(*AuthenticatedUser)
+		if !ok || user == nil {
+			return map[string]interface{}{"ok": false, "error": "unauthorized"}
+		}
+
+		request, err := parseSyncPayload(payload)
+		if err != nil {
+			return map[string]interface{}{"ok": false, "error": "invalid_payload", "message": err.Error()}
+		}
+
+		// 先记录服务器时间，作为客户端下次同步的 since，避免漏掉查询期间产生的变更
+		serverTime := time.Now()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		roomIDs, err := chatService.GetUserRoomIDs(ctx, user.ID)
+		if err != nil {
+			log.Printf("Failed to load rooms for sync (user %s): %v", user.Username, err)
+			return map[string]interface{}{"ok": false, "error": "room_load_failed"}
 		}
 
-		// 廣播打字狀態給房間内的其他用戶（不包括發送者自己）
-		typingData := map[string]interface{}{
-			"user_id":   user.ID,
-			"username":  user.Username,
-			"room":      room,
-			"is_typing": isTyping,
+		results := make([]services.RoomSyncResult, 0, len(roomIDs))
+		for _, roomID := range roomIDs {
+			var cursor *services.SyncCursor
+			if c, exists := request.rooms[roomID]; exists {
+				cursor = &c
+			}
+			result, err := chatService.CollectRoomChanges(ctx, roomID, cursor, request.since, syncRoomMessageLimit)
+			if err != nil {
+				log.Printf("Failed to collect sync changes for room %s: %v", roomID, err)
+				continue
+			}
+			results = append(results, result)
 		}
 
-		log.Printf("Broadcasting typing status from %s in room %s: %v", user.Username, room, isTyping)
-		server.BroadcastToRoom("/", room, "typing", typingData)
+		batches := buildSyncBatches(results, request.batchSize)
+		syncID := primitive.NewObjectID().Hex()
+
+		log.Printf("User %s sync %s: %d rooms, %d batches", user.Username, syncID, len(roomIDs), len(batches))
+		go emitSyncBatches(s, syncID, batches, serverTime)
+
+		return map[string]interface{}{
+			"ok":            true,
+			"sync_id":       syncID,
+			"rooms":         len(roomIDs),
+			"total_batches": len(batches),
+			"server_time":   serverTime.Format(time.RFC3339Nano),
+		}
 	})
 
 	// 當客戶端發生錯誤時觸發
@@ -715,12 +1188,28 @@ func NewSocketIOServer(chatService *services.ChatService, redisOptions *socketio
 
 	// 當客戶端斷線時觸發
 	server.OnDisconnect("/", func(s socketio.Conn, reason string) {
+		chatService.UnregisterSocket(s.ID())
+
 		// 這裡使用了安全的 "comma-ok" 型別斷言
 		user, ok := s.Context().(*AuthenticatedUser)
+		if revoked, isRevoked := s.Context().(*revokedUser); isRevoked {
+			// 被強制斷開的連線已停止處理事件，仍需清理在線與輸入狀態
+			user, ok = revoked.user, true
+		}
 
 		// 只有在 ok 為 true 且 user 不為 nil 的情況下，才會執行這個區塊
 		if ok && user != nil {
 			log.Printf("User %s disconnected (SocketID: %s): %s", user.Username, s.ID(), reason)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := chatService.PresenceDisconnect(ctx, s.ID(), user.ID); err != nil {
+				log.Printf("Failed to update presence for user %s: %v", user.ID, err)
+			}
+			chatService.StopSocketTyping(ctx, s.ID())
+			cancel()
+			if !chatService.IsUserConnected(user.ID) {
+				limiter.forget(user.ID)
+			}
 		} else {
 			// 如果使用者未經驗證 (例如 Token 過期被拒絕)，則會安全地執行這個區塊
 			log.Printf("Unauthenticated socket disconnected (SocketID: %s): %s", s.ID(), reason)
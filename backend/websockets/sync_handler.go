@@ -0,0 +1,127 @@
+package websockets
+
+import (
+	"errors"
+	"time"
+
+	"chatwme/backend/services"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+const (
+	defaultSyncBatchSize = 100
+	maxSyncBatchSize     = 500
+	syncRoomMessageLimit = 1000 // 每個聊天室最多補齊的消息數，超過時 has_more 為 true
+)
+
+type syncRequest struct {
+	since     *time.Time
+	rooms     map[string]services.SyncCursor
+	batchSize int
+}
+
+// parseSyncPayload 解析 "sync" 事件的參數
+func parseSyncPayload(payload map[string]interface{}) (syncRequest, error) {
+	request := syncRequest{
+		rooms:     map[string]services.SyncCursor{},
+		batchSize: defaultSyncBatchSize,
+	}
+
+	if sinceStr, ok := payload["since"].(string); ok && sinceStr != "" {
+		since, err := time.Parse(time.RFC3339Nano, sinceStr)
+		if err != nil {
+			return request, errors.New("since 必須是 RFC3339 格式的時間")
+		}
+		request.since = &since
+	}
+
+	if rooms, ok := payload["rooms"].(map[string]interface{}); ok {
+		for roomID, raw := range rooms {
+			entry, ok := raw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			cursor := services.SyncCursor{LastSeq: toInt64(entry["last_seq"])}
+			if lastID, ok := entry["last_id"].(string); ok {
+				cursor.LastID = lastID
+			}
+			request.rooms[roomID] = cursor
+		}
+	}
+
+	if size := toInt(payload["batch_size"]); size > 0 {
+		request.batchSize = min(size, maxSyncBatchSize)
+	}
+
+	return request, nil
+}
+
+// buildSyncBatches 將各聊天室的變更切分成批次，每批最多 batchSize 項（消息、刪除與已讀變更合計）
+// 單個聊天室的變更可能跨越多個批次，每個片段都帶有 room 以便客戶端合併
+// 游標失效的聊天室即使沒有任何變更也會輸出一個片段，讓客戶端知道需要重新載入
+func buildSyncBatches(results []services.RoomSyncResult, batchSize int) [][]map[string]interface{} {
+	var batches [][]map[string]interface{}
+	var current []map[string]interface{}
+	used := 0
+
+	for _, result := range results {
+		messages, deletions, receipts := result.Messages, result.Deletions, result.ReadReceipts
+		first := true
+		for len(messages)+len(deletions)+len(receipts) > 0 || (first && result.CursorNotFound) {
+			first = false
+			if used >= batchSize {
+				batches = append(batches, current)
+				current, used = nil, 0
+			}
+
+			capacity := batchSize - used
+			take := func(items []map[string]interface{}) ([]map[string]interface{}, []map[string]interface{}) {
+				n := min(len(items), capacity)
+				capacity -= n
+				return items[:n], items[n:]
+			}
+
+			segment := map[string]interface{}{
+				"room":             result.RoomID,
+				"has_more":         result.HasMore,
+				"cursor_not_found": result.CursorNotFound,
+			}
+			segment["messages"], messages = take(messages)
+			segment["deletions"], deletions = take(deletions)
+			segment["read_receipts"], receipts = take(receipts)
+
+			current = append(current, segment)
+			used = batchSize - capacity
+		}
+	}
+
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches
+}
+
+// emitSyncBatches 逐批推送同步結果，客戶端確認（ack）上一批後才發送下一批
+func emitSyncBatches(s socketio.Conn, syncID string, batches [][]map[string]interface{}, serverTime time.Time) {
+	var send func(index int)
+	send = func(index int) {
+		if index >= len(batches) {
+			s.Emit("sync_complete", map[string]interface{}{
+				"sync_id":     syncID,
+				"server_time": serverTime.Format(time.RFC3339Nano),
+			})
+			return
+		}
+
+		s.Emit("sync_batch", map[string]interface{}{
+			"sync_id":       syncID,
+			"batch":         index + 1,
+			"total_batches": len(batches),
+			"rooms":         batches[index],
+		}, func() {
+			send(index + 1)
+		})
+	}
+	send(0)
+}
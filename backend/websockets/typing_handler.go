@@ -0,0 +1,36 @@
+package websockets
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chatwme/backend/services"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// handleTyping 更新用戶在聊天室中的輸入狀態，"typing"、"typing_start" 與 "typing_end" 共用
+func handleTyping(chatService *services.ChatService, s socketio.Conn, payload map[string]interface{}, isTyping bool) map[string]interface{} {
+	user, ok := s.Context().(*AuthenticatedUser)
+	if !ok || user == nil {
+		return map[string]interface{}{"ok": false, "error": "unauthorized"}
+	}
+
+	room, ok := payload["room"].(string)
+	if !ok || room == "" {
+		return map[string]interface{}{"ok": false, "error": "invalid_room"}
+	}
+	// 只能在已加入的聊天室中發送，加入時已檢查成員身份
+	if !chatService.HasSocketInRoom(room, user.ID) {
+		return map[string]interface{}{"ok": false, "error": "not_in_room"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := chatService.SetTyping(ctx, s.ID(), room, user.ID, user.Username, isTyping); err != nil {
+		log.Printf("Failed to update typing state of user %s in room %s: %v", user.ID, room, err)
+		return map[string]interface{}{"ok": false, "error": "typing_update_failed"}
+	}
+	return map[string]interface{}{"ok": true}
+}